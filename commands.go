@@ -0,0 +1,315 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/liuqx0717/FolderChecksum/folderchecksum"
+)
+
+// A command runs instead of the default scan when its name is the first
+// argument, e.g., "FolderChecksum runs <rootdir>". Use "./runs" for a
+// <rootdir> with the same name as a command.
+type command struct {
+	name  string
+	usage string // the positional arguments
+	desc  string
+	run   func(cmd *command, args []string)
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{
+			name:  "runs",
+			usage: "<rootdir>",
+			desc: "List the runs recorded by -history: the id, the time, and\n" +
+				"the number of entries new or changed in that run.",
+			run: runRunsCommand,
+		},
+		{
+			name:  "history",
+			usage: "<rootdir> <path>",
+			desc: "Print the changes of <path> recorded by -history, one per\n" +
+				"line: the run id, the time, the status (new, changed,\n" +
+				"metachanged or deleted), the size and the checksum (the\n" +
+				"target of a symlink, or - for a folder).",
+			run: runHistoryCommand,
+		},
+		{
+			name:  "export",
+			usage: "<rootdir> [<prefix>...]",
+			desc: "Write the checksums in <dbfile> in the format of md5sum (or\n" +
+				"sha256sum, etc.), which can be verified by \"md5sum -c\" in\n" +
+				"<rootdir>. Only the regular files hashed by -hash are written.",
+			run: runExportCommand,
+		},
+		{
+			name:  "mtree",
+			usage: "<rootdir> [<prefix>...]",
+			desc: "Write the entries in <dbfile> as an mtree spec, with the type,\n" +
+				"mode, size and digest (md5, sha256 or sha512) keywords. Use\n" +
+				"-mtree of the default command to compare a folder against it.",
+			run: runMtreeCommand,
+		},
+		{
+			name:  "import",
+			usage: "<rootdir> <manifest>...",
+			desc: "Add the checksums in the manifests (made by md5sum, sha256sum,\n" +
+				"etc., in GNU or BSD-style format, hashdeep, or SFV) to <dbfile>,\n" +
+				"so that <rootdir> can be compared against them. The paths must\n" +
+				"be relative to <rootdir>, and not in <dbfile> yet.",
+			run: runImportCommand,
+		},
+		{
+			name:  "diff",
+			usage: "<olddb> <newdb>",
+			desc: "Compare two database files (or two runs recorded by -history)\n" +
+				"without reading any folder, and output the differences as if\n" +
+				"<newdb> were the result of scanning the folder in <olddb>.",
+			run: runDiffCommand,
+		},
+	}
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// Print the commands in the usage of the default scan.
+func printCommands() {
+	w := flag.CommandLine.Output()
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  FolderChecksum %s [OPTIONS] %s\n", cmd.name, cmd.usage)
+		fmt.Fprintf(w, "    \t%s\n",
+			strings.ReplaceAll(cmd.desc, "\n", "\n    \t"))
+	}
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "  Use \"FolderChecksum <command> -h\" for the options of a command.")
+	fmt.Fprintln(w, "")
+}
+
+// Set by -loglevel of the commands.
+var commandLogLevel int
+
+// The logger of the commands, set by parseCommandFlags.
+var commandLogger *folderchecksum.Logger
+
+// Return a FlagSet for cmd, with the options shared by all the commands.
+func newCommandFlagSet(cmd *command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	fs.Usage = func() {
+		w := fs.Output()
+		fmt.Fprintln(w, "")
+		fmt.Fprintln(w, "Usage:")
+		fmt.Fprintln(w, "")
+		fmt.Fprintf(w, "  FolderChecksum %s [OPTIONS] %s\n", cmd.name, cmd.usage)
+		fmt.Fprintln(w, "")
+		fmt.Fprintf(w, "  %s\n", strings.ReplaceAll(cmd.desc, "\n", "\n  "))
+		fmt.Fprintln(w, "")
+		fmt.Fprintln(w, "Options:")
+		fmt.Fprintln(w, "")
+		fs.PrintDefaults()
+	}
+	fs.IntVar(&commandLogLevel, "loglevel", folderchecksum.INFO,
+		"Set log level (ERROR=0, WARNING=1, INFO=2, DEBUG=3).")
+	return fs
+}
+
+// Parse args by fs returned by newCommandFlagSet.
+func parseCommandFlags(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+	commandLogger = folderchecksum.NewLogger(os.Stderr, commandLogLevel)
+}
+
+// Add -dbfile to fs. Return a function to get the path of the db file
+// under <rootdir> after parsing.
+func addDbFileFlag(fs *flag.FlagSet) func(rootDir string) string {
+	dbFile := fs.String("dbfile", ".checksum.db",
+		"Set database file name, same as the default command.")
+	return func(rootDir string) string {
+		path, err := folderchecksum.DbFilePath(rootDir, *dbFile)
+		if err != nil {
+			logFatal("%s", err.Error())
+		}
+		return path
+	}
+}
+
+// Add -exclude and -include to fs. Return a function to set the patterns in
+// opts after parsing.
+func addFilterFlags(fs *flag.FlagSet) func(opts *folderchecksum.ExportOptions) {
+	var excludeList, includeList flagValues
+	fs.Var(&excludeList, "exclude",
+		"Append a regex pattern to the <exclude> list, same as the default\n"+
+			"command.")
+	fs.Var(&includeList, "include",
+		"Append a regex pattern to the <include> list, same as the default\n"+
+			"command.")
+	return func(opts *folderchecksum.ExportOptions) {
+		opts.Exclude = excludeList
+		opts.Include = includeList
+	}
+}
+
+// Add the options controlling the output to fs. Return a function to set
+// them in opts after parsing.
+func addOutputFlags(fs *flag.FlagSet) func(opts *folderchecksum.DiffOptions) {
+	format := fs.String("format", "text",
+		"Set the output format ("+
+			strings.Join(folderchecksum.OutputFormats(), ", ")+"), "+
+			"same as the\ndefault command.")
+	nul := fs.Bool("0", false,
+		"Terminate the output records with NUL instead of newline, same as\n"+
+			"the default command.")
+	track := fs.String("track", "",
+		"Report the changes of these attributes (a comma separated list\n"+
+			"of "+strings.Join(folderchecksum.AttrNames(), ", ")+
+			"), same as the default command.")
+	return func(opts *folderchecksum.DiffOptions) {
+		opts.Format = *format
+		opts.Nul = *nul
+		opts.Track = splitList(*track)
+		opts.Output = os.Stdout
+	}
+}
+
+func runDiffCommand(cmd *command, args []string) {
+	fs := newCommandFlagSet(cmd)
+	setOutput := addOutputFlags(fs)
+	fromRun := fs.Int64("from", 0,
+		"Use the snapshot of <olddb> right after this run.")
+	toRun := fs.Int64("to", 0,
+		"Use the snapshot of <newdb> right after this run.")
+	parseCommandFlags(fs, args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		logFatal("Expected exactly two args <olddb> <newdb>")
+	}
+
+	opts := folderchecksum.DiffOptions{
+		OldDb:   fs.Arg(0),
+		NewDb:   fs.Arg(1),
+		FromRun: *fromRun,
+		ToRun:   *toRun,
+		Logger:  commandLogger,
+	}
+	setOutput(&opts)
+	if _, err := folderchecksum.Diff(opts); err != nil {
+		logFatal("%s", err.Error())
+	}
+}
+
+func runHistoryCommand(cmd *command, args []string) {
+	fs := newCommandFlagSet(cmd)
+	getDbFile := addDbFileFlag(fs)
+	parseCommandFlags(fs, args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		logFatal("Expected exactly two args <rootdir> <path>")
+	}
+
+	err := folderchecksum.PrintHistory(getDbFile(fs.Arg(0)), fs.Arg(1),
+		os.Stdout)
+	if err != nil {
+		logFatal("%s", err.Error())
+	}
+}
+
+func runExportCommand(cmd *command, args []string) {
+	fs := newCommandFlagSet(cmd)
+	getDbFile := addDbFileFlag(fs)
+	setFilters := addFilterFlags(fs)
+	hashAlgo := fs.String("hash", "",
+		"Write the checksums computed by this algorithm ("+
+			strings.Join(folderchecksum.HashAlgoNames(), ", ")+").\n"+
+			"Use the one recorded in <dbfile> by default.")
+	tagged := fs.Bool("tag", false,
+		"Use the BSD-style tagged format, i.e., \"MD5 (<path>) = <checksum>\".")
+	parseCommandFlags(fs, args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		logFatal("Expected args <rootdir> [<prefix>...]")
+	}
+
+	opts := folderchecksum.ExportOptions{
+		DbFile:   getDbFile(fs.Arg(0)),
+		Prefixes: fs.Args()[1:],
+		HashAlgo: *hashAlgo,
+		Tagged:   *tagged,
+		Logger:   commandLogger,
+	}
+	setFilters(&opts)
+	if _, err := folderchecksum.Export(opts, os.Stdout); err != nil {
+		logFatal("%s", err.Error())
+	}
+}
+
+func runMtreeCommand(cmd *command, args []string) {
+	fs := newCommandFlagSet(cmd)
+	getDbFile := addDbFileFlag(fs)
+	setFilters := addFilterFlags(fs)
+	parseCommandFlags(fs, args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		logFatal("Expected args <rootdir> [<prefix>...]")
+	}
+
+	opts := folderchecksum.ExportOptions{
+		DbFile:   getDbFile(fs.Arg(0)),
+		Prefixes: fs.Args()[1:],
+		Logger:   commandLogger,
+	}
+	setFilters(&opts)
+	if _, err := folderchecksum.ExportMtree(opts, os.Stdout); err != nil {
+		logFatal("%s", err.Error())
+	}
+}
+
+func runImportCommand(cmd *command, args []string) {
+	fs := newCommandFlagSet(cmd)
+	getDbFile := addDbFileFlag(fs)
+	format := fs.String("format", "auto",
+		"Set the format of the manifests ("+
+			strings.Join(folderchecksum.ManifestFormats(), ", ")+"). auto\n"+
+			"detects the format from the first line.")
+	hashAlgo := fs.String("hash", "",
+		"Set the algorithm of the checksums in gnu format, or the column\n"+
+			"to import in hashdeep format. By default it's determined by the\n"+
+			"length of the checksums (e.g., 32 for md5), or the first\n"+
+			"supported column.")
+	parseCommandFlags(fs, args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		logFatal("Expected args <rootdir> <manifest>...")
+	}
+
+	_, err := folderchecksum.Import(getDbFile(fs.Arg(0)), fs.Args()[1:],
+		*format, *hashAlgo, commandLogger)
+	if err != nil {
+		logFatal("%s", err.Error())
+	}
+}
+
+func runRunsCommand(cmd *command, args []string) {
+	fs := newCommandFlagSet(cmd)
+	getDbFile := addDbFileFlag(fs)
+	parseCommandFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		logFatal("Expected exactly one arg <rootdir>")
+	}
+
+	err := folderchecksum.ListRuns(getDbFile(fs.Arg(0)), os.Stdout)
+	if err != nil {
+		logFatal("%s", err.Error())
+	}
+}
@@ -1,16 +1,13 @@
 package main
 
 import (
-	"database/sql"
 	"flag"
 	"fmt"
-	"io"
 	"os"
-	"path"
-	"path/filepath"
-	"regexp"
 	"runtime"
 	"strings"
+
+	"github.com/liuqx0717/FolderChecksum/folderchecksum"
 )
 
 type flagValues []string
@@ -32,30 +29,36 @@ type flags struct {
 	excludeList flagValues
 	includeList flagValues
 	followLinks bool
+	trackLinks  bool
+	trackDirs   bool
 	sizeOnly    bool
+	quick       bool
+	track       string
+	xattrs      string
 	update      bool
+	hashAlgo    string
+	migrate     int64
+	format      string
+	nul         bool
+	sort        bool
+	moves       bool
+	copies      bool
+	history     bool
+	snapshot    int64
+	mtree       string
+	keepGoing   bool
+	retries     int
 	rootDir     string
 	prefix      flagValues
 }
 
 var flg flags
 
-type config struct {
-	j           int
-	dbFile      string
-	db          *sql.DB        // thread safe
-	excludeRe   *regexp.Regexp // thread safe
-	includeRe   *regexp.Regexp // thread safe
-	followLinks bool
-	sizeOnly    bool
-	update      bool
-	outFile     io.Writer
-	rootDir     string
-	prefix      []string
-}
-
 func init() {
 	s := "'" + string(os.PathSeparator) + "'"
+	attrs := strings.Join(folderchecksum.AttrNames(), ", ")
+	hashAlgos := strings.Join(folderchecksum.HashAlgoNames(), ", ")
+	formats := strings.Join(folderchecksum.OutputFormats(), ", ")
 	flag.Usage = func() {
 		w := flag.CommandLine.Output()
 		fmt.Fprintln(w, "")
@@ -67,11 +70,14 @@ func init() {
 		fmt.Fprintln(w, "  the checksums stored in <dbfile>, and update <dbfile> when -update is")
 		fmt.Fprintln(w, "  used.")
 		fmt.Fprintln(w, "")
+		fmt.Fprintln(w, "Commands:")
+		fmt.Fprintln(w, "")
+		printCommands()
 		fmt.Fprintln(w, "Positional Arguments:")
 		fmt.Fprintln(w, "")
 		fmt.Fprintln(w, "  <rootdir>")
 		fmt.Fprintln(w, "    \tThe root folder to calculate the checksums. For each subfile, the")
-		fmt.Fprintln(w, "    \tpath relative to <rootdir>, the size, and the md5 checksum will be")
+		fmt.Fprintln(w, "    \tpath relative to <rootdir>, the size, and the checksum will be")
 		fmt.Fprintln(w, "    \tstored into <dbfile>. <rootdir> must be a folder.")
 		fmt.Fprintln(w, "")
 		fmt.Fprintln(w, "  <prefix>")
@@ -110,9 +116,10 @@ func init() {
 		fmt.Fprintln(w, "  Then these paths will be tested against the patterns:")
 		fmt.Fprintln(w, "    file1")
 		fmt.Fprintln(w, "    subdir1/file1")
-		fmt.Fprintln(w, "  Note that only files are tested (folders are ignored). Also note that")
-		fmt.Fprintln(w, "  slash (/) should always be used as the path separator in patterns, even")
-		fmt.Fprintln(w, "  on Windows.")
+		fmt.Fprintln(w, "  Note that only files are tested (folders are ignored unless -trackdirs")
+		fmt.Fprintln(w, "  is used, and excluding a folder never excludes its subfiles). Also note")
+		fmt.Fprintln(w, "  that slash (/) should always be used as the path separator in patterns,")
+		fmt.Fprintln(w, "  even on Windows.")
 		fmt.Fprintln(w, "")
 		fmt.Fprintln(w, "  This tool will automatically add a leading '^' and trailing '$' for each")
 		fmt.Fprintln(w, "  specified pattern.")
@@ -120,18 +127,20 @@ func init() {
 	}
 	flag.BoolVar(&flg.version, "version", false,
 		"Display version number and exit.\n")
-	flag.IntVar(&flg.logLevel, "loglevel", INFO,
+	flag.IntVar(&flg.logLevel, "loglevel", folderchecksum.INFO,
 		"Set log level (ERROR=0, WARNING=1, INFO=2, DEBUG=3). Logs greater\n"+
 			"than or equal to this level will be printed to stderr.\n")
 	flag.IntVar(&flg.j, "j", runtime.NumCPU(),
 		"Set the number of workers to parallelly read the files. For SSD\n"+
-			"only. Use 1 if <rootdir> is on a HDD.\n")
+			"only. Use 1 if <rootdir> is on a HDD. 0 means the number of CPU\n"+
+			"cores.\n")
 	flag.StringVar(&flg.dbFile, "dbfile", ".checksum.db",
 		"Set database file name. If it doesn't contain any "+s+", the file\n"+
 			"will be put into <rootdir> and will be automatically added to the\n"+
 			"<exclude> list. If it contains at least one "+s+", the file will be\n"+
 			"located using the path (for absolute paths) or current working\n"+
-			"directory (for relative paths).\n")
+			"directory (for relative paths). A file name ending with .txt\n"+
+			"is a text database file, which can be committed to git.\n")
 	flag.Var(&flg.excludeList, "exclude",
 		"Append a regex pattern to the <exclude> list. This option may be\n"+
 			"repeated. See Pattern Matching section for more details.")
@@ -140,13 +149,105 @@ func init() {
 			"repeated. See Pattern Matching section for more details.")
 	flag.BoolVar(&flg.followLinks, "followlinks", false,
 		"Follow symlinks as if the targets themselves are in the folder (\n"+
-			"fail on broken links). By default symlinks in <rootdir> and <prefix>\n"+
-			"are followed and others are skipped.")
+			"broken links are errors, see -keep-going). By default symlinks in\n"+
+			"<rootdir> and <prefix> are followed and others are skipped. A\n"+
+			"symlink pointing to one of the folders containing it (i.e., a\n"+
+			"loop) is skipped.")
+	flag.BoolVar(&flg.trackLinks, "tracklinks", false,
+		"Record the symlinks in <rootdir> themselves (instead of skipping\n"+
+			"them) as entries in <dbfile>, so that retargeted and removed\n"+
+			"links are reported. Their targets are not followed. Can't be\n"+
+			"used with -followlinks. Without this option, the links recorded\n"+
+			"in <dbfile> are reported as deleted.")
+	flag.BoolVar(&flg.trackDirs, "trackdirs", false,
+		"Record the folders in <rootdir> (including empty ones) as entries\n"+
+			"in <dbfile>, so that new and deleted folders are reported. The\n"+
+			"folder paths are also tested against the patterns. Without this\n"+
+			"option, the folders recorded in <dbfile> are reported as deleted.")
 	flag.BoolVar(&flg.sizeOnly, "sizeonly", false,
 		"Detect changes only by checking file sizes (instead of checksums).")
+	flag.BoolVar(&flg.quick, "quick", false,
+		"Deem a file unchanged without reading it if its size, mtime, ctime,\n"+
+			"inode and device number are the same as recorded in <dbfile>.\n"+
+			"Only the files whose stat tuple differs are read. The stat tuple\n"+
+			"is always recorded by -update. ctime, inode and device number are\n"+
+			"only available on Linux and macOS.")
+	flag.StringVar(&flg.track, "track", "",
+		"Report the changes of these attributes (a comma separated list\n"+
+			"of "+attrs+") as \"metachanged:\" with the\n"+
+			"old and new values. All of them are always recorded by -update.\n"+
+			"uid and gid are only available on Linux and macOS.")
+	flag.StringVar(&flg.xattrs, "xattrs", "",
+		"Record a digest of the extended attributes in these namespaces (a\n"+
+			"comma separated list, e.g. \"security,system\" for SELinux labels\n"+
+			"and POSIX ACLs), and report their changes as \"metachanged:\".\n"+
+			"Only supported on Linux.")
 	flag.BoolVar(&flg.update, "update", false,
 		"Update the <dbfile>. By default this tool only compares current\n"+
 			"<rootdir> against <dbfile> without modifying <dbfile>.")
+	flag.StringVar(&flg.hashAlgo, "hash", "",
+		"Set the hash algorithm ("+hashAlgos+").\n"+
+			"The algorithm is recorded in <dbfile> by -update, and the recorded\n"+
+			"one is used by default afterwards. Specifying a different one is\n"+
+			"an error (except for -migrate). A new <dbfile> uses "+
+			folderchecksum.DefaultHashAlgo+" by default.")
+	flag.Int64Var(&flg.migrate, "migrate", 0,
+		"Switch <dbfile> to the algorithm specified by -hash, then rehash at\n"+
+			"most this many files whose checksums are computed by another\n"+
+			"algorithm, and exit. Files whose content no longer matches\n"+
+			"<dbfile> are skipped, and don't count toward this number. Only\n"+
+			"the files under <prefix> are rehashed if specified. Until all\n"+
+			"the files are migrated, each file is compared using the\n"+
+			"algorithm stored along with it.")
+	flag.StringVar(&flg.format, "format", "text",
+		"Set the output format ("+formats+"). In\n"+
+			"json and ndjson formats, each record carries the status, path,\n"+
+			"old and new size, and old and new checksum (when computed). The\n"+
+			"last record (status \"summary\") holds the stats. csv format has\n"+
+			"the same columns (without the summary) after a header row.")
+	flag.BoolVar(&flg.nul, "0", false,
+		"Terminate the output records with NUL instead of newline (e.g., for\n"+
+			"xargs -0). Can't be used with -format json.")
+	flag.BoolVar(&flg.sort, "sort", false,
+		"Sort the output records by path. The records are held in memory\n"+
+			"and written after all the files are processed. Without this\n"+
+			"option, the order of new and changed files depends on -j.")
+	flag.BoolVar(&flg.moves, "moves", false,
+		"Report a deleted file and a new file with the same size and\n"+
+			"checksum as \"moved: <old> -> <new>\". -update rewrites the path\n"+
+			"of the row in <dbfile>. New files are always read in this mode.\n"+
+			"Empty files are never deemed moved. Can't be used with -sizeonly.")
+	flag.BoolVar(&flg.copies, "copies", false,
+		"Report a new file whose content already exists in <dbfile> under\n"+
+			"another path as \"copied: <src> -> <new>\". New files are always\n"+
+			"read in this mode. Empty files are never deemed copied. Can't be\n"+
+			"used with -sizeonly.")
+	flag.BoolVar(&flg.history, "history", false,
+		"Keep the history of <dbfile>: each -update is recorded as a run,\n"+
+			"along with the entries changed in that run. Once used with\n"+
+			"-update, the history is always kept for that <dbfile>. Use the\n"+
+			"runs command to list the runs.")
+	flag.Int64Var(&flg.snapshot, "snapshot", 0,
+		"Compare <rootdir> against the snapshot of <dbfile> right after\n"+
+			"this run, instead of the current content. Can't be used with\n"+
+			"-update or -migrate.")
+	flag.StringVar(&flg.mtree, "mtree", "",
+		"Compare <rootdir> against this mtree spec instead of <dbfile>. The\n"+
+			"folders and symlinks in the spec are only compared with\n"+
+			"-trackdirs and -tracklinks. Can't be used with -update,\n"+
+			"-migrate or -snapshot.")
+	flag.BoolVar(&flg.keepGoing, "keep-going", false,
+		"Report the entries that can't be read (e.g., permission denied,\n"+
+			"I/O errors, or files deleted during the scan) as \"error:\" with\n"+
+			"the reason, and go on with the others. Their rows in <dbfile> are\n"+
+			"left untouched. The tool then exits with code 3 instead of 0. By\n"+
+			"default the first such entry aborts the run with code 1.")
+	flag.IntVar(&flg.retries, "retries", 3,
+		"Read a file again up to this many times if its size, mtime or\n"+
+			"ctime differs before and after it's read (i.e., it's modified\n"+
+			"while being read). A file still modified after the retries is\n"+
+			"reported as \"unstable:\", its row in <dbfile> is left untouched,\n"+
+			"and the tool exits with code 3 instead of 0.")
 }
 
 func parsePositionalArgs() {
@@ -160,69 +261,53 @@ func parsePositionalArgs() {
 	}
 }
 
-func getRegexFromList(patterns []string) *regexp.Regexp {
-	regStr := "^("
-	for _, pattern := range patterns {
-		if _, err := regexp.Compile(pattern); err != nil {
-			logFatal("Invalid regex pattern '%s': %s", pattern, err.Error())
-		}
-		regStr += "(" + pattern + ")|"
-	}
-	if regStr[len(regStr)-1] == '|' {
-		regStr = regStr[:len(regStr)-1]
+// Split a comma separated list. Return nil for an empty string.
+func splitList(list string) []string {
+	if list == "" {
+		return nil
 	}
-	regStr += ")$"
-
-	logDebug("regStr: %s", regStr)
-	return regexp.MustCompile(regStr)
+	return strings.Split(list, ",")
 }
 
-func flagsToConfig(f *flags) *config {
-	var cfg config
-
-	containPathSep := strings.Contains(f.dbFile, string(os.PathSeparator))
-	if !containPathSep && f.dbFile != path.Clean(f.dbFile) {
-		logFatal("Cleaned dbFile '%s' not equal to original '%s'",
-			path.Clean(f.dbFile), f.dbFile)
-	}
-
-	logLevel = f.logLevel
-	if flg.j <= 0 {
-		logFatal("j must >= 1")
-	}
-	cfg.j = flg.j
-
-	if containPathSep {
-		cfg.dbFile = f.dbFile
-	} else {
-		cfg.dbFile = filepath.Join(f.rootDir, f.dbFile)
+func flagsToOptions(f *flags) folderchecksum.Options {
+	return folderchecksum.Options{
+		Jobs:        f.j,
+		DbFile:      f.dbFile,
+		Exclude:     f.excludeList,
+		Include:     f.includeList,
+		FollowLinks: f.followLinks,
+		TrackLinks:  f.trackLinks,
+		TrackDirs:   f.trackDirs,
+		SizeOnly:    f.sizeOnly,
+		Quick:       f.quick,
+		Track:       splitList(f.track),
+		Xattrs:      splitList(f.xattrs),
+		Update:      f.update,
+		HashAlgo:    f.hashAlgo,
+		Migrate:     f.migrate,
+		History:     f.history,
+		Snapshot:    f.snapshot,
+		Mtree:       f.mtree,
+		Moves:       f.moves,
+		Copies:      f.copies,
+		Retries:     f.retries,
+		Output:      os.Stdout,
+		Format:      f.format,
+		Nul:         f.nul,
+		Sort:        f.sort,
+		RootDir:     f.rootDir,
+		Prefixes:    f.prefix,
+		SkipError:   skipErrorFunc(f.keepGoing),
+		Logger:      folderchecksum.NewLogger(os.Stderr, f.logLevel),
 	}
-	cfg.dbFile = filepath.Clean(cfg.dbFile)
-	cfg.db = mustOpenDb(cfg.dbFile)
+}
 
-	if containPathSep {
-		cfg.excludeRe = getRegexFromList(f.excludeList)
-	} else {
-		cfg.excludeRe = getRegexFromList(
-			append(f.excludeList,
-				regexp.QuoteMeta(f.dbFile),
-				regexp.QuoteMeta(f.dbFile+"-wal"),
-				regexp.QuoteMeta(f.dbFile+"-shm")))
+// Return the Options.SkipError of -keep-going.
+func skipErrorFunc(keepGoing bool) func(*folderchecksum.FileError) bool {
+	if !keepGoing {
+		return nil
 	}
-
-	cfg.includeRe = getRegexFromList(f.includeList)
-	cfg.followLinks = f.followLinks
-	cfg.sizeOnly = f.sizeOnly
-	cfg.update = f.update
-	cfg.outFile = os.Stdout
-	cfg.rootDir = filepath.Clean(f.rootDir)
-
-	for _, prefix := range f.prefix {
-		cfg.prefix = append(cfg.prefix, cleanPrefix(prefix))
+	return func(*folderchecksum.FileError) bool {
+		return true
 	}
-
-	logDebug("flg: %+v", flg)
-	logDebug("cfg: %+v", cfg)
-
-	return &cfg
 }
@@ -0,0 +1,13 @@
+//go:build unix
+
+package folderchecksum
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// Whether new files can be created in dir, e.g., it's not on a read-only
+// file system.
+func isDirWritable(dir string) bool {
+	return unix.Access(dir, unix.W_OK) == nil
+}
@@ -0,0 +1,122 @@
+package folderchecksum
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The attributes that can be tracked by -track. They are recorded in the
+// stat tuple regardless of -track, but only the tracked ones are reported.
+var attrNames = []string{"mode", "uid", "gid", "mtime"}
+
+// Return the attributes supported by Options.Track.
+func AttrNames() []string {
+	return append([]string(nil), attrNames...)
+}
+
+type trackedAttrs struct {
+	mode  bool
+	uid   bool
+	gid   bool
+	mtime bool
+}
+
+// Parse the names in attrNames.
+func parseTrackedAttrs(names []string) (trackedAttrs, error) {
+	var ret trackedAttrs
+	for _, name := range names {
+		switch strings.TrimSpace(name) {
+		case "mode":
+			ret.mode = true
+		case "uid":
+			ret.uid = true
+		case "gid":
+			ret.gid = true
+		case "mtime":
+			ret.mtime = true
+		default:
+			return ret, fmt.Errorf("Unknown attribute '%s' in -track, "+
+				"expected one of: %s", name, strings.Join(attrNames, ", "))
+		}
+	}
+	return ret, nil
+}
+
+// Parse the xattr namespaces (e.g., "security" for "security.selinux").
+// Return the sorted and deduplicated namespaces.
+func parseXattrNamespaces(list []string) ([]string, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	if !xattrsSupported {
+		return nil, fmt.Errorf("-xattrs is only supported on Linux")
+	}
+	var namespaces []string
+	for _, ns := range list {
+		ns = strings.TrimSpace(ns)
+		if ns == "" || strings.ContainsAny(ns, ".:") {
+			return nil, fmt.Errorf("Invalid xattr namespace '%s' in -xattrs",
+				ns)
+		}
+		i := sort.SearchStrings(namespaces, ns)
+		if i < len(namespaces) && namespaces[i] == ns {
+			continue
+		}
+		namespaces = append(namespaces, "")
+		copy(namespaces[i+1:], namespaces[i:])
+		namespaces[i] = ns
+	}
+	return namespaces, nil
+}
+
+func formatMtime(mtime int64) string {
+	return time.Unix(0, mtime).UTC().Format(time.RFC3339Nano)
+}
+
+// Compare the tracked attributes in the stat tuples, and return the
+// changes in the form of "mode: 0644 -> 0777". The attributes not
+// recorded in db (mode, uid and gid are -1, mtime is 0) are ignored.
+func getMetaChanges(attrs trackedAttrs, dbStat fileStat,
+	stat fileStat) []string {
+	var changes []string
+	if attrs.mode && dbStat.mode != -1 && dbStat.mode != stat.mode {
+		changes = append(changes,
+			fmt.Sprintf("mode: %04o -> %04o", dbStat.mode, stat.mode))
+	}
+	if attrs.uid && dbStat.uid != -1 && dbStat.uid != stat.uid {
+		changes = append(changes,
+			fmt.Sprintf("uid: %d -> %d", dbStat.uid, stat.uid))
+	}
+	if attrs.gid && dbStat.gid != -1 && dbStat.gid != stat.gid {
+		changes = append(changes,
+			fmt.Sprintf("gid: %d -> %d", dbStat.gid, stat.gid))
+	}
+	if attrs.mtime && dbStat.mtime != 0 && dbStat.mtime != stat.mtime {
+		changes = append(changes, fmt.Sprintf("mtime: %s -> %s",
+			formatMtime(dbStat.mtime), formatMtime(stat.mtime)))
+	}
+	return changes
+}
+
+// Compare the xattrs digests returned by getXattrsDigest, and return
+// the change in the form of "xattrs: 0123456789ab -> ba9876543210" (the
+// beginning of the digests). Return an empty string if they are the same,
+// or can't be compared (not recorded in db, or computed on different
+// namespaces). A digest in db may be shorter, e.g., edited in a text db.
+func getXattrsChange(dbDigest string, digest string) string {
+	dbNamespaces, dbHash, _ := strings.Cut(dbDigest, ":")
+	namespaces, hash, _ := strings.Cut(digest, ":")
+	if dbDigest == "" || dbNamespaces != namespaces || dbHash == hash {
+		return ""
+	}
+	const n = 12
+	if len(dbHash) > n {
+		dbHash = dbHash[:n]
+	}
+	if len(hash) > n {
+		hash = hash[:n]
+	}
+	return fmt.Sprintf("xattrs: %s -> %s", dbHash, hash)
+}
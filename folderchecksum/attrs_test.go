@@ -0,0 +1,28 @@
+package folderchecksum
+
+import (
+	"testing"
+)
+
+func TestGetXattrsChange(t *testing.T) {
+	digest := "user:0123456789abcdef"
+	testCases := []struct {
+		dbDigest string
+		expect   string
+	}{
+		{"", ""},
+		{digest, ""},
+		{"security:fedcba9876543210", ""},
+		{"user:fedcba9876543210", "xattrs: fedcba987654 -> 0123456789ab"},
+		// Shorter than the beginning shown.
+		{"user:0123", "xattrs: 0123 -> 0123456789ab"},
+		{"user", "xattrs:  -> 0123456789ab"},
+	}
+	for _, testCase := range testCases {
+		actual := getXattrsChange(testCase.dbDigest, digest)
+		if actual != testCase.expect {
+			t.Errorf("Incorrect change for '%s': %s", testCase.dbDigest,
+				actual)
+		}
+	}
+}
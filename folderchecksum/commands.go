@@ -0,0 +1,289 @@
+package folderchecksum
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// The options of Export and ExportMtree.
+type ExportOptions struct {
+	// The path of the database file, see DbFilePath.
+	DbFile string
+	// Same as Options.Exclude and Options.Include.
+	Exclude []string
+	Include []string
+	// Only export the entries under these paths, same as Options.Prefixes.
+	Prefixes []string
+	// Export the checksums computed by this algorithm, the one recorded in
+	// DbFile if it's empty. Not used by ExportMtree.
+	HashAlgo string
+	// Use the BSD-style tagged format. Not used by ExportMtree.
+	Tagged bool
+	// Same as Options.Logger.
+	Logger *Logger
+}
+
+// The options of Diff.
+type DiffOptions struct {
+	// The paths of the database files.
+	OldDb string
+	NewDb string
+	// Use the snapshots right after these runs instead, if not 0.
+	FromRun int64
+	ToRun   int64
+	// Same as Options.Track.
+	Track []string
+	// Same as Options.Output, Options.Format and Options.Nul.
+	Output io.Writer
+	Format string
+	Nul    bool
+	// Same as Options.Logger.
+	Logger *Logger
+}
+
+// Open the existing database file read-only. If runId is not 0, open the
+// snapshot of that run instead, in which case the returned temp folder
+// should be removed after closing the db.
+func openExistingDb(dbFile string, runId int64) (*sql.DB, string, error) {
+	if _, err := os.Stat(dbFile); err != nil {
+		return nil, "", fmt.Errorf("Failed to open '%s': %w", dbFile, err)
+	}
+	if isTextDbFile(dbFile) {
+		if runId != 0 {
+			return nil, "", fmt.Errorf("No runs recorded in a text database "+
+				"file '%s'", dbFile)
+		}
+		return loadTextDb(dbFile)
+	}
+	db, err := openReadOnlyDb(dbFile)
+	if err != nil {
+		return nil, "", err
+	}
+	if runId == 0 {
+		return db, "", nil
+	}
+	defer db.Close()
+	return openSnapshotDb(db, dbFile, runId)
+}
+
+// Return the config with the filters in opts, and the db opened. The
+// returned temp folder (see openExistingDb) should be removed after
+// closing the db.
+func newExportConfig(opts *ExportOptions) (*config, string, error) {
+	var cfg config
+	var err error
+	if cfg.excludeRe, err = getRegexFromList(opts.Exclude); err != nil {
+		return nil, "", err
+	}
+	if cfg.includeRe, err = getRegexFromList(opts.Include); err != nil {
+		return nil, "", err
+	}
+	for _, prefix := range opts.Prefixes {
+		cfg.prefix = append(cfg.prefix, cleanPrefix(prefix))
+	}
+	cfg.dbFile = opts.DbFile
+	cfg.logger = opts.Logger
+	db, tempDir, err := openExistingDb(cfg.dbFile, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	cfg.db = db
+	return &cfg, tempDir, nil
+}
+
+// Compare two database files (or two runs recorded by Options.History)
+// as if NewDb were the result of scanning the folder in OldDb.
+func Diff(opts DiffOptions) (*Result, error) {
+	if opts.FromRun < 0 || opts.ToRun < 0 {
+		return nil, fmt.Errorf("from and to must >= 0")
+	}
+	cfg := config{
+		format:  opts.Format,
+		nul:     opts.Nul,
+		outFile: opts.Output,
+		logger:  opts.Logger,
+		stats:   &scanStats{},
+		output:  &outputState{},
+	}
+	if cfg.format == "" {
+		cfg.format = "text"
+	}
+	if err := checkOutputOptions(cfg.format, cfg.nul); err != nil {
+		return nil, err
+	}
+	var err error
+	if cfg.track, err = parseTrackedAttrs(opts.Track); err != nil {
+		return nil, err
+	}
+
+	oldDb, oldTempDir, err := openExistingDb(opts.OldDb, opts.FromRun)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(oldTempDir)
+	defer oldDb.Close()
+	newDb, newTempDir, err := openExistingDb(opts.NewDb, opts.ToRun)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(newTempDir)
+	defer newDb.Close()
+
+	outputBegin(&cfg)
+	if err = diffDbs(&cfg, oldDb, newDb); err != nil {
+		return nil, err
+	}
+	if err = verifyStats(&cfg); err != nil {
+		return nil, err
+	}
+	if err = outputEnd(&cfg); err != nil {
+		return nil, err
+	}
+	return &Result{
+		Stats:   getStats(&cfg),
+		Records: cfg.output.records,
+	}, nil
+}
+
+// Write the changes of relPath recorded by Options.History to w.
+func PrintHistory(dbFile string, relPath string, w io.Writer) error {
+	db, tempDir, err := openExistingDb(dbFile, 0)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	defer db.Close()
+	_, ok, err := queryMeta(db, "history")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("No history recorded in '%s', use -history with "+
+			"-update", dbFile)
+	}
+	return printFileHistory(db, cleanPrefix(relPath), w)
+}
+
+// Write the runs recorded by Options.History to w.
+func ListRuns(dbFile string, w io.Writer) error {
+	if isTextDbFile(dbFile) {
+		return fmt.Errorf("No runs recorded in a text database file '%s'",
+			dbFile)
+	}
+	db, _, err := openExistingDb(dbFile, 0)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return listRuns(db, w)
+}
+
+// Write the checksums in the format of md5sum (or sha256sum, etc.) to w.
+// Return the number of files written.
+func Export(opts ExportOptions, w io.Writer) (int64, error) {
+	if err := checkHashAlgo(opts.HashAlgo); err != nil {
+		return 0, err
+	}
+	cfg, tempDir, err := newExportConfig(&opts)
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tempDir)
+	defer cfg.db.Close()
+	cfg.hashAlgo = opts.HashAlgo
+	if cfg.hashAlgo == "" {
+		cfg.hashAlgo, err = resolveHashAlgo(newSqliteStore(cfg.db), "", false,
+			cfg.logger)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if opts.Tagged && checksumTags[cfg.hashAlgo] == "" {
+		return 0, fmt.Errorf("-tag doesn't support %s", cfg.hashAlgo)
+	}
+
+	n, err := exportManifest(cfg, w, cfg.hashAlgo, opts.Tagged)
+	if err != nil {
+		return 0, err
+	}
+	cfg.logger.info("Exported %d files", n)
+	return n, nil
+}
+
+// Write the entries as an mtree spec to w. Return the number of entries
+// written.
+func ExportMtree(opts ExportOptions, w io.Writer) (int64, error) {
+	cfg, tempDir, err := newExportConfig(&opts)
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tempDir)
+	defer cfg.db.Close()
+
+	n, err := exportMtree(cfg, w)
+	if err != nil {
+		return 0, err
+	}
+	cfg.logger.info("Exported %d entries", n)
+	return n, nil
+}
+
+// Add the checksums in the manifests (see ManifestFormats, "auto" if
+// format is empty) to dbFile. hashAlgo is the algorithm of the checksums
+// in gnu format, or the column to import in hashdeep format. Return the
+// number of files imported. The logs are written to logger if it's not nil.
+func Import(dbFile string, manifests []string, format string,
+	hashAlgo string, logger *Logger) (int64, error) {
+	if format == "" {
+		format = "auto"
+	}
+	if !isValidManifestFormat(format) {
+		return 0, fmt.Errorf("Unknown format '%s', expected one of: %s",
+			format, strings.Join(manifestFormats, ", "))
+	}
+	if err := checkHashAlgo(hashAlgo); err != nil {
+		return 0, err
+	}
+
+	var cfg config
+	var err error
+	cfg.dbFile = dbFile
+	cfg.logger = logger
+	if isTextDbFile(cfg.dbFile) {
+		var tempDir string
+		if cfg.db, tempDir, err = loadTextDb(cfg.dbFile); err != nil {
+			return 0, err
+		}
+		defer os.RemoveAll(tempDir)
+		cfg.textDb = true
+	} else {
+		if cfg.db, err = openDb(cfg.dbFile); err != nil {
+			return 0, err
+		}
+		if err = createTablesIfNeeded(cfg.db, cfg.logger); err != nil {
+			cfg.db.Close()
+			return 0, err
+		}
+	}
+	defer cfg.db.Close()
+	cfg.history, err = resolveHistory(newSqliteStore(cfg.db), false, true)
+	if err != nil {
+		return 0, err
+	}
+	cfg.hashAlgo = hashAlgo
+
+	n, err := importManifests(&cfg, manifests, format)
+	if err != nil {
+		return 0, err
+	}
+	if cfg.textDb {
+		if err = saveTextDb(cfg.db, cfg.dbFile); err != nil {
+			return 0, err
+		}
+	}
+	cfg.logger.info("Imported %d files", n)
+	return n, nil
+}
@@ -0,0 +1,841 @@
+package folderchecksum
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type fileInfo struct {
+	relPath  string
+	size     int64
+	checksum string
+	algo     string // empty if checksum is empty
+	stat     fileStat
+	fileType entryType
+	target   string // symlink target, empty for other types
+	xattrs   string // digest of the xattrs, empty if not recorded
+}
+
+// The columns of fileInfo except relPath. NULL is read as empty string
+// or 0, except mode, uid and gid which are read as -1 (i.e., unknown).
+// The order matches fileInfoScanDest and fileInfoArgs.
+const fileInfoColumns = `size, COALESCE(checksum, ''), COALESCE(algo, ''),
+	COALESCE(mtime, 0), COALESCE(ctime, 0), COALESCE(inode, 0),
+	COALESCE(dev, 0), COALESCE(mode, -1), COALESCE(uid, -1),
+	COALESCE(gid, -1), type, COALESCE(target, ''), COALESCE(xattrs, '')`
+
+// Return the destinations for scanning fileInfoColumns into file.
+func fileInfoScanDest(file *fileInfo) []any {
+	return []any{&file.size, &file.checksum, &file.algo,
+		&file.stat.mtime, &file.stat.ctime, &file.stat.inode, &file.stat.dev,
+		&file.stat.mode, &file.stat.uid, &file.stat.gid,
+		&file.fileType, &file.target, &file.xattrs}
+}
+
+// Return the arguments for size, checksum, algo, mtime, ctime, inode, dev,
+// mode, uid, gid, type, target, xattrs.
+func fileInfoArgs(file *fileInfo) []any {
+	return []any{file.size, nullIfEmpty(file.checksum), nullIfEmpty(file.algo),
+		file.stat.mtime, file.stat.ctime, file.stat.inode, file.stat.dev,
+		nullIfNegative(file.stat.mode), nullIfNegative(file.stat.uid),
+		nullIfNegative(file.stat.gid), file.fileType, nullIfEmpty(file.target),
+		nullIfEmpty(file.xattrs)}
+}
+
+// The methods shared by *sql.DB and *sql.Tx.
+type sqlQuerier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+// Return nil for empty string, so that it's stored as NULL.
+func nullIfEmpty(str string) any {
+	if str == "" {
+		return nil
+	}
+	return str
+}
+
+// Return nil for negative number, so that it's stored as NULL.
+func nullIfNegative(n int64) any {
+	if n < 0 {
+		return nil
+	}
+	return n
+}
+
+func escapeForLike(literal string) string {
+	ret := strings.ReplaceAll(literal, `\`, `\\`)
+	ret = strings.ReplaceAll(ret, `%`, `\%`)
+	ret = strings.ReplaceAll(ret, `_`, `\_`)
+	return ret
+}
+
+// The user should call Close() on the return value.
+func openDb(file string) (*sql.DB, error) {
+	// In the default ROLLBACK mode, readers can be active at the
+	// beginning of a write, before any content is flushed to disk
+	// and while all changes are still held in the writer's private
+	// memory space. But before any changes are made to the database
+	// file on disk, all readers must be (temporarily) expelled in
+	// order to give the writer exclusive access to the database file.
+	//
+	// If the write txn is too big, it may try to flush something to
+	// disk even when COMMIT is not called yet, and the readers will
+	// fail with "database is locked" error. Using WAL mode can prevent
+	// this.
+	db, err := sql.Open("sqlite3", "file:"+file+
+		"?_journal_mode=WAL&_txlock=immediate")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open '%s': %w", file, err)
+	}
+	return db, nil
+}
+
+// Return the URI opening file read-only. The locking still applies, so
+// that a concurrent writer is seen consistently. Reading a db in WAL mode
+// needs the -shm file next to it, which can't be created on a read-only
+// medium. Nobody can write to such a db, so it's opened as immutable
+// instead.
+func readOnlyDbUri(file string) string {
+	uri := "file:" + file + "?mode=ro"
+	if !isDirWritable(filepath.Dir(file)) {
+		uri += "&immutable=1"
+	}
+	return uri
+}
+
+// Open the existing database file without modifying it. The tables and
+// columns missing in a file created by an older version are provided by
+// createCompatSchema. The user should call Close() on the return value.
+func openReadOnlyDb(file string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", readOnlyDbUri(file))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open '%s': %w", file, err)
+	}
+	// The temporary tables and views apply to a single connection.
+	db.SetMaxOpenConns(1)
+	if err = createCompatSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func hasTable(db sqlQuerier, table string) (bool, error) {
+	var n int64
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name=?`,
+		table).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("Failed to query table %s: %w", table, err)
+	}
+	return n != 0, nil
+}
+
+// Make db (opened read-only) look like upgraded by createTablesIfNeeded.
+// The missing tables are created as empty temporary tables. If the files
+// table lacks some columns, it's shadowed by a temporary view filling them
+// as filesTableUpgrades does.
+func createCompatSchema(db *sql.DB) error {
+	for _, def := range []string{metaTableDef, filesTableDef, runsTableDef,
+		versionsTableDef} {
+		table := strings.Fields(def)[0]
+		ok, err := hasTable(db, table)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		_, err = db.Exec("CREATE TEMP TABLE " + def)
+		if err != nil {
+			return fmt.Errorf("Failed to create table %s: %w", table, err)
+		}
+	}
+
+	cols := []string{"path", "size", "checksum"}
+	upgraded := true
+	for _, upgrade := range filesTableUpgrades {
+		ok, err := hasColumn(db, "files", upgrade.column)
+		if err != nil {
+			return err
+		}
+		if ok {
+			cols = append(cols, upgrade.column)
+			continue
+		}
+		upgraded = false
+		value := upgrade.value
+		if value == "" {
+			value = "NULL"
+		}
+		cols = append(cols, value+" AS "+upgrade.column)
+	}
+	if upgraded {
+		return nil
+	}
+	_, err := db.Exec(`CREATE TEMP VIEW files AS SELECT ` +
+		strings.Join(cols, ", ") + `, visited FROM main.files`)
+	if err != nil {
+		return fmt.Errorf("Failed to create view files: %w", err)
+	}
+	return nil
+}
+
+// Create a new db named name in a temporary folder, and fill it by fill.
+// The user should call Close() on the returned db, then remove the
+// returned temp folder.
+func openTempDb(name string, fill func(db *sql.DB) error) (*sql.DB, string,
+	error) {
+	dir, err := os.MkdirTemp("", "FolderChecksum")
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to create temp dir: %w", err)
+	}
+	db, err := openDb(filepath.Join(dir, name))
+	if err == nil {
+		err = createTablesIfNeeded(db, nil)
+		if err == nil {
+			err = fill(db)
+		}
+		if err != nil {
+			db.Close()
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, "", err
+	}
+	return db, dir, nil
+}
+
+// The user should call Commit() or Rollback() on the return value.
+func createTx(db *sql.DB) (*sql.Tx, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create tx: %w", err)
+	}
+	return tx, nil
+}
+
+func commitTx(tx *sql.Tx) error {
+	err := tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Failed to commit tx: %w", err)
+	}
+	return nil
+}
+
+// The tables created by createTablesIfNeeded, besides the ones created
+// by createHistoryTables.
+const metaTableDef = `meta (
+	key TEXT NOT NULL PRIMARY KEY,
+	value TEXT NOT NULL)`
+const filesTableDef = `files (
+	path TEXT NOT NULL PRIMARY KEY,
+	size INT NOT NULL,
+	checksum TEXT NULL,
+	algo TEXT NULL,
+	mtime INT NULL,
+	ctime INT NULL,
+	inode INT NULL,
+	dev INT NULL,
+	type INT NOT NULL DEFAULT 0,
+	target TEXT NULL,
+	mode INT NULL,
+	uid INT NULL,
+	gid INT NULL,
+	xattrs TEXT NULL,
+	visited BIT NOT NULL)`
+
+// Columns added to the files table after the first release. They are
+// added to existing tables on demand, and value (NULL if empty) is the
+// value of the existing rows.
+var filesTableUpgrades = []struct {
+	column string
+	def    string
+	value  string
+}{
+	{
+		// Rows created before the algo column existed were computed
+		// by the algorithm recorded in the db, or md5 if not recorded.
+		column: "algo",
+		def:    "TEXT NULL",
+		value: `CASE WHEN checksum IS NOT NULL THEN COALESCE(
+				(SELECT value FROM meta WHERE key='hash'), 'md5') END`,
+	},
+	{column: "mtime", def: "INT NULL"},
+	{column: "ctime", def: "INT NULL"},
+	{column: "inode", def: "INT NULL"},
+	{column: "dev", def: "INT NULL"},
+	{column: "type", def: "INT NOT NULL DEFAULT 0", value: "0"},
+	{column: "target", def: "TEXT NULL"},
+	{column: "mode", def: "INT NULL"},
+	{column: "uid", def: "INT NULL"},
+	{column: "gid", def: "INT NULL"},
+	{column: "xattrs", def: "TEXT NULL"},
+}
+
+func hasColumn(db sqlQuerier, table string, column string) (bool, error) {
+	var n int64
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?`,
+		table, column).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("Failed to query columns of %s: %w",
+			table, err)
+	}
+	return n != 0, nil
+}
+
+func createTablesIfNeeded(db *sql.DB, logger *Logger) error {
+	tx, err := createTx(db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, def := range []string{metaTableDef, filesTableDef} {
+		_, err = tx.Exec("CREATE TABLE IF NOT EXISTS " + def)
+		if err != nil {
+			return fmt.Errorf("Failed to create table: %w", err)
+		}
+	}
+
+	for _, upgrade := range filesTableUpgrades {
+		ok, err := hasColumn(tx, "files", upgrade.column)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		logger.info("Adding column '%s' to the db", upgrade.column)
+		_, err = tx.Exec(
+			"ALTER TABLE files ADD COLUMN " + upgrade.column + " " +
+				upgrade.def)
+		if err != nil {
+			return fmt.Errorf("Failed to add column %s: %w",
+				upgrade.column, err)
+		}
+		if upgrade.value == "" {
+			continue
+		}
+		_, err = tx.Exec(
+			"UPDATE files SET " + upgrade.column + "=" + upgrade.value)
+		if err != nil {
+			return fmt.Errorf("Failed to fill column %s: %w",
+				upgrade.column, err)
+		}
+	}
+
+	if err = createHistoryTables(tx); err != nil {
+		return err
+	}
+
+	// Used by -copies to look up files by content. Created after the
+	// upgrades since older tables don't have the algo column.
+	_, err = tx.Exec(
+		`CREATE INDEX IF NOT EXISTS files_checksum ON files(checksum, algo)`)
+	if err != nil {
+		return fmt.Errorf("Failed to create index: %w", err)
+	}
+
+	return commitTx(tx)
+}
+
+// Return 1. the value; 2. whether the key exists.
+func queryMeta(db sqlQuerier, key string) (string, bool, error) {
+	var value string
+	err := db.QueryRow(`SELECT value FROM meta WHERE key=?`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("Failed to query meta %s: %w", key, err)
+	}
+	return value, true, nil
+}
+
+func setMeta(db sqlQuerier, key string, value string) error {
+	_, err := db.Exec(
+		`INSERT INTO meta(key, value) VALUES(?, ?)
+			ON CONFLICT(key) DO UPDATE SET value=excluded.value`,
+		key, value)
+	if err != nil {
+		return fmt.Errorf("Failed to set meta %s=%s: %w", key, value, err)
+	}
+	return nil
+}
+
+// Count the files with checksums computed by one of hashers. The ones only
+// verified by verifyOnlyHashers (e.g., imported from SFV) don't determine
+// the algorithm of db.
+func countFilesWithChecksum(db sqlQuerier) (int64, error) {
+	var args []any
+	for algo := range verifyOnlyHashers {
+		args = append(args, algo)
+	}
+	var n int64
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM files
+			WHERE checksum IS NOT NULL AND COALESCE(algo, '') NOT IN (`+
+			strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")+`)`,
+		args...).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to count files: %w", err)
+	}
+	return n, nil
+}
+
+func checkRowsAffected(res sql.Result, n int64) error {
+	numRows, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("Failed to get rows affected: %w", err)
+	}
+	if numRows != n {
+		return fmt.Errorf("RowsAffected should be %d, but got %d", n, numRows)
+	}
+	return nil
+}
+
+// The user should call Commit() or Rollback() on tx, or Close()
+// on the return value.
+func prepareInsertFile(tx *sql.Tx) (*sql.Stmt, error) {
+	stmt, err := tx.Prepare(
+		`INSERT INTO files(path, size, checksum, algo,
+				mtime, ctime, inode, dev, mode, uid, gid, type, target,
+				xattrs, visited)
+			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1)`)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to prepare insert: %w", err)
+	}
+	return stmt, nil
+}
+
+func insertFile(stmt *sql.Stmt, file *fileInfo) error {
+	res, err := stmt.Exec(append([]any{file.relPath}, fileInfoArgs(file)...)...)
+	if err != nil {
+		return fmt.Errorf("Failed to insert %+v: %w", file, err)
+	}
+	return checkRowsAffected(res, 1)
+}
+
+// The user should call Commit() or Rollback() on tx, or Close()
+// on the return value.
+func prepareUpdateAndMarkFile(tx *sql.Tx) (*sql.Stmt, error) {
+	stmt, err := tx.Prepare(
+		`UPDATE files
+			SET size=?, checksum=?, algo=?,
+				mtime=?, ctime=?, inode=?, dev=?, mode=?, uid=?, gid=?,
+				type=?, target=?, xattrs=?, visited=1
+			WHERE path=?`)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to prepare update: %w", err)
+	}
+	return stmt, nil
+}
+
+func updateAndMarkFile(stmt *sql.Stmt, file *fileInfo) error {
+	res, err := stmt.Exec(append(fileInfoArgs(file), file.relPath)...)
+	if err != nil {
+		return fmt.Errorf("Failed to update %+v: %w", file, err)
+	}
+	return checkRowsAffected(res, 1)
+}
+
+// The user should call Commit() or Rollback() on tx, or Close()
+// on the return value.
+func prepareMarkFile(tx *sql.Tx) (*sql.Stmt, error) {
+	// We will never mark a visited file in our use case, hence the use
+	// of visited=0.
+	stmt, err := tx.Prepare(
+		`UPDATE files
+			SET visited=1
+			WHERE path=? AND visited=0`)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to prepare mark: %w", err)
+	}
+	return stmt, nil
+}
+
+func markFile(stmt *sql.Stmt, relPath string) error {
+	res, err := stmt.Exec(relPath)
+	if err != nil {
+		return fmt.Errorf("Failed to mark %s: %w", relPath, err)
+	}
+	return checkRowsAffected(res, 1)
+}
+
+// Insert files into db in a single tx, leaving them unvisited.
+func insertUnvisitedFiles(db *sql.DB, files []fileInfo) error {
+	tx, err := createTx(db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := prepareInsertFile(tx)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i := range files {
+		if err = insertFile(stmt, &files[i]); err != nil {
+			return err
+		}
+	}
+	n, err := clearVisitedFlags(tx, "")
+	if err != nil {
+		return err
+	}
+	if n != int64(len(files)) {
+		return fmt.Errorf("numVisitedFlagsCleared mismatch")
+	}
+	return commitTx(tx)
+}
+
+// Return 1. nil or the file; 2. visited flag.
+func queryFile(q sqlQuerier, relPath string) (*fileInfo, bool, error) {
+	stmt, err := q.Prepare(
+		`SELECT ` + fileInfoColumns + `, visited FROM files WHERE path=?`)
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to prepare query %s: %w",
+			relPath, err)
+	}
+	defer stmt.Close()
+
+	ret := fileInfo{
+		relPath: relPath,
+	}
+	var visited bool
+	err = stmt.QueryRow(relPath).Scan(
+		append(fileInfoScanDest(&ret), &visited)...)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to query %s: %w", relPath, err)
+	}
+
+	return &ret, visited, nil
+}
+
+// Return the smallest path (other than file.relPath) of the regular files
+// in db with the same size and checksum as file, or an empty string if
+// there isn't one.
+func queryCopySource(q sqlQuerier, file *fileInfo,
+	skip func(relPath string) bool) (string, error) {
+	rows, err := q.Query(
+		`SELECT path FROM files
+			WHERE checksum=? AND algo=? AND size=? AND type=? AND path<>?
+			ORDER BY path ASC`,
+		file.checksum, file.algo, file.size, typeFile, file.relPath)
+	if err != nil {
+		return "", fmt.Errorf("Failed to query %s: %w", file.relPath, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var path string
+		if err = rows.Scan(&path); err != nil {
+			return "", fmt.Errorf("Failed to scan %s: %w", file.relPath, err)
+		}
+		if skip == nil || !skip(path) {
+			return path, nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return "", fmt.Errorf("Failed to query %s: %w", file.relPath, err)
+	}
+	return "", nil
+}
+
+func deleteUnvisitedFile(tx *sql.Tx, relPath string) error {
+	stmt, err := tx.Prepare(`
+		DELETE FROM files WHERE path=? AND visited=0`)
+	if err != nil {
+		return fmt.Errorf("Failed to prepare delete %s: %w", relPath, err)
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(relPath)
+	if err != nil {
+		return fmt.Errorf("Failed to delete %s: %w", relPath, err)
+	}
+	return checkRowsAffected(res, 1)
+}
+
+func checkDirPrefix(prefix string) error {
+	if prefix != "" && prefix[len(prefix)-1] != '/' {
+		return fmt.Errorf("prefix must end with '/'")
+	}
+	return nil
+}
+
+// Scan rows (path and fileInfoColumns) and call proc on each of them.
+func scanFiles(rows *sql.Rows, prefix string,
+	proc func(file *fileInfo) error) error {
+	for rows.Next() {
+		var file fileInfo
+		err := rows.Scan(
+			append([]any{&file.relPath}, fileInfoScanDest(&file)...)...)
+		if err != nil {
+			return fmt.Errorf("Failed to scan %s: %w", prefix, err)
+		}
+		if err = proc(&file); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Failed to query %s: %w", prefix, err)
+	}
+	return nil
+}
+
+func queryUnvisitedFiles(tx *sql.Tx, prefix string,
+	procOneFile func(file *fileInfo) error) error {
+	if err := checkDirPrefix(prefix); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(
+		`SELECT path, ` + fileInfoColumns + ` FROM files
+			WHERE path LIKE ? ESCAPE '\' AND visited=0
+			ORDER BY path ASC`)
+	if err != nil {
+		return fmt.Errorf("Failed to prepare query %s: %w", prefix, err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(escapeForLike(prefix) + "%")
+	if err != nil {
+		return fmt.Errorf("Failed to query %s: %w", prefix, err)
+	}
+	defer rows.Close()
+
+	return scanFiles(rows, prefix, procOneFile)
+}
+
+func deleteUnvisitedFiles(tx *sql.Tx, prefix string, expectN int64) error {
+	if err := checkDirPrefix(prefix); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`
+		DELETE FROM files WHERE path LIKE ? ESCAPE '\' AND visited=0`)
+	if err != nil {
+		return fmt.Errorf("Failed to prepare delete %s: %w", prefix, err)
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(escapeForLike(prefix) + "%")
+	if err != nil {
+		return fmt.Errorf("Failed to delete %s: %w", prefix, err)
+	}
+	return checkRowsAffected(res, expectN)
+}
+
+// Return the number of rows marked (0 or 1).
+func markFileIfUnvisited(tx *sql.Tx, relPath string) (int64, error) {
+	res, err := tx.Exec(
+		`UPDATE files
+			SET visited=1
+			WHERE path=? AND visited=0`, relPath)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to mark %s: %w", relPath, err)
+	}
+	numRows, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get rows affected: %w", err)
+	}
+	return numRows, nil
+}
+
+// Return the number of rows marked.
+func markUnvisitedFiles(tx *sql.Tx, prefix string) (int64, error) {
+	if err := checkDirPrefix(prefix); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(
+		`UPDATE files
+			SET visited=1
+			WHERE path LIKE ? ESCAPE '\' AND visited=0`,
+		escapeForLike(prefix)+"%")
+	if err != nil {
+		return 0, fmt.Errorf("Failed to mark %s: %w", prefix, err)
+	}
+	numRows, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get rows affected: %w", err)
+	}
+	return numRows, nil
+}
+
+// Return the number of rows cleared (0 or 1).
+func clearVisitedFlagIfSet(tx *sql.Tx, relpath string) (int64, error) {
+	res, err := tx.Exec(
+		`UPDATE files
+			SET visited=0
+			WHERE path=? AND visited=1`, relpath)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to clear %s: %w", relpath, err)
+	}
+	numRows, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get rows affected: %w", err)
+	}
+	return numRows, nil
+}
+
+// Rewrite the unvisited row at oldPath with file (including the path),
+// and mark it visited.
+func moveFile(tx *sql.Tx, oldPath string, file *fileInfo) error {
+	res, err := tx.Exec(
+		`UPDATE files
+			SET path=?, size=?, checksum=?, algo=?,
+				mtime=?, ctime=?, inode=?, dev=?, mode=?, uid=?, gid=?,
+				type=?, target=?, xattrs=?, visited=1
+			WHERE path=? AND visited=0`,
+		append(append([]any{file.relPath}, fileInfoArgs(file)...),
+			oldPath)...)
+	if err != nil {
+		return fmt.Errorf("Failed to move %s to %+v: %w", oldPath, file, err)
+	}
+	return checkRowsAffected(res, 1)
+}
+
+func clearVisitedFlag(tx *sql.Tx, relpath string) error {
+	stmt, err := tx.Prepare(
+		`UPDATE files
+			SET visited=0
+			WHERE path=? AND visited=1`)
+	if err != nil {
+		return fmt.Errorf("Failed to prepare clear %s: %w", relpath, err)
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(relpath)
+	if err != nil {
+		return fmt.Errorf("Failed to clear %s: %w", relpath, err)
+	}
+	return checkRowsAffected(res, 1)
+}
+
+// Return number of rows affected.
+func clearVisitedFlags(tx *sql.Tx, prefix string) (int64, error) {
+	if err := checkDirPrefix(prefix); err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare(
+		`UPDATE files
+			SET visited=0
+			WHERE path LIKE ? ESCAPE '\' AND visited=1`)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to prepare clear %s: %w", prefix, err)
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(escapeForLike(prefix) + "%")
+	if err != nil {
+		return 0, fmt.Errorf("Failed to clear %s: %w", prefix, err)
+	}
+	numRows, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get rows affected: %w", err)
+	}
+	return numRows, nil
+}
+
+// Query at most limit files whose checksums are computed by an algorithm
+// other than algo, and whose paths sort after after. prefix follows the
+// same rule as <prefix> in the command line, i.e., "" for all the files,
+// otherwise the file "prefix" itself and the files under "prefix/".
+func queryFilesToMigrate(db sqlQuerier, prefix string, after string,
+	algo string, limit int64) ([]fileInfo, error) {
+	stmt, err := db.Prepare(
+		`SELECT path, ` + fileInfoColumns + ` FROM files
+			WHERE checksum IS NOT NULL AND algo<>? AND path>?
+				AND (path=? OR path LIKE ? ESCAPE '\')
+			ORDER BY path ASC LIMIT ?`)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to prepare query %s: %w", prefix, err)
+	}
+	defer stmt.Close()
+
+	pattern := "%"
+	if prefix != "" {
+		pattern = escapeForLike(prefix+"/") + "%"
+	}
+	rows, err := stmt.Query(algo, after, prefix, pattern, limit)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query %s: %w", prefix, err)
+	}
+	defer rows.Close()
+
+	var ret []fileInfo
+	err = scanFiles(rows, prefix, func(file *fileInfo) error {
+		ret = append(ret, *file)
+		return nil
+	})
+	return ret, err
+}
+
+// Call proc on each row in files in the order of path. prefix follows the
+// same rule as queryFilesToMigrate.
+func queryFilesUnder(db *sql.DB, prefix string,
+	proc func(*fileInfo) error) error {
+	pattern := "%"
+	if prefix != "" {
+		pattern = escapeForLike(prefix+"/") + "%"
+	}
+	rows, err := db.Query(
+		`SELECT path, `+fileInfoColumns+` FROM files
+			WHERE path=? OR path LIKE ? ESCAPE '\'
+			ORDER BY path ASC`, prefix, pattern)
+	if err != nil {
+		return fmt.Errorf("Failed to query %s: %w", prefix, err)
+	}
+	defer rows.Close()
+
+	return scanFiles(rows, prefix, proc)
+}
+
+func countFilesToMigrate(db sqlQuerier, algo string) (int64, error) {
+	var n int64
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM files
+			WHERE checksum IS NOT NULL AND algo<>?`, algo).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to count files: %w", err)
+	}
+	return n, nil
+}
+
+// The user should call Commit() or Rollback() on tx, or Close()
+// on the return value.
+func prepareMigrateFile(tx *sql.Tx) (*sql.Stmt, error) {
+	stmt, err := tx.Prepare(
+		`UPDATE files
+			SET checksum=?, algo=?
+			WHERE path=? AND checksum=? AND algo=?`)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to prepare migrate: %w", err)
+	}
+	return stmt, nil
+}
+
+// Replace the checksum of oldFile with newFile's. Both of them should
+// have the same relPath.
+func migrateFile(stmt *sql.Stmt, oldFile *fileInfo, newFile *fileInfo) error {
+	res, err := stmt.Exec(newFile.checksum, newFile.algo,
+		oldFile.relPath, oldFile.checksum, oldFile.algo)
+	if err != nil {
+		return fmt.Errorf("Failed to migrate %+v: %w", oldFile, err)
+	}
+	return checkRowsAffected(res, 1)
+}
@@ -1,8 +1,9 @@
-package main
+package folderchecksum
 
 import (
 	"database/sql"
 	"math"
+	"os"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -13,6 +14,11 @@ type fileRow struct {
 	path     string
 	size     int64
 	checksum any // string or nil
+	algo     any // string or nil
+	stat     fileStat
+	fileType entryType
+	target   string
+	xattrs   string
 	visited  bool
 }
 
@@ -21,12 +27,17 @@ var testDbRows = [...]fileRow{
 		path:     "file1",
 		size:     123,
 		checksum: "aaa",
-		visited:  true,
+		algo:     "md5",
+		stat: fileStat{mtime: 1, ctime: 2, inode: 3, dev: 4,
+			mode: 0644, uid: 1000, gid: 1000},
+		visited: true,
 	},
 	{
 		path:     "file2",
 		size:     123,
 		checksum: "bbb",
+		algo:     "md5",
+		stat:     fileStat{mtime: -1, ctime: -2, inode: -3, dev: -4},
 		visited:  false,
 	},
 	{
@@ -36,6 +47,7 @@ var testDbRows = [...]fileRow{
 		path:     "file2/file1",
 		size:     123,
 		checksum: "bbb",
+		algo:     "md5",
 		visited:  true,
 	},
 	{
@@ -57,6 +69,7 @@ var testDbRows = [...]fileRow{
 		path:     "%dir1/dir1/file1",
 		size:     789,
 		checksum: "ccc",
+		algo:     "md5",
 		visited:  true,
 	},
 	{
@@ -64,6 +77,7 @@ var testDbRows = [...]fileRow{
 		path:     "%dir1/dir1/file2",
 		size:     789,
 		checksum: "ddd",
+		algo:     "md5",
 		visited:  false,
 	},
 	{
@@ -72,6 +86,7 @@ var testDbRows = [...]fileRow{
 		path:     "%dir123/file1",
 		size:     789,
 		checksum: "eee",
+		algo:     "md5",
 		visited:  false,
 	},
 	{
@@ -79,13 +94,25 @@ var testDbRows = [...]fileRow{
 		path:     "dir\\_2/dir1/\"'`file1",
 		size:     math.MaxUint32 * 10,
 		checksum: "fff",
+		algo:     "md5",
 		visited:  false,
 	},
+	{
+		// A symlink.
+		path:     "link1",
+		size:     7,
+		checksum: nil,
+		algo:     nil,
+		fileType: typeLink,
+		target:   "../dir1",
+		visited:  true,
+	},
 	{
 		// The name contains special characters \ _ " ' `
 		path:     "dir\\_2/dir1/\"'`file2",
 		size:     math.MaxUint32 * 10,
 		checksum: "ggg",
+		algo:     "md5",
 		visited:  true,
 	},
 }
@@ -129,7 +156,11 @@ func verifyFileInfo(t *testing.T, actual []fileInfo, expect []fileInfo) {
 
 func getAllRowsFromFiles(t *testing.T, db *sql.DB) []fileRow {
 	rows, err := db.Query(
-		`SELECT path, size, checksum, visited FROM files
+		`SELECT path, size, checksum, algo, COALESCE(mtime, 0),
+			COALESCE(ctime, 0), COALESCE(inode, 0), COALESCE(dev, 0),
+			COALESCE(mode, -1), COALESCE(uid, -1), COALESCE(gid, -1),
+			type, COALESCE(target, ''), COALESCE(xattrs, ''), visited
+			FROM files
 			ORDER BY path ASC`)
 	if err != nil {
 		t.Fatal(err)
@@ -139,7 +170,10 @@ func getAllRowsFromFiles(t *testing.T, db *sql.DB) []fileRow {
 	var ret []fileRow
 	for rows.Next() {
 		var row fileRow
-		err = rows.Scan(&row.path, &row.size, &row.checksum, &row.visited)
+		err = rows.Scan(&row.path, &row.size, &row.checksum, &row.algo,
+			&row.stat.mtime, &row.stat.ctime, &row.stat.inode, &row.stat.dev,
+			&row.stat.mode, &row.stat.uid, &row.stat.gid,
+			&row.fileType, &row.target, &row.xattrs, &row.visited)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -150,47 +184,247 @@ func getAllRowsFromFiles(t *testing.T, db *sql.DB) []fileRow {
 }
 
 func clearAndInsertRowsToFiles(t *testing.T, db *sql.DB, rows []fileRow) {
-	tx := mustCreateTx(db)
-	_, err := tx.Exec("DELETE FROM files")
+	tx, err := createTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Exec("DELETE FROM files")
 	if err != nil {
 		t.Fatal(err)
 	}
 	stmt, err := tx.Prepare(
-		`INSERT INTO files(path, size, checksum, visited)
-			VALUES(?, ?, ?, ?)`)
+		`INSERT INTO files(path, size, checksum, algo,
+				mtime, ctime, inode, dev, mode, uid, gid, type, target,
+				xattrs, visited)
+			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		t.Fatal(err)
 	}
 	for _, row := range rows {
-		_, err = stmt.Exec(row.path, row.size, row.checksum, row.visited)
+		_, err = stmt.Exec(row.path, row.size, row.checksum, row.algo,
+			row.stat.mtime, row.stat.ctime, row.stat.inode, row.stat.dev,
+			nullIfNegative(row.stat.mode), nullIfNegative(row.stat.uid),
+			nullIfNegative(row.stat.gid), row.fileType,
+			nullIfEmpty(row.target), nullIfEmpty(row.xattrs), row.visited)
 		if err != nil {
 			t.Fatal(err)
 		}
 	}
-	mustCommitTx(tx)
+	if err := commitTx(tx); err != nil {
+		t.Fatal(err)
+	}
 }
 
 // The user should call Close() on the return value.
 func prepareTestDb(t *testing.T) *sql.DB {
 	dbFile := filepath.Join(t.TempDir(), "test.db")
 
-	db := mustOpenDb(dbFile)
-	mustCreateFilesTableIfNeeded(db)
-	mustCreateFilesTableIfNeeded(db)
+	db, err := openDb(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createTablesIfNeeded(db, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := createTablesIfNeeded(db, nil); err != nil {
+		t.Fatal(err)
+	}
 	return db
 }
 
-func TestCreateFilesTable(t *testing.T) {
+func TestCreateTables(t *testing.T) {
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	var n int64
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM sqlite_master
+			WHERE type='index' AND name='files_checksum'`).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("Index files_checksum not created")
+	}
+}
+
+func TestUpgradeFilesTable(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "test.db")
+	db, err := openDb(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The files table created by the first release.
+	_, err = db.Exec(
+		`CREATE TABLE files (
+			path TEXT NOT NULL PRIMARY KEY,
+			size INT NOT NULL,
+			checksum TEXT NULL,
+			visited BIT NOT NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(
+		`INSERT INTO files(path, size, checksum, visited)
+			VALUES('file1', 5, 'aaa', 0), ('file2', 5, NULL, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := createTablesIfNeeded(db, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := createTablesIfNeeded(db, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	actualRows := getAllRowsFromFiles(t, db)
+	expectRows := []fileRow{
+		{
+			path:     "file1",
+			size:     5,
+			checksum: "aaa",
+			algo:     "md5",
+			stat:     fileStat{mode: -1, uid: -1, gid: -1},
+			visited:  false,
+		},
+		{
+			path:     "file2",
+			size:     5,
+			checksum: nil,
+			algo:     nil,
+			stat:     fileStat{mode: -1, uid: -1, gid: -1},
+			visited:  false,
+		},
+	}
+	verifyFileRows(t, actualRows, expectRows)
+}
+
+func TestOpenReadOnlyDb(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "test.db")
+	db, err := sql.Open("sqlite3", dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The files table created by the first release.
+	_, err = db.Exec(
+		`CREATE TABLE files (
+			path TEXT NOT NULL PRIMARY KEY,
+			size INT NOT NULL,
+			checksum TEXT NULL,
+			visited BIT NOT NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(
+		`INSERT INTO files(path, size, checksum, visited)
+			VALUES('file1', 5, 'aaa', 0), ('file2', 5, NULL, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	content, err := os.ReadFile(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = openReadOnlyDb(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	expectRows := []fileRow{
+		{
+			path:     "file1",
+			size:     5,
+			checksum: "aaa",
+			algo:     "md5",
+			stat:     fileStat{mode: -1, uid: -1, gid: -1},
+			visited:  false,
+		},
+		{
+			path:     "file2",
+			size:     5,
+			checksum: nil,
+			algo:     nil,
+			stat:     fileStat{mode: -1, uid: -1, gid: -1},
+			visited:  false,
+		},
+	}
+	verifyFileRows(t, getAllRowsFromFiles(t, db), expectRows)
+	if _, ok, err := queryMeta(db, "hash"); err != nil || ok {
+		t.Fatalf("Unexpected meta hash: %v, %v", ok, err)
+	}
+	var builder strings.Builder
+	if err = listRuns(db, &builder); err != nil || builder.Len() != 0 {
+		t.Fatalf("Unexpected runs: %s, %v", builder.String(), err)
+	}
+	if _, err = db.Exec(`DELETE FROM main.files`); err == nil {
+		t.Fatal("Expected an error writing a read-only db")
+	}
+	db.Close()
+
+	actual, err := os.ReadFile(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(actual) != string(content) {
+		t.Fatal("The db file is modified")
+	}
+}
+
+func TestMeta(t *testing.T) {
 	db := prepareTestDb(t)
 	defer db.Close()
+
+	value, ok, err := queryMeta(db, "key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || value != "" {
+		t.Fatalf("Unexpected meta: %s", value)
+	}
+
+	if err := setMeta(db, "key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := setMeta(db, "key2", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := setMeta(db, "key1", "value3"); err != nil {
+		t.Fatal(err)
+	}
+
+	value, ok, err = queryMeta(db, "key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || value != "value3" {
+		t.Fatalf("Incorrect meta: %s", value)
+	}
+	value, ok, err = queryMeta(db, "key2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || value != "value2" {
+		t.Fatalf("Incorrect meta: %s", value)
+	}
 }
 
 func TestInsertFile(t *testing.T) {
 	db := prepareTestDb(t)
 	defer db.Close()
 
-	tx := mustCreateTx(db)
-	stmt := mustPrepareInsertFile(tx)
+	tx, err := createTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := prepareInsertFile(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer stmt.Close()
 
 	for _, row := range testDbRows {
@@ -198,14 +432,22 @@ func TestInsertFile(t *testing.T) {
 			relPath:  row.path,
 			size:     row.size,
 			checksum: "",
+			stat:     row.stat,
+			fileType: row.fileType,
+			target:   row.target,
 		}
 		if row.checksum != nil {
 			file.checksum = row.checksum.(string)
+			file.algo = row.algo.(string)
+		}
+		if err := insertFile(stmt, &file); err != nil {
+			t.Fatal(err)
 		}
-		mustInsertFile(stmt, &file)
 	}
 
-	mustCommitTx(tx)
+	if err := commitTx(tx); err != nil {
+		t.Fatal(err)
+	}
 
 	actualRows := getAllRowsFromFiles(t, db)
 	expectRows := copyAndSortFileRows(testDbRows[:])
@@ -221,25 +463,41 @@ func TestUpdateAndMarkFile(t *testing.T) {
 
 	clearAndInsertRowsToFiles(t, db, testDbRows[:])
 
-	tx := mustCreateTx(db)
-	stmt := mustPrepareUpdateAndMarkFile(tx)
+	tx, err := createTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := prepareUpdateAndMarkFile(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer stmt.Close()
 
 	for _, row := range testDbRows {
-		mustUpdateAndMarkFile(stmt, &fileInfo{
+		if err := updateAndMarkFile(stmt, &fileInfo{
 			relPath:  row.path,
 			size:     math.MaxInt64,
 			checksum: "newchecksum",
-		})
+			algo:     "sha256",
+			stat:     fileStat{mtime: math.MaxInt64, inode: math.MinInt64},
+		}); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	mustCommitTx(tx)
+	if err := commitTx(tx); err != nil {
+		t.Fatal(err)
+	}
 
 	actualRows := getAllRowsFromFiles(t, db)
 	expectRows := copyAndSortFileRows(testDbRows[:])
 	for i := range expectRows {
 		expectRows[i].size = math.MaxInt64
 		expectRows[i].checksum = "newchecksum"
+		expectRows[i].algo = "sha256"
+		expectRows[i].stat = fileStat{mtime: math.MaxInt64, inode: math.MinInt64}
+		expectRows[i].fileType = typeFile
+		expectRows[i].target = ""
 		expectRows[i].visited = true
 	}
 	verifyFileRows(t, actualRows, expectRows)
@@ -251,13 +509,23 @@ func TestMarkFile(t *testing.T) {
 
 	clearAndInsertRowsToFiles(t, db, testDbRows[:])
 
-	tx := mustCreateTx(db)
-	stmt := mustPrepareMarkFile(tx)
+	tx, err := createTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := prepareMarkFile(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer stmt.Close()
 
-	mustMarkFile(stmt, "%dir1/file1")
+	if err := markFile(stmt, "%dir1/file1"); err != nil {
+		t.Fatal(err)
+	}
 
-	mustCommitTx(tx)
+	if err := commitTx(tx); err != nil {
+		t.Fatal(err)
+	}
 
 	actualRows := getAllRowsFromFiles(t, db)
 	expectRows := copyAndSortFileRows(testDbRows[:])
@@ -276,29 +544,42 @@ func TestQueryFile(t *testing.T) {
 	clearAndInsertRowsToFiles(t, db, testDbRows[:])
 
 	// Query a non-existing file
-	file, visited := mustQueryFile(db, "fileX")
+	file, visited, err := queryFile(db, "fileX")
+	if err != nil {
+		t.Fatal(err)
+	}
 	if file != nil || visited {
 		t.Errorf("nil expected: %+v", file)
 	}
 
 	// Query an existing folder name
-	file, visited = mustQueryFile(db, "%dir1")
+	file, visited, err = queryFile(db, "%dir1")
+	if err != nil {
+		t.Fatal(err)
+	}
 	if file != nil || visited {
 		t.Errorf("nil expected: %+v", file)
 	}
 
 	// Query existing file names
 	for _, row := range testDbRows {
-		actual, visited := mustQueryFile(db, row.path)
+		actual, visited, err := queryFile(db, row.path)
+		if err != nil {
+			t.Fatal(err)
+		}
 		expect := fileInfo{
 			relPath:  row.path,
 			size:     row.size,
 			checksum: "",
+			stat:     row.stat,
+			fileType: row.fileType,
+			target:   row.target,
 		}
 		if row.checksum != nil {
 			expect.checksum = row.checksum.(string)
+			expect.algo = row.algo.(string)
 		}
-		if actual != expect {
+		if *actual != expect {
 			t.Errorf("actual: %+v", actual)
 			t.Errorf("expect: %+v", expect)
 		}
@@ -316,9 +597,16 @@ func TestDeleteUnvisitedFile(t *testing.T) {
 	var expectRows []fileRow
 
 	clearAndInsertRowsToFiles(t, db, testDbRows[:])
-	tx := mustCreateTx(db)
-	mustDeleteUnvisitedFile(tx, "file2")
-	mustCommitTx(tx)
+	tx, err := createTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteUnvisitedFile(tx, "file2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitTx(tx); err != nil {
+		t.Fatal(err)
+	}
 	actualRows = getAllRowsFromFiles(t, db)
 	expectRows = []fileRow{}
 	for _, row := range copyAndSortFileRows(testDbRows[:]) {
@@ -338,11 +626,15 @@ func TestQueryUnvisitedFiles(t *testing.T) {
 
 	var actual []fileInfo
 	var expect []fileInfo
-	procOneFile := func(file *fileInfo) {
+	procOneFile := func(file *fileInfo) error {
 		actual = append(actual, *file)
+		return nil
 	}
 
-	tx := mustCreateTx(db)
+	tx, err := createTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// Query all files.
 	actual = []fileInfo{}
@@ -355,13 +647,19 @@ func TestQueryUnvisitedFiles(t *testing.T) {
 			relPath:  row.path,
 			size:     row.size,
 			checksum: "",
+			stat:     row.stat,
+			fileType: row.fileType,
+			target:   row.target,
 		}
 		if row.checksum != nil {
 			file.checksum = row.checksum.(string)
+			file.algo = row.algo.(string)
 		}
 		expect = append(expect, file)
 	}
-	mustQueryUnvisitedFiles(tx, "", procOneFile)
+	if err := queryUnvisitedFiles(tx, "", procOneFile); err != nil {
+		t.Fatal(err)
+	}
 	verifyFileInfo(t, actual, expect)
 
 	// Query subfolder %dir1.
@@ -371,6 +669,7 @@ func TestQueryUnvisitedFiles(t *testing.T) {
 			relPath:  "%dir1/dir1/file2",
 			size:     789,
 			checksum: "ddd",
+			algo:     "md5",
 		},
 		{
 			relPath:  "%dir1/file1",
@@ -378,7 +677,9 @@ func TestQueryUnvisitedFiles(t *testing.T) {
 			checksum: "",
 		},
 	}
-	mustQueryUnvisitedFiles(tx, "%dir1/", procOneFile)
+	if err := queryUnvisitedFiles(tx, "%dir1/", procOneFile); err != nil {
+		t.Fatal(err)
+	}
 	verifyFileInfo(t, actual, expect)
 
 	// Query subfolder dir\_2.
@@ -388,18 +689,25 @@ func TestQueryUnvisitedFiles(t *testing.T) {
 			relPath:  "dir\\_2/dir1/\"'`file1",
 			size:     math.MaxUint32 * 10,
 			checksum: "fff",
+			algo:     "md5",
 		},
 	}
-	mustQueryUnvisitedFiles(tx, `dir\_2/`, procOneFile)
+	if err := queryUnvisitedFiles(tx, `dir\_2/`, procOneFile); err != nil {
+		t.Fatal(err)
+	}
 	verifyFileInfo(t, actual, expect)
 
 	// Query a non-existing folder.
 	actual = []fileInfo{}
 	expect = []fileInfo{}
-	mustQueryUnvisitedFiles(tx, "dirXXX/", procOneFile)
+	if err := queryUnvisitedFiles(tx, "dirXXX/", procOneFile); err != nil {
+		t.Fatal(err)
+	}
 	verifyFileInfo(t, actual, expect)
 
-	mustCommitTx(tx)
+	if err := commitTx(tx); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestDeleteUnvisitedFiles(t *testing.T) {
@@ -411,9 +719,16 @@ func TestDeleteUnvisitedFiles(t *testing.T) {
 
 	// Delete all unvisited files.
 	clearAndInsertRowsToFiles(t, db, testDbRows[:])
-	tx := mustCreateTx(db)
-	mustDeleteUnvisitedFiles(tx, "", 5)
-	mustCommitTx(tx)
+	tx, err := createTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteUnvisitedFiles(tx, "", 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitTx(tx); err != nil {
+		t.Fatal(err)
+	}
 	actualRows = getAllRowsFromFiles(t, db)
 	expectRows = []fileRow{}
 	for _, row := range copyAndSortFileRows(testDbRows[:]) {
@@ -426,9 +741,16 @@ func TestDeleteUnvisitedFiles(t *testing.T) {
 
 	// Delete all unvisited files in %dir1.
 	clearAndInsertRowsToFiles(t, db, testDbRows[:])
-	tx = mustCreateTx(db)
-	mustDeleteUnvisitedFiles(tx, "%dir1/", 2)
-	mustCommitTx(tx)
+	tx, err = createTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteUnvisitedFiles(tx, "%dir1/", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitTx(tx); err != nil {
+		t.Fatal(err)
+	}
 	actualRows = getAllRowsFromFiles(t, db)
 	expectRows = []fileRow{}
 	for _, row := range copyAndSortFileRows(testDbRows[:]) {
@@ -441,9 +763,16 @@ func TestDeleteUnvisitedFiles(t *testing.T) {
 
 	// Delete all unvisited files in dir\_2.
 	clearAndInsertRowsToFiles(t, db, testDbRows[:])
-	tx = mustCreateTx(db)
-	mustDeleteUnvisitedFiles(tx, `dir\_2/`, 1)
-	mustCommitTx(tx)
+	tx, err = createTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteUnvisitedFiles(tx, `dir\_2/`, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitTx(tx); err != nil {
+		t.Fatal(err)
+	}
 	actualRows = getAllRowsFromFiles(t, db)
 	expectRows = []fileRow{}
 	for _, row := range copyAndSortFileRows(testDbRows[:]) {
@@ -456,9 +785,16 @@ func TestDeleteUnvisitedFiles(t *testing.T) {
 
 	// Delete all unvisited files in a non-existing folder.
 	clearAndInsertRowsToFiles(t, db, testDbRows[:])
-	tx = mustCreateTx(db)
-	mustDeleteUnvisitedFiles(tx, `dirXXX/`, 0)
-	mustCommitTx(tx)
+	tx, err = createTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteUnvisitedFiles(tx, `dirXXX/`, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitTx(tx); err != nil {
+		t.Fatal(err)
+	}
 	actualRows = getAllRowsFromFiles(t, db)
 	expectRows = copyAndSortFileRows(testDbRows[:])
 	verifyFileRows(t, actualRows, expectRows)
@@ -474,13 +810,20 @@ func TestClearVisitedFlag(t *testing.T) {
 	clearAndInsertRowsToFiles(t, db, testDbRows[:])
 
 	// Clear existing file names
-	tx := mustCreateTx(db)
+	tx, err := createTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
 	for _, row := range testDbRows {
 		if row.visited {
-			mustClearVisitedFlag(tx, row.path)
+			if err := clearVisitedFlag(tx, row.path); err != nil {
+				t.Fatal(err)
+			}
 		}
 	}
-	mustCommitTx(tx)
+	if err := commitTx(tx); err != nil {
+		t.Fatal(err)
+	}
 	actualRows = getAllRowsFromFiles(t, db)
 	expectRows = copyAndSortFileRows(testDbRows[:])
 	for i := range expectRows {
@@ -498,28 +841,44 @@ func TestClearVisitedFlags(t *testing.T) {
 
 	// Clear all files.
 	clearAndInsertRowsToFiles(t, db, testDbRows[:])
-	tx := mustCreateTx(db)
-	n := mustClearVisitedFlags(tx, "")
-	mustCommitTx(tx)
+	tx, err := createTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := clearVisitedFlags(tx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := commitTx(tx); err != nil {
+		t.Fatal(err)
+	}
 	actualRows = getAllRowsFromFiles(t, db)
 	expectRows = copyAndSortFileRows(testDbRows[:])
 	for i := range expectRows {
 		expectRows[i].visited = false
 	}
 	verifyFileRows(t, actualRows, expectRows)
-	if n != 5 {
+	if n != 6 {
 		t.Fatalf("Incorrect n=%d", n)
 	}
-	_, err := db.Exec("DELETE FROM files")
+	_, err = db.Exec("DELETE FROM files")
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Clear files in %dir1.
 	clearAndInsertRowsToFiles(t, db, testDbRows[:])
-	tx = mustCreateTx(db)
-	n = mustClearVisitedFlags(tx, "%dir1/")
-	mustCommitTx(tx)
+	tx, err = createTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = clearVisitedFlags(tx, "%dir1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := commitTx(tx); err != nil {
+		t.Fatal(err)
+	}
 	actualRows = getAllRowsFromFiles(t, db)
 	expectRows = copyAndSortFileRows(testDbRows[:])
 	for i, row := range expectRows {
@@ -538,9 +897,17 @@ func TestClearVisitedFlags(t *testing.T) {
 
 	// Clear files in dir\_2.
 	clearAndInsertRowsToFiles(t, db, testDbRows[:])
-	tx = mustCreateTx(db)
-	n = mustClearVisitedFlags(tx, `dir\_2/`)
-	mustCommitTx(tx)
+	tx, err = createTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = clearVisitedFlags(tx, `dir\_2/`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := commitTx(tx); err != nil {
+		t.Fatal(err)
+	}
 	actualRows = getAllRowsFromFiles(t, db)
 	expectRows = copyAndSortFileRows(testDbRows[:])
 	for i, row := range expectRows {
@@ -559,9 +926,17 @@ func TestClearVisitedFlags(t *testing.T) {
 
 	// Clear files in a non-existing folder.
 	clearAndInsertRowsToFiles(t, db, testDbRows[:])
-	tx = mustCreateTx(db)
-	n = mustClearVisitedFlags(tx, `dirXXX/`)
-	mustCommitTx(tx)
+	tx, err = createTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = clearVisitedFlags(tx, `dirXXX/`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := commitTx(tx); err != nil {
+		t.Fatal(err)
+	}
 	actualRows = getAllRowsFromFiles(t, db)
 	expectRows = copyAndSortFileRows(testDbRows[:])
 	verifyFileRows(t, actualRows, expectRows)
@@ -573,3 +948,30 @@ func TestClearVisitedFlags(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestOpenReadOnlyDbConcurrentWriter(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "test.db")
+	db, err := openDb(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = createTablesIfNeeded(db, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	roDb, err := openReadOnlyDb(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer roDb.Close()
+	if n, err := countFilesWithChecksum(roDb); err != nil || n != 0 {
+		t.Fatalf("Incorrect count: %d, %v", n, err)
+	}
+	clearAndInsertRowsToFiles(t, db, testDbRows[:])
+	// The commit of the writer is seen.
+	n, err := countFilesWithChecksum(roDb)
+	if err != nil || n == 0 {
+		t.Fatalf("Incorrect count: %d, %v", n, err)
+	}
+}
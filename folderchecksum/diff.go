@@ -0,0 +1,149 @@
+package folderchecksum
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Iterate the rows of the files table in the order of path.
+type filesCursor struct {
+	rows *sql.Rows
+	file *fileInfo // the current row, nil after the last one
+}
+
+// The user should call Close() on the return value.
+func openFilesCursor(db *sql.DB) (*filesCursor, error) {
+	rows, err := db.Query(
+		`SELECT path, ` + fileInfoColumns + ` FROM files ORDER BY path ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query files: %w", err)
+	}
+	cursor := &filesCursor{rows: rows}
+	if err = cursor.next(); err != nil {
+		rows.Close()
+		return nil, err
+	}
+	return cursor, nil
+}
+
+func (c *filesCursor) next() error {
+	if !c.rows.Next() {
+		if err := c.rows.Err(); err != nil {
+			return fmt.Errorf("Failed to query files: %w", err)
+		}
+		c.file = nil
+		return nil
+	}
+	var file fileInfo
+	err := c.rows.Scan(
+		append([]any{&file.relPath}, fileInfoScanDest(&file)...)...)
+	if err != nil {
+		return fmt.Errorf("Failed to scan files: %w", err)
+	}
+	c.file = &file
+	return nil
+}
+
+func (c *filesCursor) Close() {
+	c.rows.Close()
+}
+
+// Compare the files tables of oldDb and newDb, and output the differences
+// as if newDb were the result of scanning the folder recorded in oldDb.
+// The records are output in the order of path.
+func diffDbs(cfg *config, oldDb *sql.DB, newDb *sql.DB) error {
+	oldCursor, err := openFilesCursor(oldDb)
+	if err != nil {
+		return err
+	}
+	defer oldCursor.Close()
+	newCursor, err := openFilesCursor(newDb)
+	if err != nil {
+		return err
+	}
+	defer newCursor.Close()
+
+	for oldCursor.file != nil || newCursor.file != nil {
+		oldFile := oldCursor.file
+		newFile := newCursor.file
+		switch {
+		case newFile == nil ||
+			(oldFile != nil && oldFile.relPath < newFile.relPath):
+			outputDeletedFile(cfg, oldFile)
+			err = oldCursor.next()
+		case oldFile == nil || newFile.relPath < oldFile.relPath:
+			outputNewFile(cfg, newFile)
+			err = newCursor.next()
+		default:
+			diffFile(cfg, oldFile, newFile)
+			if err = oldCursor.next(); err == nil {
+				err = newCursor.next()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compare two records of the same path, in the same way as fileCheckWorker
+// compares a file against db.
+func diffFile(cfg *config, oldFile *fileInfo, newFile *fileInfo) {
+	// The attributes not recorded in newFile can't be compared either.
+	oldStat := oldFile.stat
+	if newFile.stat.mode == -1 {
+		oldStat.mode = -1
+	}
+	if newFile.stat.uid == -1 {
+		oldStat.uid = -1
+	}
+	if newFile.stat.gid == -1 {
+		oldStat.gid = -1
+	}
+	if newFile.stat.mtime == 0 {
+		oldStat.mtime = 0
+	}
+	changes := getMetaChanges(cfg.track, oldStat, newFile.stat)
+	if change := getXattrsChange(oldFile.xattrs,
+		newFile.xattrs); change != "" {
+		changes = append(changes, change)
+	}
+	if len(changes) != 0 {
+		outputMetaChangedFile(cfg, newFile.relPath, changes)
+	}
+
+	if oldFile.checksum != "" && newFile.checksum != "" &&
+		oldFile.algo != newFile.algo {
+		cfg.logger.warning("Can't compare the checksums of '%s' (%s vs %s), "+
+			"only the size is compared", newFile.relPath, oldFile.algo,
+			newFile.algo)
+	}
+	if isContentChanged(oldFile, newFile) {
+		outputChangedFile(cfg, oldFile, newFile)
+	} else {
+		outputUnchangedFile(cfg, newFile.relPath)
+	}
+}
+
+// Return whether the content of newFile is different from oldFile. The
+// files whose checksums can't be compared (not recorded, or computed by
+// different algorithms) are compared by size only. Unknown sizes are not
+// compared.
+func isContentChanged(oldFile *fileInfo, newFile *fileInfo) bool {
+	sizeKnown := oldFile.size != unknownSize && newFile.size != unknownSize
+	switch {
+	case oldFile.fileType != newFile.fileType ||
+		(sizeKnown && oldFile.size != newFile.size):
+		return true
+	case newFile.fileType == typeDir:
+		return false
+	case newFile.fileType == typeLink:
+		return oldFile.target != newFile.target
+	case oldFile.checksum == "" || newFile.checksum == "" ||
+		oldFile.algo != newFile.algo:
+		return false
+	default:
+		return oldFile.checksum != newFile.checksum
+	}
+}
@@ -0,0 +1,70 @@
+package folderchecksum
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffDbs(t *testing.T) {
+	oldDb := prepareTestDb(t)
+	defer oldDb.Close()
+	newDb := prepareTestDb(t)
+	defer newDb.Close()
+
+	clearAndInsertRowsToFiles(t, oldDb, testDbRows[:])
+	var newRows []fileRow
+	for _, row := range testDbRows {
+		switch row.path {
+		case "file1":
+			row.checksum = "zzz"
+			row.stat.mode = 0600
+		case "file2":
+			// Deleted.
+			continue
+		case "file2/file1":
+			row.fileType = typeDir
+			row.size = 0
+			row.checksum = nil
+			row.algo = nil
+		case "%dir1/dir1/file1":
+			// Can't be compared by checksum.
+			row.checksum = "xxx"
+			row.algo = "sha256"
+		case "link1":
+			row.target = "../dir2"
+		}
+		newRows = append(newRows, row)
+	}
+	newRows = append(newRows, fileRow{path: "file3", size: 1,
+		checksum: "yyy", algo: "md5"})
+	clearAndInsertRowsToFiles(t, newDb, newRows)
+
+	var builder strings.Builder
+	cfg := config{
+		format:  "text",
+		track:   trackedAttrs{mode: true},
+		outFile: &builder,
+		stats:   &scanStats{},
+		output:  &outputState{},
+	}
+	if err := diffDbs(&cfg, oldDb, newDb); err != nil {
+		t.Fatal(err)
+	}
+	expect := strings.Join([]string{
+		"metachanged: file1 (mode: 0644 -> 0600)",
+		"changed: file1",
+		"deleted: file2",
+		"changed: file2/file1",
+		"new: file3",
+		"changed: link1",
+		"",
+	}, "\n")
+	if builder.String() != expect {
+		t.Errorf("actual: %s", builder.String())
+		t.Errorf("expect: %s", expect)
+		t.FailNow()
+	}
+	if n := cfg.stats.numFilesUnchanged.Load(); n != 7 {
+		t.Fatalf("Incorrect numFilesUnchanged: %d", n)
+	}
+}
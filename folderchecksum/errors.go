@@ -0,0 +1,70 @@
+package folderchecksum
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// An error reading an entry in the folder, e.g., permission denied or a
+// file deleted during the scan. See Options.SkipError.
+type FileError struct {
+	// The path relative to Options.RootDir, slash separated.
+	Path string
+	Err  error
+	// The entries under Path are not walked either.
+	dir bool
+}
+
+func (e *FileError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// Returned by the walk and the workers once the scan is aborted.
+var errAborted = errors.New("aborted")
+
+// The errors of a scan. The first error not skipped by cfg.skipError
+// aborts the scan: the walk stops, the workers drain their channels, and
+// the tx is rolled back.
+type scanErrors struct {
+	mu      sync.Mutex
+	err     error
+	aborted atomic.Bool
+	// Only accessed by dbUpdateWorker until the scan ends.
+	skipped []FileError
+}
+
+// Abort the scan with err unless it's already aborted.
+func (e *scanErrors) abort(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err == nil {
+		e.err = err
+		e.aborted.Store(true)
+	}
+}
+
+// Return the error aborting the scan, or nil.
+func (e *scanErrors) get() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
+// Return the *FileError in err if it's skipped according to
+// cfg.skipError, in which case it's recorded. Otherwise abort the scan
+// with err and return nil.
+func skipFileError(cfg *config, err error) *FileError {
+	var fileErr *FileError
+	if errors.As(err, &fileErr) && cfg.skipError != nil &&
+		cfg.skipError(fileErr) {
+		cfg.errors.skipped = append(cfg.errors.skipped, *fileErr)
+		return fileErr
+	}
+	cfg.errors.abort(err)
+	return nil
+}
@@ -0,0 +1,93 @@
+package folderchecksum
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The algorithm names in the BSD-style tagged format, as printed by
+// coreutils (e.g., "md5sum --tag"), and xxhsum for xxhash.
+var checksumTags = map[string]string{
+	"md5":     "MD5",
+	"sha256":  "SHA256",
+	"sha512":  "SHA512",
+	"blake2b": "BLAKE2b",
+	"xxhash":  "XXH64",
+}
+
+// Escape relPath the way coreutils does: if it contains '\\', '\n' or
+// '\r', they are escaped, and the whole line is prefixed with '\\'.
+// Return the escaped path and whether it's escaped.
+func escapeManifestPath(relPath string) (string, bool) {
+	if !strings.ContainsAny(relPath, "\\\n\r") {
+		return relPath, false
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`)
+	return replacer.Replace(relPath), true
+}
+
+// Format a line of the checksum manifest, either in the GNU format
+// ("<checksum>  <path>") or the BSD-style tagged format
+// ("<TAG> (<path>) = <checksum>").
+func formatManifestLine(file *fileInfo, tagged bool) string {
+	relPath, escaped := escapeManifestPath(file.relPath)
+	var line string
+	if tagged {
+		line = checksumTags[file.algo] + " (" + relPath + ") = " +
+			file.checksum
+	} else {
+		line = file.checksum + "  " + relPath
+	}
+	if escaped {
+		line = `\` + line
+	}
+	return line
+}
+
+// Write the regular files in cfg.db (under cfg.prefix, and not excluded)
+// whose checksums are computed by algo to w, in the format accepted by
+// "md5sum -c" (or "sha256sum -c", etc.). Return the number of files
+// written.
+func exportManifest(cfg *config, w io.Writer, algo string,
+	tagged bool) (int64, error) {
+	prefixes := cfg.prefix
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+
+	out := bufio.NewWriter(w)
+	var numExported, numSkipped int64
+	for _, prefix := range prefixes {
+		err := queryFilesUnder(cfg.db, prefix, func(file *fileInfo) error {
+			if file.fileType != typeFile || shouldExcludePath(cfg,
+				file.relPath) {
+				return nil
+			}
+			if file.algo != algo {
+				// Including the files recorded with -sizeonly.
+				cfg.logger.debug("skipped: %s (algo '%s')", file.relPath,
+					file.algo)
+				numSkipped++
+				return nil
+			}
+			out.WriteString(formatManifestLine(file, tagged))
+			out.WriteByte('\n')
+			numExported++
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return 0, fmt.Errorf("Failed to write: %w", err)
+	}
+
+	if numSkipped != 0 {
+		cfg.logger.warning("Skipped %d files without %s checksums, use "+
+			"-migrate to rehash them", numSkipped, algo)
+	}
+	return numExported, nil
+}
@@ -0,0 +1,59 @@
+package folderchecksum
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestFormatManifestLine(t *testing.T) {
+	testCases := []struct {
+		path   string
+		tagged bool
+		expect string
+	}{
+		{"dir1/file1", false, "aaa  dir1/file1"},
+		{"dir1/file1", true, "MD5 (dir1/file1) = aaa"},
+		{"new\nline", false, `\aaa  new\nline`},
+		{"dir\\_2/\r", true, `\MD5 (dir\\_2/\r) = aaa`},
+	}
+	for _, testCase := range testCases {
+		file := fileInfo{relPath: testCase.path, checksum: "aaa",
+			algo: "md5"}
+		actual := formatManifestLine(&file, testCase.tagged)
+		if actual != testCase.expect {
+			t.Errorf("actual: %s", actual)
+			t.Errorf("expect: %s", testCase.expect)
+		}
+	}
+}
+
+func TestExportManifest(t *testing.T) {
+	db := prepareTestDb(t)
+	defer db.Close()
+	clearAndInsertRowsToFiles(t, db, append(testDbRows[:],
+		fileRow{path: "%dir1/dir1/file3", size: 1, checksum: "hhh",
+			algo: "sha256"}))
+
+	var builder strings.Builder
+	cfg := config{
+		db:        db,
+		prefix:    []string{"%dir1", "file2"},
+		excludeRe: regexp.MustCompile(`^(.*/file2)$`),
+		includeRe: regexp.MustCompile(`^(file2/.*)$`),
+	}
+	n, err := exportManifest(&cfg, &builder, "md5", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := strings.Join([]string{
+		"ccc  %dir1/dir1/file1",
+		"bbb  file2",
+		"bbb  file2/file1",
+		"",
+	}, "\n")
+	if builder.String() != expect || n != 3 {
+		t.Errorf("actual: %s", builder.String())
+		t.Errorf("expect: %s", expect)
+	}
+}
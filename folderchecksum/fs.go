@@ -0,0 +1,293 @@
+package folderchecksum
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// The stat tuple used to detect changes without reading the files. The
+// fields not supported by the platform are 0, except uid and gid which
+// are -1. mtime and ctime are in nanoseconds. mode only contains the
+// permission bits (including setuid, setgid and sticky).
+type fileStat struct {
+	mtime int64
+	ctime int64
+	inode int64
+	dev   int64
+	mode  int64
+	uid   int64
+	gid   int64
+}
+
+// The type of an entry in the folder (and in the db).
+type entryType int
+
+const (
+	typeFile entryType = 0
+	typeLink entryType = 1
+	typeDir  entryType = 2
+)
+
+// The options of walkDir.
+type walkOptions struct {
+	// Follow all the symlinks.
+	followLinks bool
+	// Call procOneFile on symlinks (instead of skipping them). Can't be
+	// used with followLinks.
+	trackLinks bool
+	// Call procOneFile on folders as well (except rootDir itself).
+	trackDirs bool
+	logger    *Logger
+	// The file system walked without followLinks, os.DirFS(rootDir) if
+	// it's nil. Replaced in tests.
+	fsys fs.FS
+}
+
+func isSymlink(mode fs.FileMode) bool {
+	return mode&fs.ModeSymlink != 0
+}
+
+// Return false for directories and regular files. Return true otherwise.
+func isSpecialFile(mode fs.FileMode) bool {
+	// Clear ModeDir bit from ModeType.
+	specialBits := fs.ModeType &^ fs.ModeDir
+	return (mode & specialBits) != 0
+}
+
+func cleanPrefix(prefix string) string {
+	// If prefix contains '..', the result of path.Clean() could be
+	// something like '..' or '../..'. So we prepend it with '/' to
+	// squash the excess '..', then remove the leading '/'.
+	return path.Clean("/" + prefix)[1:]
+}
+
+func checkDirExists(path string) error {
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fmt.Errorf("Failed to evaluate '%s': %w", path, err)
+	}
+	info, err := os.Stat(realPath)
+	if err != nil {
+		return fmt.Errorf("Failed to stat '%s': %w", realPath, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("Not a folder '%s'", realPath)
+	}
+	return nil
+}
+
+// Recursively enumerate all the files under rootDir whose relative
+// path starts with prefix. Call procOneFile with the path relative
+// to rootDir and the file info. procOneFile is NOT called on folders
+// unless opts.trackDirs is true.
+// Slash (/) is always used as path separator in prefix and relPath,
+// even on Windows.
+//
+// rootDir must be an existing directory. If prefix doesn't exist,
+// this function will return (without failing).
+//
+// By default symlinks in rootDir and prefix are followed and others
+// are skipped. When opts.followLinks is true, follow all the links.
+// When opts.trackLinks is true, call procOneFile on the links (with the
+// info of the links themselves) instead of skipping them.
+//
+// An entry that can't be read is passed to procError, and the walk goes
+// on unless procError returns an error. The walk stops at the first
+// error returned by procOneFile or procError, and returns it.
+func walkDir(rootDir string, prefix string, opts walkOptions,
+	procOneFile func(relPath string, info fs.FileInfo) error,
+	procError func(err *FileError) error) error {
+	if err := checkDirExists(rootDir); err != nil {
+		return err
+	}
+
+	// If prefix contains '..', the result of path.Clean() could be
+	// something like '..' or '../..'. So we prepend it with '/' to
+	// squash the excess '..', then remove the leading '/'.
+	prefixArg := cleanPrefix(prefix)
+	if prefixArg == "" {
+		prefixArg = "."
+	}
+	opts.logger.debug("WalkDir rootDir=%s, prefix=%s prefixArg=%s",
+		rootDir, prefix, prefixArg)
+
+	if opts.followLinks {
+		startPath := filepath.Join(rootDir, filepath.FromSlash(prefixArg))
+		info, err := os.Stat(startPath)
+		if err != nil {
+			if _, lerr := os.Lstat(startPath); lerr == nil {
+				return procError(&FileError{Path: prefixArg,
+					Err: fmt.Errorf("Broken link '%s': %w", prefixArg, err)})
+			}
+			opts.logger.warning("Failed to stat prefix '%s', skipped",
+				prefixArg)
+			return nil
+		}
+		return walkFollowLinks(rootDir, prefixArg, info, nil, &opts,
+			procOneFile, procError)
+	}
+
+	fsys := opts.fsys
+	if fsys == nil {
+		fsys = os.DirFS(rootDir)
+	}
+	return fs.WalkDir(fsys, prefixArg,
+		func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if d == nil {
+					// The initial fs.Stat failed.
+					opts.logger.warning("Failed to stat prefix '%s', skipped",
+						path)
+					return nil
+				}
+				// A directory's ReadDir method failed. fs.WalkDir would
+				// still walk the entries read before the error, skip
+				// them since the whole directory is reported.
+				err = procError(&FileError{Path: path,
+					Err: fmt.Errorf("Failed to walk '%s': %w", path, err),
+					dir: true})
+				if err != nil {
+					return err
+				}
+				return fs.SkipDir
+			}
+			isDir := d.IsDir()
+			mode := d.Type()
+			info, err := d.Info()
+			if err != nil {
+				return procError(&FileError{Path: path,
+					Err: fmt.Errorf("Failed to stat '%s': %w", path, err)})
+			}
+			opts.logger.debug("Found path=%s, isDir=%v, isSpecial=%v",
+				path, isDir, isSpecialFile(mode))
+
+			if !isDir && !isSpecialFile(mode) {
+				return procOneFile(path, info)
+			} else if opts.trackLinks && isSymlink(mode) {
+				return procOneFile(path, info)
+			} else if opts.trackDirs && isDir && path != "." {
+				return procOneFile(path, info)
+			}
+			return nil
+		})
+}
+
+// Walk relPath (whose info is already obtained by following the links)
+// and its subfiles, following all the symlinks. Broken links are passed
+// to procError. ancestors are the folders containing relPath. A folder
+// that is the same as one of its ancestors (i.e., a loop) is skipped.
+// os.SameFile compares the device and inode numbers on Unix.
+func walkFollowLinks(rootDir string, relPath string, info fs.FileInfo,
+	ancestors []fs.FileInfo, opts *walkOptions,
+	procOneFile func(string, fs.FileInfo) error,
+	procError func(*FileError) error) error {
+	opts.logger.debug("Found path=%s, isDir=%v, isSpecial=%v",
+		relPath, info.IsDir(), isSpecialFile(info.Mode()))
+
+	if !info.IsDir() {
+		if !isSpecialFile(info.Mode()) {
+			return procOneFile(relPath, info)
+		}
+		return nil
+	}
+
+	for _, ancestor := range ancestors {
+		if os.SameFile(ancestor, info) {
+			opts.logger.warning("Folder loop detected at '%s', skipped",
+				relPath)
+			return nil
+		}
+	}
+	ancestors = append(ancestors, info)
+	if opts.trackDirs && relPath != "." {
+		if err := procOneFile(relPath, info); err != nil {
+			return err
+		}
+	}
+
+	fullPath := filepath.Join(rootDir, filepath.FromSlash(relPath))
+	entries, err := os.ReadDir(fullPath)
+	if err != nil {
+		return procError(&FileError{Path: relPath,
+			Err: fmt.Errorf("Failed to walk '%s': %w", relPath, err),
+			dir: true})
+	}
+	for _, entry := range entries {
+		childRelPath := path.Join(relPath, entry.Name())
+		childInfo, err := os.Stat(filepath.Join(fullPath, entry.Name()))
+		if err != nil {
+			if isSymlink(entry.Type()) {
+				err = fmt.Errorf("Broken link '%s': %w", childRelPath, err)
+			} else {
+				err = fmt.Errorf("Failed to stat '%s': %w", childRelPath, err)
+			}
+			err = procError(&FileError{Path: childRelPath, Err: err})
+		} else {
+			err = walkFollowLinks(rootDir, childRelPath, childInfo, ancestors,
+				opts, procOneFile, procError)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the target of a symlink. Slash (/) is always used as the
+// path separator, even on Windows.
+func readLink(path string) (string, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read link '%s': %w", path, err)
+	}
+	return filepath.ToSlash(target), nil
+}
+
+// Return checksum string computed by algo and number of bytes read.
+func calcFileChecksum(filePath string, algo string) (string, int64, error) {
+	checksums, n, err := calcFileChecksums(filePath, []string{algo})
+	if err != nil {
+		return "", 0, err
+	}
+	return checksums[0], n, nil
+}
+
+// Read the file once and compute the checksums using all the algos.
+// Return checksum strings (in the same order as algos) and number of
+// bytes read.
+func calcFileChecksums(filePath string, algos []string) ([]string, int64,
+	error) {
+	var hashes []hash.Hash
+	var writers []io.Writer
+	for _, algo := range algos {
+		h, err := newHasher(algo)
+		if err != nil {
+			return nil, 0, err
+		}
+		hashes = append(hashes, h)
+		writers = append(writers, h)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to open '%s': %w", filePath, err)
+	}
+	defer file.Close()
+
+	n, err := io.Copy(io.MultiWriter(writers...), file)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to compute %v for '%s': %w",
+			algos, filePath, err)
+	}
+
+	var checksums []string
+	for _, h := range hashes {
+		checksums = append(checksums, fmt.Sprintf("%x", h.Sum(nil)))
+	}
+	return checksums, n, nil
+}
@@ -0,0 +1,598 @@
+package folderchecksum
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type walkRes struct {
+	path string
+	size int64
+}
+
+func verifyWalkRes(t *testing.T, actual []walkRes, expect []walkRes) {
+	if len(actual) != len(expect) {
+		t.Errorf("actual: %+v", actual)
+		t.Errorf("expect: %+v", expect)
+		t.FailNow()
+	}
+	for i := range actual {
+		if actual[i] != expect[i] {
+			t.Errorf("actual[%d]: %+v", i, actual[i])
+			t.Errorf("expect[%d]: %+v", i, expect[i])
+		}
+	}
+}
+
+// Call walkDir, and fail t if an error is reported.
+func testWalkDir(t *testing.T, rootDir string, prefix string, opts walkOptions,
+	procOneFile func(relPath string, info fs.FileInfo)) {
+	err := walkDir(rootDir, prefix, opts,
+		func(relPath string, info fs.FileInfo) error {
+			procOneFile(relPath, info)
+			return nil
+		},
+		func(err *FileError) error {
+			return err
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// - testDir
+// | file1
+// | file2
+// | emptyFile
+// | - dir1
+// | | file1
+// | | file2
+// | | - emptyDir
+// | - dir2
+// | | file1 -> ../file1
+// | | dir1 -> ../dir1
+func prepareTestDir(t *testing.T) string {
+	testDir := filepath.Join(t.TempDir(), "testDir")
+	err := os.Mkdir(testDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(testDir, "file1"), []byte("file1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(testDir, "file2"), []byte("file2"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(testDir, "emptyFile"), []byte(""), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir1 := filepath.Join(testDir, "dir1")
+	err = os.Mkdir(dir1, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(dir1, "emptyDir"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir1, "file1"), []byte("dir1/file1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir1, "file2"), []byte("dir1/file2"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir2 := filepath.Join(testDir, "dir2")
+	err = os.Mkdir(dir2, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(filepath.Join("..", "file1"), filepath.Join(dir2, "file1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(filepath.Join("..", "dir1"), filepath.Join(dir2, "dir1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testDir
+}
+
+func TestCalcFileChecksum(t *testing.T) {
+	// % echo -n '' | md5sum
+	// d41d8cd98f00b204e9800998ecf8427e  -
+	// % echo -n 'file1' | md5sum
+	// 826e8142e6baabe8af779f5f490cf5f5  -
+	// % echo -n 'dir1/file1' | md5sum
+	// a09ebcef8ab11daef0e33e4394ea775f  -
+
+	rootDir := prepareTestDir(t)
+
+	// Empty file.
+	md5, n, err := calcFileChecksum(
+		filepath.Join(rootDir, "emptyFile"), "md5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md5 != "d41d8cd98f00b204e9800998ecf8427e" {
+		t.Fatalf("Incorrect md5: %s", md5)
+	}
+	if n != 0 {
+		t.Fatalf("Incorrect n: %d", n)
+	}
+
+	// Non-empty file.
+	md5, n, err = calcFileChecksum(filepath.Join(rootDir, "file1"), "md5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md5 != "826e8142e6baabe8af779f5f490cf5f5" {
+		t.Fatalf("Incorrect md5: %s", md5)
+	}
+	if n != 5 {
+		t.Fatalf("Incorrect n: %d", n)
+	}
+
+	// Symlink to a file.
+	md5, n, err = calcFileChecksum(
+		filepath.Join(rootDir, "dir2", "file1"), "md5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md5 != "826e8142e6baabe8af779f5f490cf5f5" {
+		t.Fatalf("Incorrect md5: %s", md5)
+	}
+	if n != 5 {
+		t.Fatalf("Incorrect n: %d", n)
+	}
+
+	// Symlink in path.
+	md5, n, err = calcFileChecksum(
+		filepath.Join(rootDir, "dir2", "dir1", "file1"), "md5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md5 != "a09ebcef8ab11daef0e33e4394ea775f" {
+		t.Fatalf("Incorrect md5: %s", md5)
+	}
+	if n != 10 {
+		t.Fatalf("Incorrect n: %d", n)
+	}
+}
+
+func TestCalcFileChecksumAlgos(t *testing.T) {
+	// % echo -n 'file1' | sha256sum
+	// % echo -n 'file1' | sha512sum
+	// % echo -n 'file1' | b2sum
+	expect := map[string]string{
+		"md5": "826e8142e6baabe8af779f5f490cf5f5",
+		"sha256": "c147efcfc2d7ea666a9e4f5187b115c9" +
+			"0903f0fc896a56df9a6ef5d8f3fc9f31",
+		"sha512": "119c19f868a33109852c09d66f6a5c73" +
+			"a7cd52f38325020a461cd94a74edef88" +
+			"709fcbc547d96d0ad9da671260fc4232" +
+			"2d177378bad7a285f5df03f8e28f8565",
+		"blake2b": "cdd6f110d8bd98e98a7c744669634833" +
+			"9bde07da2291f2d2be7648f2f6165fe2" +
+			"46e219f8592a736770f96f64d3fd550a" +
+			"c64c11fe612e3452b82ba34367d435fc",
+		"xxhash": "4500d9a38090fc1b",
+		"crc32":  "9ee760e5",
+	}
+	if len(expect) != len(hashers)+len(verifyOnlyHashers) {
+		t.Fatalf("Untested hash algorithms: %v", HashAlgoNames())
+	}
+
+	rootDir := prepareTestDir(t)
+
+	for algo, checksum := range expect {
+		actual, n, err := calcFileChecksum(filepath.Join(rootDir, "file1"), algo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != checksum {
+			t.Errorf("Incorrect %s: %s", algo, actual)
+		}
+		if n != 5 {
+			t.Errorf("Incorrect n for %s: %d", algo, n)
+		}
+	}
+}
+
+func TestWalkDirIgnoreSymLinks(t *testing.T) {
+	var actual []walkRes
+	var expect []walkRes
+	procOneFile := func(relPath string, info fs.FileInfo) {
+		actual = append(actual, walkRes{relPath, info.Size()})
+	}
+
+	rootDir := prepareTestDir(t)
+
+	// Walk the whole rootDir.
+	expect = []walkRes{
+		{"dir1/file1", 10},
+		{"dir1/file2", 10},
+		{"emptyFile", 0},
+		{"file1", 5},
+		{"file2", 5},
+	}
+	actual = []walkRes{}
+	testWalkDir(t, rootDir, "", walkOptions{}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+	actual = []walkRes{}
+	testWalkDir(t, rootDir, "../../", walkOptions{}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+
+	// Use the subdir dir1 as prefix.
+	expect = []walkRes{
+		{"dir1/file1", 10},
+		{"dir1/file2", 10},
+	}
+	actual = []walkRes{}
+	testWalkDir(t, rootDir, "dir1/", walkOptions{}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+	actual = []walkRes{}
+	testWalkDir(t, rootDir, "dir1/../../../dir1", walkOptions{}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+
+	// Use the subdir dir2, dir1/emptyDir as prefix.
+	actual = []walkRes{}
+	expect = []walkRes{}
+	testWalkDir(t, rootDir, "dir2", walkOptions{}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+	testWalkDir(t, rootDir, "dir1/emptyDir/", walkOptions{}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+
+	// Use the subfile file1 as prefix.
+	actual = []walkRes{}
+	expect = []walkRes{
+		{"file1", 5},
+	}
+	testWalkDir(t, rootDir, "file1", walkOptions{}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+
+	// Use a non-existing subdir as prefix.
+	actual = []walkRes{}
+	expect = []walkRes{}
+	testWalkDir(t, rootDir, "dirX", walkOptions{}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+	testWalkDir(t, rootDir, "dir1/dirX", walkOptions{}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+	testWalkDir(t, rootDir, "dirX/dirX", walkOptions{}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+
+	// Use the symlink file1 as prefix. It's followed.
+	actual = []walkRes{}
+	expect = []walkRes{
+		{"dir2/file1", 5},
+	}
+	testWalkDir(t, rootDir, "dir2/file1", walkOptions{}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+
+	// Use the symlink dir1 as prefix. It's followed.
+	actual = []walkRes{}
+	expect = []walkRes{
+		{"dir2/dir1/file1", 10},
+		{"dir2/dir1/file2", 10},
+	}
+	testWalkDir(t, rootDir, "dir2/dir1", walkOptions{}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+
+	// Use a prefix that has a symlink in between. It's followed.
+	actual = []walkRes{}
+	expect = []walkRes{
+		{"dir2/dir1/file1", 10},
+	}
+	testWalkDir(t, rootDir, "dir2/dir1/file1", walkOptions{}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+
+	// Use the symlink dir1 as rootDir. It's followed.
+	actual = []walkRes{}
+	expect = []walkRes{
+		{"file1", 10},
+		{"file2", 10},
+	}
+	testWalkDir(t, filepath.Join(rootDir, "dir2", "dir1"), "", walkOptions{},
+		procOneFile)
+	verifyWalkRes(t, actual, expect)
+}
+
+func TestGetFileStat(t *testing.T) {
+	rootDir := prepareTestDir(t)
+	path := filepath.Join(rootDir, "file1")
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat1 := getFileStat(info)
+	if stat1.mtime != info.ModTime().UnixNano() {
+		t.Fatalf("Incorrect mtime: %+v", stat1)
+	}
+
+	// Rewriting the file with the same size changes the stat tuple.
+	mtime := info.ModTime().Add(time.Second)
+	err = os.Chtimes(path, mtime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat2 := getFileStat(info)
+	if stat1 == stat2 {
+		t.Fatalf("Unchanged stat: %+v", stat2)
+	}
+	if stat1.inode != stat2.inode || stat1.dev != stat2.dev {
+		t.Fatalf("Incorrect inode or dev: %+v, %+v", stat1, stat2)
+	}
+	// os.Getuid() and os.Getgid() return -1 on Windows, same as
+	// getFileStat.
+	if stat2.mode != 0644 || stat2.uid != int64(os.Getuid()) ||
+		stat2.gid != int64(os.Getgid()) {
+		t.Fatalf("Incorrect mode, uid or gid: %+v", stat2)
+	}
+
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat3 := getFileStat(info)
+	if stat3.mode != 0600 {
+		t.Fatalf("Incorrect mode: %+v", stat3)
+	}
+}
+
+func TestWalkDirFollowLinks(t *testing.T) {
+	var actual []walkRes
+	var expect []walkRes
+	procOneFile := func(relPath string, info fs.FileInfo) {
+		actual = append(actual, walkRes{relPath, info.Size()})
+	}
+
+	rootDir := prepareTestDir(t)
+
+	// Walk the whole rootDir.
+	expect = []walkRes{
+		{"dir1/file1", 10},
+		{"dir1/file2", 10},
+		{"dir2/dir1/file1", 10},
+		{"dir2/dir1/file2", 10},
+		{"dir2/file1", 5},
+		{"emptyFile", 0},
+		{"file1", 5},
+		{"file2", 5},
+	}
+	actual = []walkRes{}
+	testWalkDir(t, rootDir, "", walkOptions{followLinks: true}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+
+	// Use the subdir dir2 as prefix.
+	expect = []walkRes{
+		{"dir2/dir1/file1", 10},
+		{"dir2/dir1/file2", 10},
+		{"dir2/file1", 5},
+	}
+	actual = []walkRes{}
+	testWalkDir(t, rootDir, "dir2/", walkOptions{followLinks: true}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+
+	// Use the symlink file1 as prefix.
+	expect = []walkRes{
+		{"dir2/file1", 5},
+	}
+	actual = []walkRes{}
+	testWalkDir(t, rootDir, "dir2/file1", walkOptions{followLinks: true},
+		procOneFile)
+	verifyWalkRes(t, actual, expect)
+
+	// Use a non-existing subdir as prefix.
+	expect = []walkRes{}
+	actual = []walkRes{}
+	testWalkDir(t, rootDir, "dirX", walkOptions{followLinks: true}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+
+	// Create loops: dir1/loop -> .. and dir1/emptyDir/loop -> ../../dir2.
+	// The latter is a loop only when reached from dir2. The former is
+	// always a loop, even when reached from dir2/dir1.
+	err := os.Symlink("..", filepath.Join(rootDir, "dir1", "loop"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(filepath.Join("..", "..", "dir2"),
+		filepath.Join(rootDir, "dir1", "emptyDir", "loop"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = []walkRes{
+		{"dir1/emptyDir/loop/file1", 5},
+		{"dir1/file1", 10},
+		{"dir1/file2", 10},
+		{"dir2/dir1/file1", 10},
+		{"dir2/dir1/file2", 10},
+		{"dir2/file1", 5},
+		{"emptyFile", 0},
+		{"file1", 5},
+		{"file2", 5},
+	}
+	actual = []walkRes{}
+	testWalkDir(t, rootDir, "", walkOptions{followLinks: true}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+}
+
+func TestWalkDirTrackLinks(t *testing.T) {
+	var actual []walkRes
+	var expect []walkRes
+	var links []string
+	procOneFile := func(relPath string, info fs.FileInfo) {
+		actual = append(actual, walkRes{relPath, info.Size()})
+		if isSymlink(info.Mode()) {
+			links = append(links, relPath)
+		}
+	}
+
+	rootDir := prepareTestDir(t)
+	target1 := filepath.Join("..", "file1")
+	target2 := filepath.Join("..", "dir1")
+
+	// Walk the whole rootDir. The links are not followed.
+	expect = []walkRes{
+		{"dir1/file1", 10},
+		{"dir1/file2", 10},
+		{"dir2/dir1", int64(len(target2))},
+		{"dir2/file1", int64(len(target1))},
+		{"emptyFile", 0},
+		{"file1", 5},
+		{"file2", 5},
+	}
+	actual = []walkRes{}
+	links = []string{}
+	testWalkDir(t, rootDir, "", walkOptions{trackLinks: true}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+	if len(links) != 2 || links[0] != "dir2/dir1" || links[1] != "dir2/file1" {
+		t.Fatalf("Incorrect links: %v", links)
+	}
+	target, err := readLink(filepath.Join(rootDir, "dir2", "dir1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "../dir1" {
+		t.Fatalf("Incorrect target: %s", target)
+	}
+
+	// Use the symlink dir1 as prefix. It's followed.
+	expect = []walkRes{
+		{"dir2/dir1/file1", 10},
+		{"dir2/dir1/file2", 10},
+	}
+	actual = []walkRes{}
+	testWalkDir(t, rootDir, "dir2/dir1", walkOptions{trackLinks: true},
+		procOneFile)
+	verifyWalkRes(t, actual, expect)
+}
+
+func TestWalkDirTrackDirs(t *testing.T) {
+	var actual []walkRes
+	var expect []walkRes
+	procOneFile := func(relPath string, info fs.FileInfo) {
+		size := info.Size()
+		if info.IsDir() {
+			// The size of a folder depends on the file system.
+			size = -1
+		}
+		actual = append(actual, walkRes{relPath, size})
+	}
+
+	rootDir := prepareTestDir(t)
+
+	// Walk the whole rootDir. The root itself is not reported.
+	expect = []walkRes{
+		{"dir1", -1},
+		{"dir1/emptyDir", -1},
+		{"dir1/file1", 10},
+		{"dir1/file2", 10},
+		{"dir2", -1},
+		{"emptyFile", 0},
+		{"file1", 5},
+		{"file2", 5},
+	}
+	actual = []walkRes{}
+	testWalkDir(t, rootDir, "", walkOptions{trackDirs: true}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+
+	// The prefix folder itself is reported.
+	expect = []walkRes{
+		{"dir1", -1},
+		{"dir1/emptyDir", -1},
+		{"dir1/file1", 10},
+		{"dir1/file2", 10},
+	}
+	actual = []walkRes{}
+	testWalkDir(t, rootDir, "dir1", walkOptions{trackDirs: true}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+
+	// Follow the links. The linked folder is reported as a folder.
+	expect = []walkRes{
+		{"dir1", -1},
+		{"dir1/emptyDir", -1},
+		{"dir1/file1", 10},
+		{"dir1/file2", 10},
+		{"dir2", -1},
+		{"dir2/dir1", -1},
+		{"dir2/dir1/emptyDir", -1},
+		{"dir2/dir1/file1", 10},
+		{"dir2/dir1/file2", 10},
+		{"dir2/file1", 5},
+		{"emptyFile", 0},
+		{"file1", 5},
+		{"file2", 5},
+	}
+	actual = []walkRes{}
+	testWalkDir(t, rootDir, "",
+		walkOptions{followLinks: true, trackDirs: true}, procOneFile)
+	verifyWalkRes(t, actual, expect)
+}
+
+// A file system whose ReadDir of dir misses the last entry, and returns an
+// error.
+type partialReadDirFS struct {
+	fs.FS
+	dir string
+}
+
+func (fsys partialReadDirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(fsys.FS, name)
+	if err != nil || name != fsys.dir {
+		return entries, err
+	}
+	return entries[:len(entries)-1], fs.ErrPermission
+}
+
+func TestWalkDirPartlyUnreadable(t *testing.T) {
+	rootDir := prepareTestDir(t)
+	opts := walkOptions{
+		fsys: partialReadDirFS{FS: os.DirFS(rootDir), dir: "dir1"},
+	}
+	var actual []walkRes
+	var dirErrors []string
+	err := walkDir(rootDir, "", opts,
+		func(relPath string, info fs.FileInfo) error {
+			actual = append(actual, walkRes{relPath, info.Size()})
+			return nil
+		},
+		func(err *FileError) error {
+			if !err.dir {
+				t.Fatalf("Unexpected error: %s", err.Error())
+			}
+			dirErrors = append(dirErrors, err.Path)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The entries read before the error are not walked either.
+	verifyWalkRes(t, actual, []walkRes{
+		{"emptyFile", 0},
+		{"file1", 5},
+		{"file2", 5},
+	})
+	if len(dirErrors) != 1 || dirErrors[0] != "dir1" {
+		t.Fatalf("Incorrect errors: %v", dirErrors)
+	}
+}
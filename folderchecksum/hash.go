@@ -0,0 +1,118 @@
+package folderchecksum
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"sort"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Older versions of this tool always used md5, and didn't record the
+// algorithm in the db.
+const DefaultHashAlgo = "md5"
+
+// The registry of supported hash algorithms. The key is the name used
+// in -hash and recorded in the db.
+var hashers = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake2b": func() hash.Hash {
+		// New512 only fails when the key is too long.
+		h, _ := blake2b.New512(nil)
+		return h
+	},
+	"xxhash": func() hash.Hash {
+		return xxhash.New()
+	},
+}
+
+// The hash algorithms only used to verify the checksums imported from
+// manifests (e.g., SFV files). They can't be used by -hash or recorded
+// as the algorithm of a db, so the files added later are hashed by one
+// of hashers instead.
+var verifyOnlyHashers = map[string]func() hash.Hash{
+	"crc32": func() hash.Hash {
+		return crc32.NewIEEE()
+	},
+}
+
+// Return the sorted names of all the supported hash algorithms.
+func HashAlgoNames() []string {
+	var names []string
+	for name := range hashers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func isValidHashAlgo(algo string) bool {
+	_, ok := hashers[algo]
+	return ok
+}
+
+// Return the constructor of algo, which is one of hashers or
+// verifyOnlyHashers.
+func findHasher(algo string) (func() hash.Hash, bool) {
+	if newHash, ok := hashers[algo]; ok {
+		return newHash, true
+	}
+	newHash, ok := verifyOnlyHashers[algo]
+	return newHash, ok
+}
+
+func newHasher(algo string) (hash.Hash, error) {
+	newHash, ok := findHasher(algo)
+	if !ok {
+		return nil, fmt.Errorf("Unknown hash algorithm '%s', expected one "+
+			"of: %s", algo, strings.Join(HashAlgoNames(), ", "))
+	}
+	return newHash(), nil
+}
+
+// Determine the hash algorithm used with s. If requested is empty, the
+// algorithm recorded in s is used. A db without such a record is either
+// new or created by an older version of this tool (md5 only). Requesting
+// an algorithm different from the recorded one is only allowed when
+// migrating, in which case the db is switched to the requested one. The
+// chosen algorithm should be recorded into s by the tx updating it.
+func resolveHashAlgo(s store, requested string, migrate bool,
+	logger *Logger) (string, error) {
+	recorded, ok, err := s.queryMeta("hash")
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		recorded = DefaultHashAlgo
+		n := int64(0)
+		if requested != "" {
+			if n, err = s.countFilesWithChecksum(); err != nil {
+				return "", err
+			}
+		}
+		if requested != "" && n == 0 {
+			// A new db.
+			recorded = requested
+		}
+	}
+
+	algo := recorded
+	if requested != "" && requested != recorded {
+		if !migrate {
+			return "", fmt.Errorf("Hash algorithm mismatch: -hash is '%s', "+
+				"but the db uses '%s'", requested, recorded)
+		}
+		logger.info("Switching the db from '%s' to '%s'", recorded,
+			requested)
+		algo = requested
+	}
+	return algo, nil
+}
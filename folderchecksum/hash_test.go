@@ -0,0 +1,143 @@
+package folderchecksum
+
+import (
+	"testing"
+)
+
+func TestResolveHashAlgo(t *testing.T) {
+	var algo string
+	var err error
+
+	// A new db uses the default algorithm, or the requested one.
+	db := prepareTestDb(t)
+	defer db.Close()
+	s := newSqliteStore(db)
+	algo, err = resolveHashAlgo(s, "", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algo != DefaultHashAlgo {
+		t.Fatalf("Incorrect algo: %s", algo)
+	}
+	algo, err = resolveHashAlgo(s, "sha256", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algo != "sha256" {
+		t.Fatalf("Incorrect algo: %s", algo)
+	}
+	// Left to the tx updating the db.
+	if _, ok, err := queryMeta(db, "hash"); err != nil || ok {
+		t.Fatalf("Algo recorded by resolveHashAlgo: %v", err)
+	}
+	if err = setMeta(db, "hash", algo); err != nil {
+		t.Fatal(err)
+	}
+
+	// The recorded algorithm is used afterwards.
+	algo, err = resolveHashAlgo(s, "", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algo != "sha256" {
+		t.Fatalf("Incorrect algo: %s", algo)
+	}
+	algo, err = resolveHashAlgo(s, "sha256", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algo != "sha256" {
+		t.Fatalf("Incorrect algo: %s", algo)
+	}
+
+	// A db created by an older version has md5 checksums but no record.
+	db2 := prepareTestDb(t)
+	defer db2.Close()
+	clearAndInsertRowsToFiles(t, db2, testDbRows[:])
+	s2 := newSqliteStore(db2)
+	algo, err = resolveHashAlgo(s2, "md5", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algo != "md5" {
+		t.Fatalf("Incorrect algo: %s", algo)
+	}
+	algo, err = resolveHashAlgo(s2, "", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algo != "md5" {
+		t.Fatalf("Incorrect algo: %s", algo)
+	}
+}
+
+func TestNewHasher(t *testing.T) {
+	for _, name := range HashAlgoNames() {
+		if !isValidHashAlgo(name) {
+			t.Errorf("Invalid algo: %s", name)
+		}
+		h, err := newHasher(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Size() <= 0 {
+			t.Errorf("Incorrect size for %s: %d", name, h.Size())
+		}
+	}
+	if isValidHashAlgo("md4") {
+		t.Errorf("md4 should be invalid")
+	}
+	// Only used to verify the imported checksums.
+	if isValidHashAlgo("crc32") {
+		t.Errorf("crc32 should be invalid")
+	}
+	if _, err := newHasher("crc32"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveHashAlgoMigrate(t *testing.T) {
+	db := prepareTestDb(t)
+	defer db.Close()
+	clearAndInsertRowsToFiles(t, db, testDbRows[:])
+	s := newSqliteStore(db)
+
+	// Switch a db created by an older version.
+	algo, err := resolveHashAlgo(s, "sha256", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algo != "sha256" {
+		t.Fatalf("Incorrect algo: %s", algo)
+	}
+	// Not switched until recorded by the migration.
+	algo, err = resolveHashAlgo(s, "", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algo != "md5" {
+		t.Fatalf("Incorrect algo: %s", algo)
+	}
+	if err = setMeta(db, "hash", "sha256"); err != nil {
+		t.Fatal(err)
+	}
+	algo, err = resolveHashAlgo(s, "", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algo != "sha256" {
+		t.Fatalf("Incorrect algo: %s", algo)
+	}
+
+	// Switch again.
+	algo, err = resolveHashAlgo(s, "blake2b", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algo != "blake2b" {
+		t.Fatalf("Incorrect algo: %s", algo)
+	}
+	if _, err = resolveHashAlgo(s, "blake2b", false, nil); err == nil {
+		t.Fatal("Expected an error for the mismatch")
+	}
+}
@@ -0,0 +1,295 @@
+package folderchecksum
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// The columns of file_versions copied from (and compared against) the
+// files table, besides path.
+var versionColumns = []string{"size", "checksum", "algo", "mtime", "ctime",
+	"inode", "dev", "mode", "uid", "gid", "type", "target", "xattrs"}
+
+const runsTableDef = `runs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	time INT NOT NULL)`
+
+// Each row is the state of a path from run_from (inclusive) to run_to
+// (exclusive). run_to is NULL for the current state.
+const versionsTableDef = `file_versions (
+	path TEXT NOT NULL,
+	run_from INT NOT NULL,
+	run_to INT NULL,
+	size INT NOT NULL,
+	checksum TEXT NULL,
+	algo TEXT NULL,
+	mtime INT NULL,
+	ctime INT NULL,
+	inode INT NULL,
+	dev INT NULL,
+	mode INT NULL,
+	uid INT NULL,
+	gid INT NULL,
+	type INT NOT NULL DEFAULT 0,
+	target TEXT NULL,
+	xattrs TEXT NULL,
+	PRIMARY KEY (path, run_from))`
+
+func createHistoryTables(tx *sql.Tx) error {
+	for _, def := range []string{runsTableDef, versionsTableDef} {
+		_, err := tx.Exec("CREATE TABLE IF NOT EXISTS " + def)
+		if err != nil {
+			return fmt.Errorf("Failed to create table: %w", err)
+		}
+	}
+	return nil
+}
+
+// Determine whether the history is recorded. Once -history is used with
+// -update, it's recorded in s (by the tx updating the files) and all the
+// later updates record the history as well.
+func resolveHistory(s store, requested bool, update bool) (bool, error) {
+	_, enabled, err := s.queryMeta("history")
+	if err != nil {
+		return false, err
+	}
+	return enabled || (requested && update), nil
+}
+
+// Record the current content of the files table as a new run. Only the
+// rows different from the previous run are stored. Return the run id.
+func recordRun(tx *sql.Tx, now time.Time) (int64, error) {
+	res, err := tx.Exec(`INSERT INTO runs(time) VALUES(?)`, now.UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("Failed to insert run: %w", err)
+	}
+	runId, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get run id: %w", err)
+	}
+
+	var same []string
+	for _, col := range versionColumns {
+		same = append(same, "f."+col+" IS v."+col)
+	}
+	cols := strings.Join(versionColumns, ", ")
+
+	// Close the versions that are changed or deleted.
+	_, err = tx.Exec(
+		`UPDATE file_versions AS v SET run_to=?
+			WHERE run_to IS NULL AND NOT EXISTS (
+				SELECT 1 FROM files AS f
+					WHERE f.path=v.path AND `+strings.Join(same, " AND ")+`)`,
+		runId)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to close versions: %w", err)
+	}
+	// Open a version for each new or changed file.
+	_, err = tx.Exec(
+		`INSERT INTO file_versions(path, run_from, run_to, `+cols+`)
+			SELECT path, ?, NULL, `+cols+` FROM files AS f
+				WHERE NOT EXISTS (
+					SELECT 1 FROM file_versions AS v
+						WHERE v.path=f.path AND v.run_to IS NULL)`,
+		runId)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to open versions: %w", err)
+	}
+
+	return runId, nil
+}
+
+func runExists(db *sql.DB, runId int64) (bool, error) {
+	var n int64
+	err := db.QueryRow(`SELECT COUNT(*) FROM runs WHERE id=?`, runId).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("Failed to query run %d: %w", runId, err)
+	}
+	return n != 0, nil
+}
+
+// Copy the snapshot of run runId in db (opened from dbFile) into a new
+// temporary db, whose files table has the same content as db had right
+// after that run. The user should call Close() on the returned db, then
+// remove the returned temp folder.
+func openSnapshotDb(db *sql.DB, dbFile string,
+	runId int64) (*sql.DB, string, error) {
+	ok, err := runExists(db, runId)
+	if err != nil {
+		return nil, "", err
+	}
+	if !ok {
+		return nil, "", fmt.Errorf("Run %d not found in '%s'", runId, dbFile)
+	}
+
+	return openTempDb("snapshot.db", func(snapshotDb *sql.DB) error {
+		return copySnapshot(snapshotDb, dbFile, runId)
+	})
+}
+
+// Fill the files table of snapshotDb with the snapshot of run runId in
+// dbFile.
+func copySnapshot(snapshotDb *sql.DB, dbFile string, runId int64) error {
+	// ATTACH can't be used in a tx, and applies to a single connection.
+	snapshotDb.SetMaxOpenConns(1)
+	_, err := snapshotDb.Exec(`ATTACH DATABASE ? AS src`,
+		readOnlyDbUri(dbFile))
+	if err != nil {
+		return fmt.Errorf("Failed to attach '%s': %w", dbFile, err)
+	}
+	cols := strings.Join(versionColumns, ", ")
+	tx, err := createTx(snapshotDb)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO meta SELECT * FROM src.meta`)
+	if err != nil {
+		return fmt.Errorf("Failed to copy meta: %w", err)
+	}
+	_, err = tx.Exec(
+		`INSERT INTO files(path, `+cols+`, visited)
+			SELECT path, `+cols+`, 0 FROM src.file_versions
+				WHERE run_from<=? AND (run_to IS NULL OR run_to>?)`,
+		runId, runId)
+	if err != nil {
+		return fmt.Errorf("Failed to copy run %d: %w", runId, err)
+	}
+	if err = commitTx(tx); err != nil {
+		return err
+	}
+	_, err = snapshotDb.Exec(`DETACH DATABASE src`)
+	if err != nil {
+		return fmt.Errorf("Failed to detach '%s': %w", dbFile, err)
+	}
+	return nil
+}
+
+// Print the runs in db, one per line: the id, the time, and the number
+// of entries new or changed in that run.
+func listRuns(db *sql.DB, w io.Writer) error {
+	rows, err := db.Query(
+		`SELECT id, time,
+			(SELECT COUNT(*) FROM file_versions WHERE run_from=id)
+			FROM runs ORDER BY id ASC`)
+	if err != nil {
+		return fmt.Errorf("Failed to query runs: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, t, n int64
+		err = rows.Scan(&id, &t, &n)
+		if err != nil {
+			return fmt.Errorf("Failed to scan runs: %w", err)
+		}
+		_, err = fmt.Fprintf(w, "%d\t%s\t%d\n", id,
+			time.Unix(0, t).Format(time.RFC3339), n)
+		if err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("Failed to query runs: %w", err)
+	}
+	return nil
+}
+
+// A change of a path recorded in file_versions.
+type fileEvent struct {
+	runId  int64
+	time   int64
+	status string    // new, changed, metachanged or deleted
+	file   *fileInfo // nil if deleted
+}
+
+// Return the timeline of relPath in the order of runs. A version is
+// "changed" if its content differs from the previous one (see
+// isContentChanged), or "metachanged" if only the metadata differs.
+func queryFileHistory(db *sql.DB, relPath string) ([]fileEvent, error) {
+	rows, err := db.Query(
+		`SELECT run_from, (SELECT time FROM runs WHERE id=run_from),
+			COALESCE(run_to, 0),
+			COALESCE((SELECT time FROM runs WHERE id=run_to), 0),
+			`+fileInfoColumns+`
+			FROM file_versions WHERE path=? ORDER BY run_from ASC`,
+		relPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query history of %s: %w", relPath,
+			err)
+	}
+	defer rows.Close()
+
+	type version struct {
+		runFrom, runFromTime, runTo, runToTime int64
+		file                                   fileInfo
+	}
+	var versions []version
+	for rows.Next() {
+		v := version{file: fileInfo{relPath: relPath}}
+		err = rows.Scan(append([]any{&v.runFrom, &v.runFromTime, &v.runTo,
+			&v.runToTime}, fileInfoScanDest(&v.file)...)...)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to scan history of %s: %w",
+				relPath, err)
+		}
+		versions = append(versions, v)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to query history of %s: %w", relPath,
+			err)
+	}
+
+	var events []fileEvent
+	for i := range versions {
+		v := &versions[i]
+		status := "new"
+		if i > 0 && versions[i-1].runTo == v.runFrom {
+			status = "metachanged"
+			if isContentChanged(&versions[i-1].file, &v.file) {
+				status = "changed"
+			}
+		}
+		events = append(events, fileEvent{runId: v.runFrom,
+			time: v.runFromTime, status: status, file: &v.file})
+		// A closed version is deleted unless the next one starts from
+		// the same run.
+		if v.runTo != 0 &&
+			(i+1 == len(versions) || versions[i+1].runFrom != v.runTo) {
+			events = append(events, fileEvent{runId: v.runTo,
+				time: v.runToTime, status: "deleted"})
+		}
+	}
+	return events, nil
+}
+
+// Print the timeline of relPath, one event per line: the run id, the time,
+// the status, the size and the checksum (or the target of a symlink, or "-"
+// for a folder).
+func printFileHistory(db *sql.DB, relPath string, w io.Writer) error {
+	events, err := queryFileHistory(db, relPath)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		fmt.Fprintf(w, "%d\t%s\t%s", event.runId,
+			time.Unix(0, event.time).Format(time.RFC3339), event.status)
+		if file := event.file; file != nil {
+			value := file.checksum
+			switch file.fileType {
+			case typeLink:
+				value = file.target
+			case typeDir:
+				value = "-"
+			}
+			fmt.Fprintf(w, "\t%d\t%s", file.size, value)
+		}
+		if _, err = fmt.Fprintln(w, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package folderchecksum
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveHistory(t *testing.T) {
+	db := prepareTestDb(t)
+	defer db.Close()
+	s := newSqliteStore(db)
+
+	if history, err := resolveHistory(s, true, false); err != nil ||
+		history {
+		t.Fatalf("History enabled without update: %v", err)
+	}
+	if history, err := resolveHistory(s, true, true); err != nil ||
+		!history {
+		t.Fatalf("History not enabled: %v", err)
+	}
+	// It's sticky once recorded by the tx updating the db.
+	if history, err := resolveHistory(s, false, true); err != nil ||
+		history {
+		t.Fatalf("History recorded by resolveHistory: %v", err)
+	}
+	if err := setMeta(db, "history", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if history, err := resolveHistory(s, false, true); err != nil ||
+		!history {
+		t.Fatalf("History not recorded in db: %v", err)
+	}
+}
+
+func TestRecordRunAndSnapshot(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "test.db")
+	db, err := openDb(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := createTablesIfNeeded(db, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run 1.
+	run1Rows := copyAndSortFileRows(testDbRows[:])
+	clearAndInsertRowsToFiles(t, db, run1Rows)
+	tx, err := createTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run1, err := recordRun(tx, time.Unix(100, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := commitTx(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run 2: file1 changed, file2 deleted, file3 new, the others are
+	// unchanged.
+	var run2Rows []fileRow
+	for _, row := range run1Rows {
+		switch row.path {
+		case "file1":
+			row.checksum = "zzz"
+		case "file2":
+			continue
+		}
+		run2Rows = append(run2Rows, row)
+	}
+	run2Rows = append(run2Rows, fileRow{path: "file3", size: 1,
+		checksum: "yyy", algo: "md5"})
+	clearAndInsertRowsToFiles(t, db, run2Rows)
+	tx, err = createTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run2, err := recordRun(tx, time.Unix(200, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := commitTx(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int64
+	err = db.QueryRow(`SELECT COUNT(*) FROM file_versions`).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(run1Rows)+2) {
+		t.Fatalf("Incorrect number of versions: %d", n)
+	}
+
+	var sb strings.Builder
+	if err := listRuns(db, &sb); err != nil {
+		t.Fatal(err)
+	}
+	expectRuns := []string{
+		"1\t" + time.Unix(100, 0).Format(time.RFC3339) + "\t11",
+		"2\t" + time.Unix(200, 0).Format(time.RFC3339) + "\t2",
+		"",
+	}
+	if sb.String() != strings.Join(expectRuns, "\n") {
+		t.Fatalf("Incorrect runs:\n%s", sb.String())
+	}
+
+	for _, run := range []struct {
+		id   int64
+		rows []fileRow
+	}{
+		{run1, run1Rows},
+		{run2, run2Rows},
+	} {
+		snapshotDb, dir, err := openSnapshotDb(db, dbFile, run.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actualRows := getAllRowsFromFiles(t, snapshotDb)
+		snapshotDb.Close()
+		os.RemoveAll(dir)
+
+		var expectRows []fileRow
+		for _, row := range run.rows {
+			row.visited = false
+			expectRows = append(expectRows, row)
+		}
+		verifyFileRows(t, actualRows, copyAndSortFileRows(expectRows))
+	}
+}
+
+func TestQueryFileHistory(t *testing.T) {
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	file := fileRow{path: "file1", size: 1, checksum: "aaa", algo: "md5",
+		stat: fileStat{mtime: 1, mode: 0644}}
+	other := fileRow{path: "file2", size: 1, checksum: "bbb", algo: "md5"}
+	recordRun := func(rows ...fileRow) {
+		clearAndInsertRowsToFiles(t, db, append(rows, other))
+		tx, err := createTx(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := recordRun(tx, time.Unix(100, 0)); err != nil {
+			t.Fatal(err)
+		}
+		if err := commitTx(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recordRun(file)
+	recordRun(file)
+	file.stat.mode = 0600
+	recordRun(file)
+	file.checksum = "ccc"
+	recordRun(file)
+	recordRun()
+	recordRun()
+	recordRun(file)
+
+	events, err := queryFileHistory(db, "file1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []string
+	for _, event := range events {
+		statuses = append(statuses,
+			fmt.Sprintf("%d %s", event.runId, event.status))
+		if (event.status == "deleted") != (event.file == nil) {
+			t.Fatalf("Incorrect event: %+v", event)
+		}
+	}
+	expect := []string{"1 new", "3 metachanged", "4 changed", "5 deleted",
+		"7 new"}
+	if strings.Join(statuses, ", ") != strings.Join(expect, ", ") {
+		t.Fatalf("Incorrect history: %v", statuses)
+	}
+}
+
+func TestPrintFileHistoryDir(t *testing.T) {
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	row := fileRow{path: "dir1", fileType: typeDir}
+	clearAndInsertRowsToFiles(t, db, []fileRow{row})
+	tx, err := createTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := recordRun(tx, time.Unix(100, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitTx(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	var builder strings.Builder
+	if err := printFileHistory(db, "dir1", &builder); err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Split(strings.TrimSuffix(builder.String(), "\n"), "\t")
+	if len(fields) != 5 || fields[2] != "new" || fields[4] != "-" {
+		t.Fatalf("Incorrect history: %q", builder.String())
+	}
+}
+
+func TestListRunsMissingDb(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{".checksum.db", "db.txt"} {
+		dbFile := filepath.Join(dir, name)
+		var builder strings.Builder
+		if err := ListRuns(dbFile, &builder); err == nil {
+			t.Fatalf("Expected an error for %s", name)
+		}
+		if _, err := os.Stat(dbFile); !os.IsNotExist(err) {
+			t.Fatalf("%s is created", name)
+		}
+	}
+}
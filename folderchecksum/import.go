@@ -0,0 +1,344 @@
+package folderchecksum
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The formats of checksum manifests accepted by the import command. "auto"
+// detects the format from the first line.
+var manifestFormats = []string{"auto", "gnu", "bsd", "hashdeep", "sfv"}
+
+// Return the manifest formats supported by Import.
+func ManifestFormats() []string {
+	return append([]string(nil), manifestFormats...)
+}
+
+// The size of the files imported from manifests without sizes.
+const unknownSize = -1
+
+var (
+	// "<checksum>  <path>" or "<checksum> *<path>", by md5sum etc.
+	gnuLineRe = regexp.MustCompile(`^\\?([0-9a-fA-F]+) [ *](.+)$`)
+	// "<TAG> (<path>) = <checksum>", by "md5sum --tag" etc.
+	bsdLineRe = regexp.MustCompile(`^\\?([A-Za-z0-9-]+) \((.+)\) = ([0-9a-fA-F]+)$`)
+	// "<path> <crc32>".
+	sfvLineRe = regexp.MustCompile(`^(.+) ([0-9a-fA-F]{8})$`)
+)
+
+const hashdeepHeader = "%%%% HASHDEEP-1.0"
+
+func isValidManifestFormat(format string) bool {
+	for _, f := range manifestFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Unescape a path escaped the way coreutils does (see escapeManifestPath).
+func unescapeManifestPath(escaped string) string {
+	replacer := strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r")
+	return replacer.Replace(escaped)
+}
+
+// Return the algorithm producing checksums of this length, preferring the
+// more common one (e.g., sha512 over blake2b).
+func guessHashAlgo(checksum string) string {
+	for _, algo := range []string{"md5", "sha256", "sha512", "xxhash",
+		"crc32"} {
+		newHash, _ := findHasher(algo)
+		if len(checksum) == newHash().Size()*2 {
+			return algo
+		}
+	}
+	return ""
+}
+
+// Detect the format of a manifest from its first line.
+func detectManifestFormat(line string) string {
+	switch {
+	case strings.HasPrefix(line, hashdeepHeader):
+		return "hashdeep"
+	case bsdLineRe.MatchString(line):
+		return "bsd"
+	case gnuLineRe.MatchString(line):
+		return "gnu"
+	case strings.HasPrefix(line, ";") || sfvLineRe.MatchString(line):
+		return "sfv"
+	}
+	return ""
+}
+
+// Parse a checksum manifest in the given format. The algorithm of the gnu
+// format is determined by the checksum length unless algo is specified.
+// For hashdeep, the column of algo (or the first supported one) is used.
+// name is used in the error messages.
+func parseManifest(r io.Reader, name string, format string,
+	algo string, logger *Logger) ([]fileInfo, error) {
+	var files []fileInfo
+	var hashdeepColumns []string
+	hashdeepColumn := -1
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if format == "auto" {
+			format = detectManifestFormat(line)
+			if format == "" {
+				return nil, fmt.Errorf("%s:%d: unknown manifest format", name,
+					lineNum)
+			}
+			logger.info("Detected format of '%s': %s", name, format)
+		}
+
+		file := fileInfo{
+			size:     unknownSize,
+			stat:     fileStat{mode: -1, uid: -1, gid: -1},
+			fileType: typeFile,
+		}
+		var relPath string
+		switch format {
+		case "gnu":
+			m := gnuLineRe.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("%s:%d: invalid line", name, lineNum)
+			}
+			file.checksum, relPath = m[1], m[2]
+			file.algo = algo
+			if algo == "" {
+				file.algo = guessHashAlgo(file.checksum)
+			}
+		case "bsd":
+			m := bsdLineRe.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("%s:%d: invalid line", name, lineNum)
+			}
+			for a, tag := range checksumTags {
+				if tag == m[1] {
+					file.algo = a
+				}
+			}
+			if file.algo == "" {
+				return nil, fmt.Errorf("%s:%d: unsupported algorithm '%s'",
+					name, lineNum, m[1])
+			}
+			relPath, file.checksum = m[2], m[3]
+		case "sfv":
+			if strings.HasPrefix(line, ";") {
+				// A comment.
+				continue
+			}
+			m := sfvLineRe.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("%s:%d: invalid line", name, lineNum)
+			}
+			relPath, file.checksum = m[1], m[2]
+			file.algo = "crc32"
+		case "hashdeep":
+			if strings.HasPrefix(line, "##") || line == hashdeepHeader {
+				// A comment.
+				continue
+			}
+			if strings.HasPrefix(line, "%%%% ") {
+				hashdeepColumns = strings.Split(line[len("%%%% "):], ",")
+				var err error
+				hashdeepColumn, err = findHashdeepColumn(hashdeepColumns,
+					name, algo)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if hashdeepColumn < 0 {
+				return nil, fmt.Errorf("%s:%d: missing column header", name,
+					lineNum)
+			}
+			// The path is the last column, and may contain ','.
+			fields := strings.SplitN(line, ",", len(hashdeepColumns))
+			if len(fields) != len(hashdeepColumns) {
+				return nil, fmt.Errorf("%s:%d: invalid line", name, lineNum)
+			}
+			size, err := strconv.ParseInt(fields[0], 10, 64)
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("%s:%d: invalid size '%s'", name,
+					lineNum, fields[0])
+			}
+			file.size = size
+			file.checksum = fields[hashdeepColumn]
+			file.algo = hashdeepColumns[hashdeepColumn]
+			relPath = fields[len(fields)-1]
+		default:
+			return nil, fmt.Errorf("Unknown manifest format '%s', expected "+
+				"one of: %s", format, strings.Join(manifestFormats, ", "))
+		}
+
+		if strings.HasPrefix(line, `\`) && (format == "gnu" ||
+			format == "bsd") {
+			relPath = unescapeManifestPath(relPath)
+		}
+		file.relPath = cleanPrefix(relPath)
+		if file.relPath == "" || strings.HasPrefix(relPath, "/") {
+			return nil, fmt.Errorf("%s:%d: invalid path '%s', expected a "+
+				"path relative to <rootdir>", name, lineNum, relPath)
+		}
+		file.checksum = strings.ToLower(file.checksum)
+		if err := checkChecksum(&file, name, lineNum); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read '%s': %w", name, err)
+	}
+	return files, nil
+}
+
+// Return the index of the checksum column to import from the hashdeep
+// columns, e.g., "size,md5,sha256,filename".
+func findHashdeepColumn(columns []string, name string,
+	algo string) (int, error) {
+	if len(columns) < 3 || columns[0] != "size" ||
+		columns[len(columns)-1] != "filename" {
+		return -1, fmt.Errorf("%s: unsupported hashdeep columns '%s'", name,
+			strings.Join(columns, ","))
+	}
+	for i := 1; i < len(columns)-1; i++ {
+		if columns[i] == algo || (algo == "" && isValidHashAlgo(columns[i])) {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("%s: no supported checksum in hashdeep columns "+
+		"'%s'", name, strings.Join(columns, ","))
+}
+
+// Check that the checksum is a hex string of the length produced by its
+// algorithm.
+func checkChecksum(file *fileInfo, name string, lineNum int) error {
+	newHash, ok := findHasher(file.algo)
+	if !ok {
+		return fmt.Errorf("%s:%d: unknown algorithm for checksum '%s'", name,
+			lineNum, file.checksum)
+	}
+	_, err := hex.DecodeString(file.checksum)
+	if err != nil || len(file.checksum) != newHash().Size()*2 {
+		return fmt.Errorf("%s:%d: invalid %s checksum '%s'", name, lineNum,
+			file.algo, file.checksum)
+	}
+	return nil
+}
+
+// Record the algorithm of the first imported file for a new db, which is
+// then used for the files added later. The verification-only algorithms
+// are not recorded, in which case the default one is used.
+func recordImportedHashAlgo(tx *sql.Tx, files []fileInfo) error {
+	_, ok, err := queryMeta(tx, "hash")
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	n, err := countFilesWithChecksum(tx)
+	if err != nil {
+		return err
+	}
+	if n != 0 {
+		return nil
+	}
+	for i := range files {
+		if isValidHashAlgo(files[i].algo) {
+			return setMeta(tx, "hash", files[i].algo)
+		}
+	}
+	return nil
+}
+
+// Insert the files in the manifests into cfg.db. Reject the paths
+// already in cfg.db or listed more than once. Return the number of files
+// imported.
+func importManifests(cfg *config, manifests []string,
+	format string) (int64, error) {
+	var files []fileInfo
+	seen := make(map[string]string)
+	for _, manifest := range manifests {
+		f, err := os.Open(manifest)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to open '%s': %w", manifest, err)
+		}
+		parsed, err := parseManifest(f, manifest, format, cfg.hashAlgo,
+			cfg.logger)
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+		for _, file := range parsed {
+			if prev, ok := seen[file.relPath]; ok {
+				return 0, fmt.Errorf("Duplicate path '%s' in '%s' and '%s'",
+					file.relPath, prev, manifest)
+			}
+			seen[file.relPath] = manifest
+		}
+		files = append(files, parsed...)
+	}
+
+	tx, err := createTx(cfg.db)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if err = recordImportedHashAlgo(tx, files); err != nil {
+		return 0, err
+	}
+	stmt, err := prepareInsertFile(tx)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	for i := range files {
+		infoInDb, _, err := queryFile(tx, files[i].relPath)
+		if err != nil {
+			return 0, err
+		}
+		if infoInDb != nil {
+			return 0, fmt.Errorf("Duplicate path '%s' in '%s' and the db",
+				files[i].relPath, seen[files[i].relPath])
+		}
+		if err = insertFile(stmt, &files[i]); err != nil {
+			return 0, err
+		}
+	}
+	numCleared, err := clearVisitedFlags(tx, "")
+	if err != nil {
+		return 0, err
+	}
+	if numCleared != int64(len(files)) {
+		return 0, fmt.Errorf("numVisitedFlagsCleared=%d, expected %d",
+			numCleared, len(files))
+	}
+	if cfg.history {
+		runId, err := recordRun(tx, time.Now())
+		if err != nil {
+			return 0, err
+		}
+		cfg.logger.info("Recorded run %d", runId)
+	}
+	if err = commitTx(tx); err != nil {
+		return 0, err
+	}
+	return int64(len(files)), nil
+}
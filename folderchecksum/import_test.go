@@ -0,0 +1,233 @@
+package folderchecksum
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testMd5 = "60b725f10c9c85c70d97880dfe8191b3"
+const testSha256 = "87428fc522803d31065e7bce3cf03fe475096631e5e07bbd7a0fde60c4cf25c7"
+
+func TestParseManifest(t *testing.T) {
+	unknown := fileStat{mode: -1, uid: -1, gid: -1}
+	testCases := []struct {
+		name     string
+		format   string
+		algo     string
+		manifest string
+		expect   []fileInfo
+	}{
+		{
+			name:   "gnu",
+			format: "auto",
+			manifest: testMd5 + "  ./dir1/file1\n" +
+				strings.ToUpper(testMd5) + " *file2\r\n" +
+				"\n" +
+				`\` + testMd5 + `  new\nline\\` + "\n",
+			expect: []fileInfo{
+				{relPath: "dir1/file1", size: -1, checksum: testMd5,
+					algo: "md5", stat: unknown},
+				{relPath: "file2", size: -1, checksum: testMd5,
+					algo: "md5", stat: unknown},
+				{relPath: "new\nline\\", size: -1, checksum: testMd5,
+					algo: "md5", stat: unknown},
+			},
+		},
+		{
+			name:     "gnu with algo",
+			format:   "gnu",
+			algo:     "blake2b",
+			manifest: strings.Repeat("ab", 64) + "  file1\n",
+			expect: []fileInfo{
+				{relPath: "file1", size: -1,
+					checksum: strings.Repeat("ab", 64), algo: "blake2b",
+					stat: unknown},
+			},
+		},
+		{
+			name:   "bsd",
+			format: "auto",
+			manifest: "SHA256 (file (1)) = " + testSha256 + "\n" +
+				"MD5 (file2) = " + testMd5 + "\n",
+			expect: []fileInfo{
+				{relPath: "file (1)", size: -1, checksum: testSha256,
+					algo: "sha256", stat: unknown},
+				{relPath: "file2", size: -1, checksum: testMd5,
+					algo: "md5", stat: unknown},
+			},
+		},
+		{
+			name:   "hashdeep",
+			format: "auto",
+			manifest: "%%%% HASHDEEP-1.0\n" +
+				"%%%% size,md5,sha256,filename\n" +
+				"## Invoked from: /data\n" +
+				"## $ hashdeep -l -r .\n" +
+				"##\n" +
+				"2," + testMd5 + "," + testSha256 + ",./dir1/a,b\n",
+			expect: []fileInfo{
+				{relPath: "dir1/a,b", size: 2, checksum: testMd5,
+					algo: "md5", stat: unknown},
+			},
+		},
+		{
+			name:   "hashdeep with algo",
+			format: "hashdeep",
+			algo:   "sha256",
+			manifest: "%%%% HASHDEEP-1.0\n" +
+				"%%%% size,md5,sha256,filename\n" +
+				"2," + testMd5 + "," + testSha256 + ",file1\n",
+			expect: []fileInfo{
+				{relPath: "file1", size: 2, checksum: testSha256,
+					algo: "sha256", stat: unknown},
+			},
+		},
+		{
+			name:     "sfv",
+			format:   "auto",
+			manifest: "; comment\nfile 1 DDEAA107\n",
+			expect: []fileInfo{
+				{relPath: "file 1", size: -1, checksum: "ddeaa107",
+					algo: "crc32", stat: unknown},
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			actual, err := parseManifest(strings.NewReader(testCase.manifest),
+				"test", testCase.format, testCase.algo, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifyFileInfo(t, actual, testCase.expect)
+		})
+	}
+}
+
+func TestImportManifests(t *testing.T) {
+	tempDir := t.TempDir()
+	manifest1 := filepath.Join(tempDir, "1.md5")
+	manifest2 := filepath.Join(tempDir, "2.sfv")
+	err := os.WriteFile(manifest1,
+		[]byte(testMd5+"  file1\n"+testMd5+"  dir1/file2\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(manifest2, []byte("file3 DDEAA107\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := prepareTestDb(t)
+	defer db.Close()
+	cfg := config{db: db}
+	n, err := importManifests(&cfg, []string{manifest1, manifest2}, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("Incorrect number of files: %d", n)
+	}
+	if algo, _, err := queryMeta(db, "hash"); err != nil || algo != "md5" {
+		t.Fatalf("Incorrect algo: %s, %v", algo, err)
+	}
+
+	unknown := fileStat{mode: -1, uid: -1, gid: -1}
+	verifyFileRows(t, getAllRowsFromFiles(t, db), []fileRow{
+		{path: "dir1/file2", size: -1, checksum: testMd5, algo: "md5",
+			stat: unknown},
+		{path: "file1", size: -1, checksum: testMd5, algo: "md5",
+			stat: unknown},
+		{path: "file3", size: -1, checksum: "ddeaa107", algo: "crc32",
+			stat: unknown},
+	})
+}
+
+func TestImportManifestsNoAlgo(t *testing.T) {
+	tempDir := t.TempDir()
+	manifest1 := filepath.Join(tempDir, "1.md5")
+	manifest2 := filepath.Join(tempDir, "2.sfv")
+	err := os.WriteFile(manifest1, []byte(testMd5+"  dir1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(manifest2, []byte("file1 DDEAA107\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := prepareTestDb(t)
+	defer db.Close()
+	cfg := config{db: db}
+
+	// Nothing is recorded if the import fails.
+	clearAndInsertRowsToFiles(t, db, []fileRow{
+		{path: "dir1", fileType: typeDir, stat: fileStat{mode: -1, uid: -1,
+			gid: -1}},
+	})
+	_, err = importManifests(&cfg, []string{manifest1}, "auto")
+	if err == nil {
+		t.Fatal("Expected an error for the duplicate path")
+	}
+	if _, ok, err := queryMeta(db, "hash"); err != nil || ok {
+		t.Fatalf("Unexpected meta hash: %v, %v", ok, err)
+	}
+
+	// crc32 is not recorded as the algorithm of a new db.
+	_, err = importManifests(&cfg, []string{manifest2}, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := queryMeta(db, "hash"); err != nil || ok {
+		t.Fatalf("Unexpected meta hash: %v, %v", ok, err)
+	}
+	algo, err := resolveHashAlgo(newSqliteStore(db), "", false, nil)
+	if err != nil || algo != DefaultHashAlgo {
+		t.Fatalf("Incorrect algo: %s, %v", algo, err)
+	}
+}
+
+func TestImportSfvThenScan(t *testing.T) {
+	rootDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(rootDir, "file1"), []byte("file1"),
+		0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := filepath.Join(t.TempDir(), "test.sfv")
+	err = os.WriteFile(manifest, []byte("file1 9EE760E5\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFile := filepath.Join(rootDir, ".checksum.db")
+	if _, err = Import(dbFile, []string{manifest}, "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The crc32 rows don't pin the algorithm of the db.
+	scanner, err := NewScanner(Options{
+		Update:   true,
+		HashAlgo: "sha256",
+		RootDir:  rootDir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := scanner.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stats != (Stats{Unchanged: 1}) {
+		t.Fatalf("Incorrect stats: %+v", result.Stats)
+	}
+	db, err := openDb(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if algo, _, err := queryMeta(db, "hash"); err != nil || algo != "sha256" {
+		t.Fatalf("Incorrect algo: %s, %v", algo, err)
+	}
+}
@@ -0,0 +1,44 @@
+package folderchecksum
+
+import (
+	"io"
+	"log"
+)
+
+const (
+	ERROR   = 0
+	WARNING = 1
+	INFO    = 2
+	DEBUG   = 3
+)
+
+// A Logger writes the logs greater than or equal to its level. It's safe
+// for concurrent use, and a nil *Logger discards all the logs.
+type Logger struct {
+	level  int
+	logger *log.Logger
+}
+
+// Return a Logger writing the logs greater than or equal to level (ERROR,
+// WARNING, INFO or DEBUG) to w, each prefixed by the time.
+func NewLogger(w io.Writer, level int) *Logger {
+	return &Logger{level: level, logger: log.New(w, "", log.Ltime)}
+}
+
+func (l *Logger) warning(fmt string, args ...any) {
+	if l != nil && l.level >= WARNING {
+		l.logger.Printf("[WARN]  "+fmt, args...)
+	}
+}
+
+func (l *Logger) info(fmt string, args ...any) {
+	if l != nil && l.level >= INFO {
+		l.logger.Printf("[INFO]  "+fmt, args...)
+	}
+}
+
+func (l *Logger) debug(fmt string, args ...any) {
+	if l != nil && l.level >= DEBUG {
+		l.logger.Printf("[DEBUG] "+fmt, args...)
+	}
+}
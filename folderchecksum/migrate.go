@@ -0,0 +1,191 @@
+package folderchecksum
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type migrateResult struct {
+	oldFile fileInfo
+	newFile fileInfo
+	skipped bool
+	err     error
+}
+
+// Verify the file against the checksum in db, and compute the new
+// checksum by cfg.hashAlgo in the same pass. The file is skipped if it no
+// longer matches db, so that a migration never hides a change.
+func migrateWorker(id int, cfg *config, wg *sync.WaitGroup,
+	cIn <-chan fileInfo, cOut chan<- migrateResult) {
+	cfg.logger.debug("Started migrateWorker %d", id)
+
+	for file := range cIn {
+		res := migrateResult{
+			oldFile: file,
+			newFile: file,
+			skipped: true,
+		}
+		path := filepath.Join(cfg.rootDir, file.relPath)
+
+		info, err := os.Stat(path)
+		switch {
+		case shouldExcludePath(cfg, file.relPath):
+			cfg.logger.info("(worker %d) skipped: %s", id, file.relPath)
+		case err != nil:
+			cfg.logger.warning("Skipped migrating '%s': %s", file.relPath,
+				err.Error())
+		case !info.Mode().IsRegular():
+			cfg.logger.warning("Skipped migrating '%s': not a regular file",
+				file.relPath)
+		case info.Size() != file.size:
+			cfg.logger.warning("Skipped migrating '%s': size changed",
+				file.relPath)
+		default:
+			checksums, n, err := calcChecksums(path,
+				[]string{file.algo, cfg.hashAlgo}, cfg.retries, cfg.logger)
+			if errors.Is(err, errUnstable) {
+				cfg.logger.warning("Skipped migrating '%s': %s", file.relPath,
+					err.Error())
+				break
+			}
+			if err != nil {
+				res.err = &FileError{Path: file.relPath, Err: err}
+				break
+			}
+			if n != file.size {
+				cfg.logger.warning("Skipped migrating '%s': size changed",
+					file.relPath)
+				break
+			}
+			if checksums[0] != file.checksum {
+				cfg.logger.warning("Skipped migrating '%s': checksum changed",
+					file.relPath)
+				break
+			}
+			res.newFile.checksum = checksums[1]
+			res.newFile.algo = cfg.hashAlgo
+			res.skipped = false
+		}
+		cOut <- res
+	}
+
+	cfg.logger.debug("Stopped migrateWorker %d", id)
+	wg.Done()
+}
+
+// The result of Options.Migrate.
+type MigrateStats struct {
+	Migrated int64
+	// The files no longer matching the db.
+	Skipped int64
+	// The files still to be migrated.
+	Remaining int64
+}
+
+// Rehash at most cfg.migrate files in cfg.store whose checksums are
+// computed by an algorithm other than cfg.hashAlgo. Only the files matching
+// cfg.prefix are migrated. The skipped files don't count against
+// cfg.migrate, so that the files no longer matching the store can't stall
+// the migration. The store is updated in a single transaction. A file that
+// can't be read is skipped or aborts the migration according to
+// cfg.skipError. cfg.hashAlgo is recorded into the store in the same
+// transaction.
+func migrateFiles(cfg *config) (MigrateStats, error) {
+	prefixes := cfg.prefix
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+
+	var ret MigrateStats
+	tx, err := cfg.store.begin()
+	if err != nil {
+		return ret, err
+	}
+	defer tx.rollback()
+	// cfg.hashAlgo may differ from the one recorded in the store.
+	if err = tx.setMeta("hash", cfg.hashAlgo); err != nil {
+		return ret, err
+	}
+
+	for _, prefix := range prefixes {
+		// Page through the files by path, since the skipped files are
+		// still returned by the query.
+		after := ""
+		for ret.Migrated < cfg.migrate {
+			batch, err := tx.queryFilesToMigrate(prefix, after,
+				cfg.hashAlgo, cfg.migrate-ret.Migrated)
+			if err != nil {
+				return ret, err
+			}
+			if len(batch) == 0 {
+				break
+			}
+			migrateBatch(cfg, tx, batch, &ret)
+			if err = cfg.errors.get(); err != nil {
+				return ret, err
+			}
+			after = batch[len(batch)-1].relPath
+		}
+	}
+	if err = tx.commit(); err != nil {
+		return ret, err
+	}
+
+	ret.Remaining, err = cfg.store.countFilesToMigrate(cfg.hashAlgo)
+	if err != nil {
+		return ret, err
+	}
+	cfg.logger.info("migrate stats: numFilesMigrated=%d numFilesSkipped=%d "+
+		"numFilesRemaining=%d", ret.Migrated, ret.Skipped, ret.Remaining)
+	return ret, nil
+}
+
+// Migrate files by j migrateWorker, and add the results to stats. An error
+// aborting the migration is recorded in cfg.errors.
+func migrateBatch(cfg *config, tx storeTx, files []fileInfo,
+	stats *MigrateStats) {
+	chMigrate := make(chan fileInfo)
+	chResult := make(chan migrateResult, 128)
+	var wgMigrate sync.WaitGroup
+	wgMigrate.Add(cfg.j)
+	for i := 0; i < cfg.j; i++ {
+		go migrateWorker(i+1, cfg, &wgMigrate, chMigrate, chResult)
+	}
+	go func() {
+		for _, file := range files {
+			if cfg.errors.aborted.Load() {
+				break
+			}
+			chMigrate <- file
+		}
+		close(chMigrate)
+		wgMigrate.Wait()
+		close(chResult)
+	}()
+
+	for res := range chResult {
+		if cfg.errors.aborted.Load() {
+			// Drain the channel.
+			continue
+		}
+		if res.err != nil {
+			if fileErr := skipFileError(cfg, res.err); fileErr != nil {
+				cfg.logger.warning("%s, skipped", fileErr.Error())
+			}
+			continue
+		}
+		if res.skipped {
+			stats.Skipped++
+			continue
+		}
+		cfg.logger.debug("migrating: %+v", res)
+		err := tx.migrateFile(&res.oldFile, &res.newFile)
+		if err != nil {
+			cfg.errors.abort(err)
+			continue
+		}
+		stats.Migrated++
+	}
+}
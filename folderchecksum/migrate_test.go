@@ -0,0 +1,193 @@
+package folderchecksum
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestMigrateFiles(t *testing.T) {
+	// - rootDir
+	// | file1
+	// | file2
+	// | - dir1
+	// | | file1
+	rootDir := filepath.Join(t.TempDir(), "rootDir")
+	err := os.Mkdir(rootDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "file1"), []byte("file1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "file2"), []byte("file2"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir1 := filepath.Join(rootDir, "dir1")
+	err = os.Mkdir(dir1, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir1, "file1"), []byte("dir1/file1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	cfg := config{
+		j:         2,
+		db:        db,
+		store:     newSqliteStore(db),
+		excludeRe: regexp.MustCompile(`^$`),
+		includeRe: regexp.MustCompile(`^$`),
+		hashAlgo:  "sha256",
+		migrate:   2,
+		rootDir:   rootDir,
+		errors:    &scanErrors{},
+	}
+
+	rows := []fileRow{
+		{
+			path:     "dir1/file1",
+			size:     10,
+			checksum: "a09ebcef8ab11daef0e33e4394ea775f",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "file1",
+			size:     5,
+			checksum: "826e8142e6baabe8af779f5f490cf5f5",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			// Content changed.
+			path:     "file2",
+			size:     5,
+			checksum: "aaa",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "file3",
+			size:     5,
+			checksum: nil,
+			algo:     nil,
+			visited:  false,
+		},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+
+	// Migrate 2 files in the first batch.
+	if _, err := migrateFiles(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	expectRows := copyAndSortFileRows(rows)
+	expectRows[0].checksum = "8ed97fbb08a960c73c60c821ea23cdda" +
+		"4cf60f24bca1d833e5b87b2b39055342"
+	expectRows[0].algo = "sha256"
+	expectRows[1].checksum = "c147efcfc2d7ea666a9e4f5187b115c9" +
+		"0903f0fc896a56df9a6ef5d8f3fc9f31"
+	expectRows[1].algo = "sha256"
+	verifyFileRows(t, getAllRowsFromFiles(t, db), expectRows)
+
+	// The changed file is skipped.
+	migrateStats, err := migrateFiles(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrateStats != (MigrateStats{Skipped: 1, Remaining: 1}) {
+		t.Fatalf("Incorrect stats: %+v", migrateStats)
+	}
+	verifyFileRows(t, getAllRowsFromFiles(t, db), expectRows)
+
+	// Only migrate the files under the prefix.
+	clearAndInsertRowsToFiles(t, db, rows)
+	cfg.prefix = []string{"dir1"}
+	if _, err := migrateFiles(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	expectRows = copyAndSortFileRows(rows)
+	expectRows[0].checksum = "8ed97fbb08a960c73c60c821ea23cdda" +
+		"4cf60f24bca1d833e5b87b2b39055342"
+	expectRows[0].algo = "sha256"
+	verifyFileRows(t, getAllRowsFromFiles(t, db), expectRows)
+}
+
+func TestMigrateFilesSkipped(t *testing.T) {
+	rootDir := t.TempDir()
+	for _, name := range []string{"file2", "file3"} {
+		err := os.WriteFile(filepath.Join(rootDir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	cfg := config{
+		j:         2,
+		db:        db,
+		store:     newSqliteStore(db),
+		excludeRe: regexp.MustCompile(`^$`),
+		includeRe: regexp.MustCompile(`^$`),
+		hashAlgo:  "sha256",
+		migrate:   1,
+		rootDir:   rootDir,
+		errors:    &scanErrors{},
+	}
+
+	rows := []fileRow{
+		{
+			// Deleted.
+			path:     "file1",
+			size:     5,
+			checksum: "826e8142e6baabe8af779f5f490cf5f5",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "file2",
+			size:     5,
+			checksum: "1c1c96fd2cf8330db0bfa936ce82f3b9",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "file3",
+			size:     5,
+			checksum: "2548729e9c3c60cc3789dfb2408e475d",
+			algo:     "md5",
+			visited:  false,
+		},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+
+	// The deleted file doesn't count against the limit, so each run makes
+	// progress.
+	for i, remaining := range []int64{2, 1} {
+		migrateStats, err := migrateFiles(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := MigrateStats{Migrated: 1, Skipped: 1, Remaining: remaining}
+		if migrateStats != expect {
+			t.Fatalf("Incorrect stats of run %d: %+v", i, migrateStats)
+		}
+	}
+	expectRows := copyAndSortFileRows(rows)
+	expectRows[1].checksum = "3377870dfeaaa7adf79a374d2702a3fd" +
+		"b13e5e5ea0dd8aa95a802ad39044a92f"
+	expectRows[1].algo = "sha256"
+	expectRows[2].checksum = "6f3fef6dc51c7996a74992b70d0c35f3" +
+		"28ed909a5e07646cf0bab3383c95bb02"
+	expectRows[2].algo = "sha256"
+	verifyFileRows(t, getAllRowsFromFiles(t, db), expectRows)
+}
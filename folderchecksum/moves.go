@@ -0,0 +1,119 @@
+package folderchecksum
+
+import (
+	"sort"
+)
+
+// The key to match a deleted file with a new file.
+type moveKey struct {
+	size     int64
+	algo     string
+	checksum string
+}
+
+// New files held back by dbUpdateWorker in -moves or -copies mode, until
+// the deleted files are known. A nil *pendingNewFiles holds nothing.
+type pendingNewFiles struct {
+	files map[moveKey][]fileInfo
+	// The paths of the records deleted or moved away in this run, which
+	// are not copy sources.
+	removed map[string]bool
+	// The paths of the moved rows (and the pending new files inserted by
+	// finish) whose visited flags need to be cleared at the end.
+	toClear []string
+}
+
+func newPendingNewFiles() *pendingNewFiles {
+	return &pendingNewFiles{
+		files:   make(map[moveKey][]fileInfo),
+		removed: make(map[string]bool),
+	}
+}
+
+// Record that the record of relPath is deleted or moved away.
+func (p *pendingNewFiles) remove(relPath string) {
+	if p != nil {
+		p.removed[relPath] = true
+	}
+}
+
+func (p *pendingNewFiles) add(file *fileInfo) {
+	key := moveKey{file.size, file.algo, file.checksum}
+	p.files[key] = append(p.files[key], *file)
+}
+
+// Take out the new file that oldFile is moved to, or return nil if there
+// isn't one. When there are multiple candidates, the one with the
+// smallest path is taken, so that the result doesn't depend on the order
+// the files are checked.
+func (p *pendingNewFiles) take(oldFile *fileInfo) *fileInfo {
+	if p == nil || oldFile.fileType != typeFile || oldFile.checksum == "" {
+		return nil
+	}
+	key := moveKey{oldFile.size, oldFile.algo, oldFile.checksum}
+	files := p.files[key]
+	if len(files) == 0 {
+		return nil
+	}
+	minIdx := 0
+	for i := range files {
+		if files[i].relPath < files[minIdx].relPath {
+			minIdx = i
+		}
+	}
+	ret := files[minIdx]
+	files[minIdx] = files[len(files)-1]
+	p.files[key] = files[:len(files)-1]
+	return &ret
+}
+
+// Rewrite the records of the moved files in the store. They are marked visited so
+// that the deletion pass of another prefix doesn't delete them.
+func (p *pendingNewFiles) applyMoves(tx storeTx, moves [][2]fileInfo) error {
+	for i := range moves {
+		if err := tx.moveFile(moves[i][0].relPath, &moves[i][1]); err != nil {
+			return err
+		}
+		p.toClear = append(p.toClear, moves[i][1].relPath)
+	}
+	return nil
+}
+
+// Output the remaining new files (which are not moved) as new or copied,
+// insert them into the store when cfg.update is true, and clear the
+// visited flags left by applyMoves.
+func (p *pendingNewFiles) finish(cfg *config, tx storeTx) error {
+	var remaining []fileInfo
+	for _, files := range p.files {
+		remaining = append(remaining, files...)
+	}
+	sort.Slice(remaining, func(i int, j int) bool {
+		return remaining[i].relPath < remaining[j].relPath
+	})
+	removed := func(relPath string) bool { return p.removed[relPath] }
+	for i := range remaining {
+		err := outputNewOrCopiedFile(cfg, &remaining[i], removed)
+		if err != nil {
+			return err
+		}
+		if cfg.update {
+			if err := tx.insertFile(&remaining[i]); err != nil {
+				return err
+			}
+			p.toClear = append(p.toClear, remaining[i].relPath)
+		}
+	}
+	p.files = make(map[moveKey][]fileInfo)
+
+	// The moved rows under a prefix handled after the move have been
+	// cleared already.
+	for _, relPath := range p.toClear {
+		n, err := tx.clearVisitedFlagIfSet(relPath)
+		if err != nil {
+			return err
+		}
+		cfg.stats.numVisitedFlagsCleared.Add(n)
+	}
+	p.toClear = nil
+	return nil
+}
@@ -0,0 +1,376 @@
+package folderchecksum
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The mtree digest keywords of the supported hash algorithms, in the order
+// of preference when reading a spec.
+var mtreeDigestKeywords = []struct {
+	algo     string
+	keywords []string
+}{
+	{"sha512", []string{"sha512digest", "sha512"}},
+	{"sha256", []string{"sha256digest", "sha256"}},
+	{"md5", []string{"md5digest", "md5"}},
+}
+
+var mtreeTypes = map[entryType]string{
+	typeFile: "file",
+	typeLink: "link",
+	typeDir:  "dir",
+}
+
+// Encode str in the vis(3) style used by mtree: the characters that are
+// not printable, white spaces, and the ones special in mtree or glob
+// patterns are written as "\ooo".
+func escapeMtreePath(str string) string {
+	var sb strings.Builder
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`\#*?[=`, c) >= 0 {
+			fmt.Fprintf(&sb, "\\%03o", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// Decode str encoded by escapeMtreePath (or mtree).
+func unescapeMtreePath(str string) (string, bool) {
+	var sb strings.Builder
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if c != '\\' {
+			sb.WriteByte(c)
+			continue
+		}
+		if i+1 < len(str) && str[i+1] == '\\' {
+			sb.WriteByte('\\')
+			i++
+			continue
+		}
+		if i+4 > len(str) {
+			return "", false
+		}
+		n, err := strconv.ParseUint(str[i+1:i+4], 8, 8)
+		if err != nil {
+			return "", false
+		}
+		sb.WriteByte(byte(n))
+		i += 3
+	}
+	return sb.String(), true
+}
+
+// Format the spec line of file in the full path form, e.g.,
+// "./dir1/file1 type=file mode=0644 size=5 md5digest=<checksum>".
+func formatMtreeLine(file *fileInfo) string {
+	var sb strings.Builder
+	sb.WriteString("./" + escapeMtreePath(file.relPath))
+	sb.WriteString(" type=" + mtreeTypes[file.fileType])
+	if file.stat.mode >= 0 {
+		fmt.Fprintf(&sb, " mode=%04o", file.stat.mode)
+	}
+	switch file.fileType {
+	case typeFile:
+		if file.size != unknownSize {
+			fmt.Fprintf(&sb, " size=%d", file.size)
+		}
+		for _, digest := range mtreeDigestKeywords {
+			if digest.algo == file.algo {
+				sb.WriteString(" " + digest.keywords[0] + "=" + file.checksum)
+			}
+		}
+	case typeLink:
+		sb.WriteString(" link=" + escapeMtreePath(file.target))
+	}
+	return sb.String()
+}
+
+// Write the entries in cfg.db (under cfg.prefix, and not excluded) to w as
+// an mtree spec. The checksums computed by algorithms without an mtree
+// keyword are omitted. Return the number of entries written.
+func exportMtree(cfg *config, w io.Writer) (int64, error) {
+	prefixes := cfg.prefix
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+
+	out := bufio.NewWriter(w)
+	out.WriteString("#mtree\n")
+	var numExported, numNoDigest int64
+	for _, prefix := range prefixes {
+		err := queryFilesUnder(cfg.db, prefix, func(file *fileInfo) error {
+			if shouldExcludePath(cfg, file.relPath) {
+				return nil
+			}
+			line := formatMtreeLine(file)
+			if file.fileType == typeFile &&
+				!strings.Contains(line, "digest=") {
+				numNoDigest++
+			}
+			out.WriteString(line)
+			out.WriteByte('\n')
+			numExported++
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return 0, fmt.Errorf("Failed to write: %w", err)
+	}
+
+	if numNoDigest != 0 {
+		cfg.logger.warning("%d files written without digests, only md5, "+
+			"sha256 and sha512 are supported by mtree", numNoDigest)
+	}
+	return numExported, nil
+}
+
+// Parse an mtree spec, in either the full path form or the classic
+// hierarchical form (with "/set" and ".."). The entries of the types other
+// than file, link and dir are skipped. name is used in the error
+// messages.
+func parseMtree(r io.Reader, name string, logger *Logger) ([]fileInfo,
+	error) {
+	var files []fileInfo
+	var dirs []string // the current dir in the hierarchical form
+	defaults := make(map[string]string)
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		// A trailing '\' continues the line.
+		for strings.HasSuffix(line, "\\") && scanner.Scan() {
+			lineNum++
+			line = line[:len(line)-1] + scanner.Text()
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch fields[0] {
+		case "/set":
+			for _, kv := range fields[1:] {
+				k, v, _ := strings.Cut(kv, "=")
+				defaults[k] = v
+			}
+			continue
+		case "/unset":
+			for _, k := range fields[1:] {
+				if k == "all" {
+					defaults = make(map[string]string)
+				}
+				delete(defaults, k)
+			}
+			continue
+		case "..":
+			if len(dirs) == 0 {
+				return nil, fmt.Errorf("%s:%d: '..' out of the root", name,
+					lineNum)
+			}
+			dirs = dirs[:len(dirs)-1]
+			continue
+		}
+
+		entryPath, ok := unescapeMtreePath(fields[0])
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: invalid path '%s'", name,
+				lineNum, fields[0])
+		}
+		keywords := make(map[string]string)
+		for k, v := range defaults {
+			keywords[k] = v
+		}
+		for _, kv := range fields[1:] {
+			k, v, _ := strings.Cut(kv, "=")
+			keywords[k] = v
+		}
+
+		// A name without '/' is relative to the current dir, which it
+		// enters if it's a dir (including the root "."). Otherwise it's
+		// relative to the root.
+		fullPath := strings.Contains(entryPath, "/")
+		relPath := entryPath
+		if !fullPath {
+			relPath = strings.Join(append(dirs, entryPath), "/")
+			if keywords["type"] == "dir" {
+				dirs = append(dirs, entryPath)
+			}
+		}
+		relPath = cleanPrefix(relPath)
+		if relPath == "" {
+			// The root itself.
+			continue
+		}
+
+		file, err := mtreeEntryToFileInfo(keywords, name, lineNum)
+		if err != nil {
+			return nil, err
+		}
+		if file == nil {
+			logger.debug("%s:%d: skipped type '%s'", name, lineNum,
+				keywords["type"])
+			continue
+		}
+		file.relPath = relPath
+		if seen[relPath] {
+			return nil, fmt.Errorf("%s:%d: duplicate path '%s'", name,
+				lineNum, relPath)
+		}
+		seen[relPath] = true
+		files = append(files, *file)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read '%s': %w", name, err)
+	}
+	return files, nil
+}
+
+// Return nil for the types other than file, link and dir.
+func mtreeEntryToFileInfo(keywords map[string]string, name string,
+	lineNum int) (*fileInfo, error) {
+	file := fileInfo{
+		size: unknownSize,
+		stat: fileStat{mode: -1, uid: -1, gid: -1},
+	}
+	parse := func(k string, base int) (int64, bool, error) {
+		v, ok := keywords[k]
+		if !ok {
+			return 0, false, nil
+		}
+		n, err := strconv.ParseInt(v, base, 64)
+		if err != nil || n < 0 {
+			return 0, false, fmt.Errorf("%s:%d: invalid %s '%s'", name,
+				lineNum, k, v)
+		}
+		return n, true, nil
+	}
+
+	switch keywords["type"] {
+	case "file", "":
+		file.fileType = typeFile
+		if n, ok, err := parse("size", 10); err != nil {
+			return nil, err
+		} else if ok {
+			file.size = n
+		}
+		for _, digest := range mtreeDigestKeywords {
+			for _, k := range digest.keywords {
+				if v, ok := keywords[k]; ok && file.checksum == "" {
+					file.checksum = strings.ToLower(v)
+					file.algo = digest.algo
+				}
+			}
+		}
+		if file.checksum != "" {
+			if err := checkChecksum(&file, name, lineNum); err != nil {
+				return nil, err
+			}
+		}
+	case "link":
+		file.fileType = typeLink
+		target, ok := unescapeMtreePath(keywords["link"])
+		if !ok || target == "" {
+			return nil, fmt.Errorf("%s:%d: invalid link '%s'", name, lineNum,
+				keywords["link"])
+		}
+		file.target = target
+		// The size of a symlink is the length of its target.
+		file.size = int64(len(target))
+	case "dir":
+		file.fileType = typeDir
+		file.size = 0
+	default:
+		return nil, nil
+	}
+
+	if n, ok, err := parse("mode", 8); err != nil {
+		return nil, err
+	} else if ok {
+		file.stat.mode = n & 07777
+	}
+	if n, ok, err := parse("uid", 10); err != nil {
+		return nil, err
+	} else if ok {
+		file.stat.uid = n
+	}
+	if n, ok, err := parse("gid", 10); err != nil {
+		return nil, err
+	} else if ok {
+		file.stat.gid = n
+	}
+	if v, ok := keywords["time"]; ok {
+		// "<seconds>.<nanoseconds>"
+		sec, nsec, _ := strings.Cut(v, ".")
+		if len(nsec) > 9 {
+			return nil, fmt.Errorf("%s:%d: invalid time '%s'", name,
+				lineNum, v)
+		}
+		s, err1 := strconv.ParseInt(sec, 10, 64)
+		ns, err2 := strconv.ParseUint(
+			nsec+strings.Repeat("0", 9-len(nsec)), 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("%s:%d: invalid time '%s'", name,
+				lineNum, v)
+		}
+		file.stat.mtime = s*1e9 + int64(ns)
+	}
+	return &file, nil
+}
+
+// Load the mtree spec into a new temporary db, which is used in place of
+// <dbfile>. The folders and symlinks are only loaded when they are
+// tracked. The user should call Close() on the returned db, then remove
+// the returned temp folder.
+func openMtreeDb(cfg *config) (*sql.DB, string, error) {
+	f, err := os.Open(cfg.mtree)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to open '%s': %w", cfg.mtree, err)
+	}
+	files, err := parseMtree(f, cfg.mtree, cfg.logger)
+	f.Close()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return openTempDb("mtree.db", func(db *sql.DB) error {
+		var tracked []fileInfo
+		for _, file := range files {
+			if (file.fileType == typeLink && !cfg.trackLinks) ||
+				(file.fileType == typeDir && !cfg.trackDirs) {
+				continue
+			}
+			tracked = append(tracked, file)
+		}
+		if err := insertUnvisitedFiles(db, tracked); err != nil {
+			return err
+		}
+
+		// New files are hashed by the algorithm of the spec by default.
+		for i := range files {
+			if files[i].algo != "" {
+				if err := setMeta(db, "hash", files[i].algo); err != nil {
+					return err
+				}
+				break
+			}
+		}
+		cfg.logger.info("Loaded %d entries from '%s'", len(tracked), cfg.mtree)
+		return nil
+	})
+}
@@ -0,0 +1,137 @@
+package folderchecksum
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestMtreePathEscaping(t *testing.T) {
+	testCases := []struct {
+		path    string
+		escaped string
+	}{
+		{"dir1/file1", "dir1/file1"},
+		{"a b\\c#\n", `a\040b\134c\043\012`},
+		{"é", `\303\251`},
+	}
+	for _, testCase := range testCases {
+		escaped := escapeMtreePath(testCase.path)
+		if escaped != testCase.escaped {
+			t.Errorf("Incorrect escaped path: %s", escaped)
+		}
+		path, ok := unescapeMtreePath(escaped)
+		if !ok || path != testCase.path {
+			t.Errorf("Incorrect unescaped path: %q", path)
+		}
+	}
+	if path, ok := unescapeMtreePath(`a\\b`); !ok || path != `a\b` {
+		t.Errorf("Incorrect unescaped path: %q", path)
+	}
+	if _, ok := unescapeMtreePath(`a\04`); ok {
+		t.Errorf("Invalid path accepted")
+	}
+}
+
+func TestMtreeRoundTrip(t *testing.T) {
+	db := prepareTestDb(t)
+	defer db.Close()
+	rows := []fileRow{
+		{path: "dir 1", fileType: typeDir, stat: fileStat{mode: 0755}},
+		{path: "dir 1/file1", size: 5, checksum: testMd5, algo: "md5",
+			stat: fileStat{mode: 0644}},
+		{path: "file2", size: 5, checksum: testSha256, algo: "sha256",
+			stat: fileStat{mode: -1}},
+		{path: "file3", size: 5, checksum: "ddeaa107", algo: "crc32",
+			stat: fileStat{mode: 0600}},
+		{path: "link1", size: 4, fileType: typeLink, target: "dir1",
+			stat: fileStat{mode: 0777}},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+
+	var builder strings.Builder
+	cfg := config{
+		db:        db,
+		excludeRe: regexp.MustCompile(`^()$`),
+		includeRe: regexp.MustCompile(`^()$`),
+	}
+	n, err := exportMtree(&cfg, &builder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := strings.Join([]string{
+		"#mtree",
+		`./dir\0401 type=dir mode=0755`,
+		`./dir\0401/file1 type=file mode=0644 size=5 md5digest=` + testMd5,
+		"./file2 type=file size=5 sha256digest=" + testSha256,
+		"./file3 type=file mode=0600 size=5",
+		"./link1 type=link mode=0777 link=dir1",
+		"",
+	}, "\n")
+	if builder.String() != expect || n != 5 {
+		t.Errorf("actual: %s", builder.String())
+		t.Errorf("expect: %s", expect)
+		t.FailNow()
+	}
+
+	unknown := fileStat{mode: -1, uid: -1, gid: -1}
+	actual, err := parseMtree(strings.NewReader(builder.String()), "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyFileInfo(t, actual, []fileInfo{
+		{relPath: "dir 1", fileType: typeDir,
+			stat: fileStat{mode: 0755, uid: -1, gid: -1}},
+		{relPath: "dir 1/file1", size: 5, checksum: testMd5, algo: "md5",
+			stat: fileStat{mode: 0644, uid: -1, gid: -1}},
+		{relPath: "file2", size: 5, checksum: testSha256, algo: "sha256",
+			stat: unknown},
+		{relPath: "file3", size: 5,
+			stat: fileStat{mode: 0600, uid: -1, gid: -1}},
+		{relPath: "link1", size: 4, fileType: typeLink, target: "dir1",
+			stat: fileStat{mode: 0777, uid: -1, gid: -1}},
+	})
+}
+
+func TestParseMtreeHierarchical(t *testing.T) {
+	// In the style of "mtree -c".
+	spec := strings.Join([]string{
+		"#\t   user: root",
+		"",
+		"/set type=file uid=0 gid=0 mode=0644",
+		".               type=dir mode=0755 time=1680000000.5",
+		"    file1       size=5 \\",
+		"                md5digest=" + strings.ToUpper(testMd5),
+		"    fifo1       type=fifo",
+		"/set type=file uid=1000 gid=1000 mode=0600",
+		"dir1            type=dir mode=0755",
+		"    file2       size=3 time=1680000000.000000001",
+		"    dir2        type=dir mode=0700",
+		"        link1   type=link link=../file2",
+		"    ..",
+		"    dir3/file3  size=0",
+		"    ..",
+		"..",
+		"",
+	}, "\n")
+	actual, err := parseMtree(strings.NewReader(spec), "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyFileInfo(t, actual, []fileInfo{
+		{relPath: "file1", size: 5, checksum: testMd5, algo: "md5",
+			stat: fileStat{mode: 0644, uid: 0, gid: 0}},
+		{relPath: "dir1", fileType: typeDir,
+			stat: fileStat{mode: 0755, uid: 1000, gid: 1000}},
+		{relPath: "dir1/file2", size: 3,
+			stat: fileStat{mtime: 1680000000000000001, mode: 0600,
+				uid: 1000, gid: 1000}},
+		{relPath: "dir1/dir2", fileType: typeDir,
+			stat: fileStat{mode: 0700, uid: 1000, gid: 1000}},
+		{relPath: "dir1/dir2/link1", size: 8, fileType: typeLink,
+			target: "../file2",
+			stat:   fileStat{mode: 0600, uid: 1000, gid: 1000}},
+		{relPath: "dir3/file3", size: 0,
+			stat: fileStat{mode: 0600, uid: 1000, gid: 1000}},
+	})
+}
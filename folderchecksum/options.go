@@ -0,0 +1,293 @@
+package folderchecksum
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// The options of a Scanner. They mirror the options of the command line
+// tool, see its usage for the details.
+type Options struct {
+	// The number of workers reading the files. runtime.NumCPU() is used if
+	// it's 0.
+	Jobs int
+	// The database file. If it doesn't contain any path separator, it's
+	// located in RootDir and excluded from the scan. ".checksum.db" is
+	// used if it's empty. A file name ending with .txt is a text database
+	// file.
+	DbFile string
+	// The regex patterns of the files to exclude, and the ones to include
+	// even if they match Exclude. They are matched against the whole path
+	// relative to RootDir, with slash as the path separator.
+	Exclude []string
+	Include []string
+
+	FollowLinks bool
+	TrackLinks  bool
+	TrackDirs   bool
+	SizeOnly    bool
+	Quick       bool
+	// The attributes reported as "metachanged", see AttrNames.
+	Track []string
+	// The namespaces of the extended attributes to record, e.g.
+	// "security". Only supported on Linux.
+	Xattrs []string
+	Update bool
+	// The hash algorithm, see HashAlgoNames. The one recorded in DbFile
+	// is used if it's empty.
+	HashAlgo string
+	// Rehash at most this many files by HashAlgo instead of scanning.
+	Migrate  int64
+	History  bool
+	Snapshot int64
+	// Compare against this mtree spec instead of DbFile.
+	Mtree  string
+	Moves  bool
+	Copies bool
+	// The number of times a file modified while being read is read again
+	// before it's reported as "unstable".
+	Retries int
+
+	// Where the records are written in Format (see OutputFormats, "text"
+	// if it's empty), terminated with NUL if Nul is true. If Output is
+	// nil, the records are returned in Result.Records instead.
+	Output io.Writer
+	Format string
+	Nul    bool
+	// Sort the records by path.
+	Sort bool
+
+	// The folder to scan.
+	RootDir string
+	// Only scan these paths under RootDir (slash separated, not
+	// overlapping with each other).
+	Prefixes []string
+
+	// Decide whether an entry that can't be read aborts the run (if it
+	// returns false) or is skipped (if it returns true). A skipped entry
+	// is reported as an "error" record and returned in Result.Errors, and
+	// its database rows are left untouched. It's called by a single
+	// goroutine at a time. The run is aborted on any error if it's nil.
+	// The other errors (e.g., a database error) always abort the run.
+	SkipError func(err *FileError) bool
+
+	// Where the logs are written, see NewLogger. They are discarded if
+	// it's nil.
+	Logger *Logger
+}
+
+type config struct {
+	j           int
+	dbFile      string
+	db          *sql.DB        // thread safe
+	store       store          // thread safe, wraps db in Scanner.Run
+	excludeRe   *regexp.Regexp // thread safe
+	includeRe   *regexp.Regexp // thread safe
+	followLinks bool
+	trackLinks  bool
+	trackDirs   bool
+	sizeOnly    bool
+	quick       bool
+	track       trackedAttrs
+	xattrs      []string // the namespaces, sorted
+	update      bool
+	hashAlgo    string // empty until resolved against db
+	migrate     int64
+	format      string
+	nul         bool // terminate the records with NUL
+	sort        bool
+	moves       bool
+	copies      bool
+	history     bool // resolved against db
+	snapshot    int64
+	mtree       string
+	retries     int
+	textDb      bool // dbFile is loaded into db, see isTextDbFile
+	outFile     io.Writer
+	rootDir     string
+	prefix      []string
+	skipError   func(err *FileError) bool
+	stats       *scanStats   // thread safe
+	output      *outputState // thread safe
+	errors      *scanErrors  // thread safe
+	logger      *Logger      // thread safe
+}
+
+func getRegexFromList(patterns []string) (*regexp.Regexp, error) {
+	regStr := "^("
+	for _, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("Invalid regex pattern '%s': %s",
+				pattern, err.Error())
+		}
+		regStr += "(" + pattern + ")|"
+	}
+	if regStr[len(regStr)-1] == '|' {
+		regStr = regStr[:len(regStr)-1]
+	}
+	regStr += ")$"
+
+	return regexp.MustCompile(regStr), nil
+}
+
+// Return the path of dbFile. If it doesn't contain any path separator, it's
+// located in rootDir.
+func DbFilePath(rootDir string, dbFile string) (string, error) {
+	if strings.Contains(dbFile, string(os.PathSeparator)) {
+		return filepath.Clean(dbFile), nil
+	}
+	if dbFile != path.Clean(dbFile) {
+		return "", fmt.Errorf("Cleaned dbFile '%s' not equal to original '%s'",
+			path.Clean(dbFile), dbFile)
+	}
+	return filepath.Join(rootDir, dbFile), nil
+}
+
+func checkOutputOptions(format string, nul bool) error {
+	if !isValidOutputFormat(format) {
+		return fmt.Errorf("Unknown format '%s', expected one of: %s",
+			format, strings.Join(outputFormats, ", "))
+	}
+	if nul && format == "json" {
+		return fmt.Errorf("-0 can't be used with -format json")
+	}
+	return nil
+}
+
+func checkHashAlgo(algo string) error {
+	if algo != "" && !isValidHashAlgo(algo) {
+		return fmt.Errorf("Unknown hash algorithm '%s', expected one of: %s",
+			algo, strings.Join(HashAlgoNames(), ", "))
+	}
+	return nil
+}
+
+// Return the config for opts, without opening the db.
+func newConfig(opts *Options) (*config, error) {
+	var cfg config
+	var err error
+
+	cfg.j = opts.Jobs
+	if cfg.j == 0 {
+		cfg.j = runtime.NumCPU()
+	}
+	if cfg.j < 0 {
+		return nil, fmt.Errorf("j must >= 0 (0 means NumCPU)")
+	}
+
+	dbFile := opts.DbFile
+	if dbFile == "" {
+		dbFile = ".checksum.db"
+	}
+	if opts.RootDir == "" {
+		return nil, fmt.Errorf("Missing arg <rootDir>")
+	}
+	if cfg.dbFile, err = DbFilePath(opts.RootDir, dbFile); err != nil {
+		return nil, err
+	}
+
+	excludeList := opts.Exclude
+	if !strings.Contains(dbFile, string(os.PathSeparator)) {
+		excludeList = append(append([]string(nil), excludeList...),
+			regexp.QuoteMeta(dbFile),
+			regexp.QuoteMeta(dbFile+"-wal"),
+			regexp.QuoteMeta(dbFile+"-shm"),
+			regexp.QuoteMeta(dbFile+".tmp"))
+	}
+	if cfg.excludeRe, err = getRegexFromList(excludeList); err != nil {
+		return nil, err
+	}
+	if cfg.includeRe, err = getRegexFromList(opts.Include); err != nil {
+		return nil, err
+	}
+
+	cfg.followLinks = opts.FollowLinks
+	if opts.FollowLinks && opts.TrackLinks {
+		return nil, fmt.Errorf(
+			"-followlinks and -tracklinks can't be used together")
+	}
+	cfg.trackLinks = opts.TrackLinks
+	cfg.trackDirs = opts.TrackDirs
+	cfg.sizeOnly = opts.SizeOnly
+	cfg.quick = opts.Quick
+	if cfg.track, err = parseTrackedAttrs(opts.Track); err != nil {
+		return nil, err
+	}
+	if cfg.xattrs, err = parseXattrNamespaces(opts.Xattrs); err != nil {
+		return nil, err
+	}
+	cfg.update = opts.Update
+	if err = checkHashAlgo(opts.HashAlgo); err != nil {
+		return nil, err
+	}
+	cfg.hashAlgo = opts.HashAlgo
+	if opts.Migrate < 0 {
+		return nil, fmt.Errorf("migrate must >= 0")
+	}
+	if opts.Migrate > 0 && (opts.HashAlgo == "" || opts.SizeOnly) {
+		return nil, fmt.Errorf(
+			"-migrate requires -hash and can't be used with -sizeonly")
+	}
+	cfg.migrate = opts.Migrate
+	cfg.format = opts.Format
+	if cfg.format == "" {
+		cfg.format = "text"
+	}
+	if err = checkOutputOptions(cfg.format, opts.Nul); err != nil {
+		return nil, err
+	}
+	cfg.nul = opts.Nul
+	cfg.sort = opts.Sort
+	if opts.Moves && opts.SizeOnly {
+		return nil, fmt.Errorf("-moves can't be used with -sizeonly")
+	}
+	cfg.moves = opts.Moves
+	if opts.Copies && opts.SizeOnly {
+		return nil, fmt.Errorf("-copies can't be used with -sizeonly")
+	}
+	cfg.copies = opts.Copies
+	if opts.Retries < 0 {
+		return nil, fmt.Errorf("retries must >= 0")
+	}
+	cfg.retries = opts.Retries
+	cfg.history = opts.History
+	if opts.Snapshot < 0 {
+		return nil, fmt.Errorf("snapshot must >= 0")
+	}
+	if opts.Snapshot > 0 && (opts.Update || opts.Migrate > 0) {
+		return nil, fmt.Errorf(
+			"-snapshot can't be used with -update or -migrate")
+	}
+	cfg.snapshot = opts.Snapshot
+	if opts.Mtree != "" &&
+		(opts.Update || opts.Migrate > 0 || opts.Snapshot > 0) {
+		return nil, fmt.Errorf(
+			"-mtree can't be used with -update, -migrate or -snapshot")
+	}
+	cfg.mtree = opts.Mtree
+	cfg.textDb = isTextDbFile(cfg.dbFile)
+	if cfg.textDb && (opts.History || opts.Snapshot > 0) {
+		return nil, fmt.Errorf(
+			"-history and -snapshot can't be used with a text <dbfile>")
+	}
+	cfg.outFile = opts.Output
+	cfg.skipError = opts.SkipError
+	cfg.logger = opts.Logger
+	cfg.rootDir = filepath.Clean(opts.RootDir)
+
+	for _, prefix := range opts.Prefixes {
+		cfg.prefix = append(cfg.prefix, cleanPrefix(prefix))
+	}
+
+	cfg.logger.debug("opts: %+v", *opts)
+	cfg.logger.debug("cfg: %+v", cfg)
+
+	return &cfg, nil
+}
@@ -0,0 +1,344 @@
+package folderchecksum
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The output formats supported by Options.Format.
+var outputFormats = []string{"text", "json", "ndjson", "csv"}
+
+func isValidOutputFormat(format string) bool {
+	for _, f := range outputFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the output formats supported by Options.Format.
+func OutputFormats() []string {
+	return append([]string(nil), outputFormats...)
+}
+
+// A record reported by a scan, e.g., a new or changed file. The fields not
+// applicable to the status are omitted, e.g., old_size of a new file, or
+// new_checksum when the checksum is not computed. Error is the reason of an
+// "error" record.
+type Record struct {
+	Status      string   `json:"status"`
+	Path        string   `json:"path,omitempty"`
+	From        string   `json:"from,omitempty"`
+	OldSize     *int64   `json:"old_size,omitempty"`
+	NewSize     *int64   `json:"new_size,omitempty"`
+	OldChecksum string   `json:"old_checksum,omitempty"`
+	NewChecksum string   `json:"new_checksum,omitempty"`
+	Changes     []string `json:"changes,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	Stats       *Stats   `json:"stats,omitempty"`
+}
+
+// The number of files in each status, also written in the final "summary"
+// record. Errors is the number of entries skipped by Options.SkipError, and
+// Unstable is the number of files modified while being read.
+type Stats struct {
+	New         int64 `json:"new"`
+	Changed     int64 `json:"changed"`
+	Deleted     int64 `json:"deleted"`
+	Unchanged   int64 `json:"unchanged"`
+	MetaChanged int64 `json:"metachanged"`
+	Moved       int64 `json:"moved"`
+	Copied      int64 `json:"copied"`
+	Errors      int64 `json:"errors"`
+	Unstable    int64 `json:"unstable"`
+}
+
+// The header of csv format. The columns match csvFields.
+var csvHeader = []string{"status", "path", "old_size", "new_size",
+	"old_checksum", "new_checksum", "changes", "from", "error"}
+
+// Output functions are called by multiple workers. The mutex keeps the
+// records from interleaving. In sorted mode (or without an output file),
+// the records are kept in memory until outputEnd. The first error writing
+// the records is kept in err, and returned by outputEnd.
+type outputState struct {
+	mu         sync.Mutex
+	numRecords int64
+	records    []Record
+	err        error
+}
+
+func int64Ptr(n int64) *int64 {
+	return &n
+}
+
+func formatSize(size *int64) string {
+	if size == nil {
+		return ""
+	}
+	return strconv.FormatInt(*size, 10)
+}
+
+func csvFields(rec *Record) []string {
+	return []string{rec.Status, rec.Path, formatSize(rec.OldSize),
+		formatSize(rec.NewSize), rec.OldChecksum, rec.NewChecksum,
+		strings.Join(rec.Changes, ", "), rec.From, rec.Error}
+}
+
+// Return the record terminator.
+func outputTerminator(cfg *config) byte {
+	if cfg.nul {
+		return 0
+	}
+	return '\n'
+}
+
+// Format rec (without the terminator) according to cfg.format.
+func formatRecord(cfg *config, rec *Record) ([]byte, error) {
+	var buf bytes.Buffer
+	switch cfg.format {
+	case "json", "ndjson":
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		err := enc.Encode(rec)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal %+v: %w", rec, err)
+		}
+	case "csv":
+		w := csv.NewWriter(&buf)
+		w.Write(csvFields(rec))
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return nil, fmt.Errorf("Failed to write csv %+v: %w", rec, err)
+		}
+	default:
+		buf.WriteString(rec.Status + ": ")
+		if rec.From != "" {
+			buf.WriteString(rec.From + " -> ")
+		}
+		buf.WriteString(rec.Path)
+		if len(rec.Changes) != 0 {
+			buf.WriteString(" (" + strings.Join(rec.Changes, ", ") + ")")
+		}
+		if rec.Error != "" {
+			buf.WriteString(" (" + rec.Error + ")")
+		}
+		buf.WriteByte('\n')
+	}
+	// Strip the newline written above.
+	return buf.Bytes()[:buf.Len()-1], nil
+}
+
+func outputRecordOut(cfg *config, rec *Record) {
+	cfg.output.mu.Lock()
+	defer cfg.output.mu.Unlock()
+	if cfg.sort || cfg.outFile == nil {
+		cfg.output.records = append(cfg.output.records, *rec)
+		return
+	}
+	writeRecord(cfg, rec)
+}
+
+// Write data to cfg.outFile unless an earlier write failed. The caller
+// should hold cfg.output.mu.
+func writeOutput(cfg *config, data []byte) {
+	if cfg.output.err != nil {
+		return
+	}
+	if _, err := cfg.outFile.Write(data); err != nil {
+		cfg.output.err = fmt.Errorf("Failed to write the output: %w", err)
+	}
+}
+
+// The caller should hold cfg.output.mu.
+func writeRecord(cfg *config, rec *Record) {
+	line, err := formatRecord(cfg, rec)
+	if err != nil {
+		if cfg.output.err == nil {
+			cfg.output.err = err
+		}
+		return
+	}
+	if cfg.format == "json" {
+		if cfg.output.numRecords == 0 {
+			writeOutput(cfg, []byte("\n  "))
+		} else {
+			writeOutput(cfg, []byte(",\n  "))
+		}
+		writeOutput(cfg, line)
+	} else {
+		writeOutput(cfg, append(line, outputTerminator(cfg)))
+	}
+	cfg.output.numRecords++
+}
+
+// Return the stats counted by the output functions.
+func getStats(cfg *config) Stats {
+	return Stats{
+		New:         cfg.stats.numFilesNew.Load(),
+		Changed:     cfg.stats.numFilesChanged.Load(),
+		Deleted:     cfg.stats.numFilesDeleted.Load(),
+		Unchanged:   cfg.stats.numFilesUnchanged.Load(),
+		MetaChanged: cfg.stats.numFilesMetaChanged.Load(),
+		Moved:       cfg.stats.numFilesMoved.Load(),
+		Copied:      cfg.stats.numFilesCopied.Load(),
+		Errors:      cfg.stats.numFilesError.Load(),
+		Unstable:    cfg.stats.numFilesUnstable.Load(),
+	}
+}
+
+// Called before any other output functions.
+func outputBegin(cfg *config) {
+	cfg.output.numRecords = 0
+	cfg.output.records = nil
+	cfg.output.err = nil
+	if cfg.outFile == nil {
+		return
+	}
+	switch cfg.format {
+	case "json":
+		writeOutput(cfg, []byte("["))
+	case "csv":
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		w.Write(csvHeader)
+		w.Flush()
+		line := buf.Bytes()[:buf.Len()-1]
+		writeOutput(cfg, append(line, outputTerminator(cfg)))
+	}
+}
+
+// Called after all the files are processed. Output the buffered records
+// in sorted mode, then the summary record in json and ndjson format.
+// Without an output file, the records are left in cfg.output.records.
+// Return the first error writing the records.
+func outputEnd(cfg *config) error {
+	cfg.output.mu.Lock()
+	defer cfg.output.mu.Unlock()
+	if cfg.sort {
+		// Records of the same path are kept in the original order, e.g.,
+		// "metachanged" before "changed".
+		sort.SliceStable(cfg.output.records, func(i int, j int) bool {
+			return cfg.output.records[i].Path < cfg.output.records[j].Path
+		})
+	}
+	if cfg.outFile == nil {
+		return nil
+	}
+	for i := range cfg.output.records {
+		writeRecord(cfg, &cfg.output.records[i])
+	}
+	cfg.output.records = nil
+	if cfg.format != "json" && cfg.format != "ndjson" {
+		return cfg.output.err
+	}
+	stats := getStats(cfg)
+	writeRecord(cfg, &Record{
+		Status: "summary",
+		Stats:  &stats,
+	})
+	if cfg.format == "json" {
+		writeOutput(cfg, []byte("\n]\n"))
+	}
+	return cfg.output.err
+}
+
+func outputNewFile(cfg *config, info *fileInfo) {
+	outputRecordOut(cfg, &Record{
+		Status:      "new",
+		Path:        info.relPath,
+		NewSize:     int64Ptr(info.size),
+		NewChecksum: info.checksum,
+	})
+	cfg.stats.numFilesNew.Add(1)
+}
+
+func outputChangedFile(cfg *config, oldInfo *fileInfo, info *fileInfo) {
+	outputRecordOut(cfg, &Record{
+		Status:      "changed",
+		Path:        info.relPath,
+		OldSize:     int64Ptr(oldInfo.size),
+		NewSize:     int64Ptr(info.size),
+		OldChecksum: oldInfo.checksum,
+		NewChecksum: info.checksum,
+	})
+	cfg.stats.numFilesChanged.Add(1)
+}
+
+func outputDeletedFile(cfg *config, oldInfo *fileInfo) {
+	outputRecordOut(cfg, &Record{
+		Status:      "deleted",
+		Path:        oldInfo.relPath,
+		OldSize:     int64Ptr(oldInfo.size),
+		OldChecksum: oldInfo.checksum,
+	})
+	cfg.stats.numFilesDeleted.Add(1)
+}
+
+func outputMovedFile(cfg *config, oldInfo *fileInfo, info *fileInfo) {
+	outputRecordOut(cfg, &Record{
+		Status:      "moved",
+		Path:        info.relPath,
+		From:        oldInfo.relPath,
+		OldSize:     int64Ptr(oldInfo.size),
+		NewSize:     int64Ptr(info.size),
+		OldChecksum: oldInfo.checksum,
+		NewChecksum: info.checksum,
+	})
+	cfg.stats.numFilesMoved.Add(1)
+}
+
+// A new file whose content already exists in db under the path src.
+func outputCopiedFile(cfg *config, src string, info *fileInfo) {
+	outputRecordOut(cfg, &Record{
+		Status:      "copied",
+		Path:        info.relPath,
+		From:        src,
+		NewSize:     int64Ptr(info.size),
+		NewChecksum: info.checksum,
+	})
+	cfg.stats.numFilesCopied.Add(1)
+}
+
+func outputUnchangedFile(cfg *config, relPath string) {
+	cfg.logger.debug("unchanged: %s", relPath)
+	cfg.stats.numFilesUnchanged.Add(1)
+}
+
+// Metadata changes are reported separately from content changes, so a
+// file can be both "changed" and "metachanged".
+func outputMetaChangedFile(cfg *config, relPath string, changes []string) {
+	outputRecordOut(cfg, &Record{
+		Status:  "metachanged",
+		Path:    relPath,
+		Changes: changes,
+	})
+	cfg.stats.numFilesMetaChanged.Add(1)
+}
+
+// An entry skipped by cfg.skipError. Its rows in db are left untouched.
+func outputErrorFile(cfg *config, err *FileError) {
+	outputRecordOut(cfg, &Record{
+		Status: "error",
+		Path:   err.Path,
+		Error:  err.Error(),
+	})
+	cfg.stats.numFilesError.Add(1)
+}
+
+// A file modified while being read, even after the retries. Its record in
+// db is left untouched.
+func outputUnstableFile(cfg *config, relPath string) {
+	outputRecordOut(cfg, &Record{
+		Status: "unstable",
+		Path:   relPath,
+	})
+	cfg.stats.numFilesUnstable.Add(1)
+}
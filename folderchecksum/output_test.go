@@ -0,0 +1,204 @@
+package folderchecksum
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestOutputJson(t *testing.T) {
+	var builder strings.Builder
+	oldInfo := fileInfo{relPath: "file1", size: 5, checksum: "aaa"}
+	newInfo := fileInfo{relPath: "file1", size: 0, checksum: "bbb"}
+	outputAll := func(cfg *config) string {
+		builder.Reset()
+		cfg.stats = &scanStats{}
+		cfg.output = &outputState{}
+		cfg.outFile = &builder
+		outputBegin(cfg)
+		outputNewFile(cfg, &fileInfo{relPath: "new\nline", size: 1})
+		outputChangedFile(cfg, &oldInfo, &newInfo)
+		outputDeletedFile(cfg, &oldInfo)
+		outputUnchangedFile(cfg, "file2")
+		outputMetaChangedFile(cfg, "file3", []string{"uid: 0 -> 1"})
+		outputMovedFile(cfg, &oldInfo, &fileInfo{relPath: "dir1/file1",
+			size: 5, checksum: "aaa"})
+		outputCopiedFile(cfg, "file1", &fileInfo{relPath: "dir1/file2",
+			size: 5, checksum: "aaa"})
+		outputErrorFile(cfg, &FileError{Path: "file4",
+			Err: errors.New("Failed to read 'file4'")})
+		outputUnstableFile(cfg, "file5")
+		outputEnd(cfg)
+		return builder.String()
+	}
+	expectRecords := []string{
+		`{"status":"new","path":"new\nline","new_size":1}`,
+		`{"status":"changed","path":"file1","old_size":5,"new_size":0,` +
+			`"old_checksum":"aaa","new_checksum":"bbb"}`,
+		`{"status":"deleted","path":"file1","old_size":5,` +
+			`"old_checksum":"aaa"}`,
+		`{"status":"metachanged","path":"file3","changes":["uid: 0 -> 1"]}`,
+		`{"status":"moved","path":"dir1/file1","from":"file1","old_size":5,` +
+			`"new_size":5,"old_checksum":"aaa","new_checksum":"aaa"}`,
+		`{"status":"copied","path":"dir1/file2","from":"file1",` +
+			`"new_size":5,"new_checksum":"aaa"}`,
+		`{"status":"error","path":"file4",` +
+			`"error":"Failed to read 'file4'"}`,
+		`{"status":"unstable","path":"file5"}`,
+		`{"status":"summary","stats":{"new":1,"changed":1,"deleted":1,` +
+			`"unchanged":1,"metachanged":1,"moved":1,"copied":1,` +
+			`"errors":1,"unstable":1}}`,
+	}
+
+	cfg := config{format: "ndjson"}
+	actual := outputAll(&cfg)
+	expect := strings.Join(expectRecords, "\n") + "\n"
+	if actual != expect {
+		t.Errorf("actual: %s", actual)
+		t.Errorf("expect: %s", expect)
+		t.FailNow()
+	}
+
+	cfg = config{format: "json"}
+	actual = outputAll(&cfg)
+	expect = "[\n  " + strings.Join(expectRecords, ",\n  ") + "\n]\n"
+	if actual != expect {
+		t.Errorf("actual: %s", actual)
+		t.Errorf("expect: %s", expect)
+		t.FailNow()
+	}
+	var records []map[string]any
+	err := json.Unmarshal([]byte(actual), &records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(expectRecords) {
+		t.Fatalf("Incorrect records: %+v", records)
+	}
+
+	cfg = config{format: "text"}
+	actual = outputAll(&cfg)
+	expect = "new: new\nline\n" +
+		"changed: file1\n" +
+		"deleted: file1\n" +
+		"metachanged: file3 (uid: 0 -> 1)\n" +
+		"moved: file1 -> dir1/file1\n" +
+		"copied: file1 -> dir1/file2\n" +
+		"error: file4 (Failed to read 'file4')\n" +
+		"unstable: file5\n"
+	if actual != expect {
+		t.Errorf("actual: %s", actual)
+		t.Errorf("expect: %s", expect)
+		t.FailNow()
+	}
+
+	cfg = config{format: "text", nul: true}
+	actual = outputAll(&cfg)
+	expect = "new: new\nline\x00" +
+		"changed: file1\x00" +
+		"deleted: file1\x00" +
+		"metachanged: file3 (uid: 0 -> 1)\x00" +
+		"moved: file1 -> dir1/file1\x00" +
+		"copied: file1 -> dir1/file2\x00" +
+		"error: file4 (Failed to read 'file4')\x00" +
+		"unstable: file5\x00"
+	if actual != expect {
+		t.Errorf("actual: %q", actual)
+		t.Errorf("expect: %q", expect)
+		t.FailNow()
+	}
+}
+
+func TestOutputCsv(t *testing.T) {
+	var builder strings.Builder
+	oldInfo := fileInfo{relPath: "a,b", size: 5, checksum: "aaa"}
+	newInfo := fileInfo{relPath: "a,b", size: 0}
+	outputAll := func(cfg *config) string {
+		builder.Reset()
+		cfg.stats = &scanStats{}
+		cfg.output = &outputState{}
+		cfg.outFile = &builder
+		outputBegin(cfg)
+		outputNewFile(cfg, &fileInfo{relPath: "new\nline", size: 1})
+		outputChangedFile(cfg, &oldInfo, &newInfo)
+		outputDeletedFile(cfg, &fileInfo{relPath: `"quoted" name`})
+		outputMetaChangedFile(cfg, "file3",
+			[]string{"uid: 0 -> 1", "gid: 0 -> 1"})
+		outputMovedFile(cfg, &oldInfo, &fileInfo{relPath: "file4",
+			size: 5, checksum: "aaa"})
+		outputErrorFile(cfg, &FileError{Path: "file5",
+			Err: errors.New("Failed to read 'file5'")})
+		outputEnd(cfg)
+		return builder.String()
+	}
+	expectRecords := []string{
+		"status,path,old_size,new_size,old_checksum,new_checksum,changes," +
+			"from,error",
+		"new,\"new\nline\",,1,,,,,",
+		"changed,\"a,b\",5,0,aaa,,,,",
+		`deleted,"""quoted"" name",0,,,,,,`,
+		`metachanged,file3,,,,,"uid: 0 -> 1, gid: 0 -> 1",,`,
+		"moved,file4,5,5,aaa,aaa,,\"a,b\",",
+		"error,file5,,,,,,,Failed to read 'file5'",
+	}
+
+	cfg := config{format: "csv"}
+	actual := outputAll(&cfg)
+	expect := strings.Join(expectRecords, "\n") + "\n"
+	if actual != expect {
+		t.Errorf("actual: %s", actual)
+		t.Errorf("expect: %s", expect)
+		t.FailNow()
+	}
+	records, err := csv.NewReader(strings.NewReader(actual)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(expectRecords) || records[1][1] != "new\nline" {
+		t.Fatalf("Incorrect records: %q", records)
+	}
+
+	cfg = config{format: "csv", nul: true}
+	actual = outputAll(&cfg)
+	expect = strings.Join(expectRecords, "\x00") + "\x00"
+	if actual != expect {
+		t.Errorf("actual: %q", actual)
+		t.Errorf("expect: %q", expect)
+		t.FailNow()
+	}
+}
+
+func TestOutputSorted(t *testing.T) {
+	var builder strings.Builder
+	cfg := config{
+		format:  "text",
+		sort:    true,
+		outFile: &builder,
+		stats:   &scanStats{},
+		output:  &outputState{},
+	}
+	outputBegin(&cfg)
+	outputNewFile(&cfg, &fileInfo{relPath: "c"})
+	outputMetaChangedFile(&cfg, "b", []string{"uid: 0 -> 1"})
+	outputChangedFile(&cfg, &fileInfo{relPath: "b"}, &fileInfo{relPath: "b"})
+	outputNewFile(&cfg, &fileInfo{relPath: "a/b"})
+	outputDeletedFile(&cfg, &fileInfo{relPath: "a"})
+	outputDeletedFile(&cfg, &fileInfo{relPath: "d"})
+	if builder.Len() != 0 {
+		t.Fatalf("Output before outputEnd: %s", builder.String())
+	}
+	outputEnd(&cfg)
+	expect := "deleted: a\n" +
+		"new: a/b\n" +
+		"metachanged: b (uid: 0 -> 1)\n" +
+		"changed: b\n" +
+		"new: c\n" +
+		"deleted: d\n"
+	if builder.String() != expect {
+		t.Errorf("actual: %s", builder.String())
+		t.Errorf("expect: %s", expect)
+		t.FailNow()
+	}
+}
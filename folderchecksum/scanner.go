@@ -0,0 +1,235 @@
+// Package folderchecksum records the checksums of the files in a folder in
+// a database file, and reports the changes of the folder against it.
+package folderchecksum
+
+import (
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// A Scanner compares a folder against its database file, and updates the
+// database file if requested.
+type Scanner struct {
+	cfg config
+}
+
+// The result of Scanner.Run.
+type Result struct {
+	Stats Stats
+	// The records if Options.Output is nil, sorted by path if Options.Sort
+	// is true.
+	Records []Record
+	// Only set by Options.Migrate, in which case the folder isn't scanned.
+	Migrate *MigrateStats
+	// The entries skipped by Options.SkipError, in the order they are
+	// skipped.
+	Errors []FileError
+}
+
+// Return a Scanner for opts, or an error if opts are invalid.
+func NewScanner(opts Options) (*Scanner, error) {
+	cfg, err := newConfig(&opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Scanner{cfg: *cfg}, nil
+}
+
+// Scan the folder (or migrate the database file if Options.Migrate is
+// set), and return the result. If an error is returned, the database file
+// is at most created or upgraded to the current tables, and its records
+// and meta are left unchanged.
+func (s *Scanner) Run() (*Result, error) {
+	cfg := s.cfg
+	cfg.stats = &scanStats{}
+	cfg.output = &outputState{}
+	cfg.errors = &scanErrors{}
+	var err error
+	if cfg.db, err = openDb(cfg.dbFile); err != nil {
+		return nil, err
+	}
+	// The temp folders of the dbs replacing <dbfile>.
+	var tempDirs []string
+	defer func() {
+		// The db may be in one of the folders, close it first.
+		cfg.db.Close()
+		for _, dir := range tempDirs {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	if cfg.mtree != "" {
+		// All the other operations use the spec instead, and <dbfile>
+		// is never created.
+		mtreeDb, tempDir, err := openMtreeDb(&cfg)
+		if err != nil {
+			return nil, err
+		}
+		cfg.db.Close()
+		cfg.db = mtreeDb
+		tempDirs = append(tempDirs, tempDir)
+		cfg.logger.info("Using mtree spec: %s", cfg.mtree)
+	} else if cfg.textDb {
+		// Written back after an update.
+		textDb, tempDir, err := loadTextDb(cfg.dbFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.db.Close()
+		cfg.db = textDb
+		tempDirs = append(tempDirs, tempDir)
+		cfg.logger.info("Using text database file: %s", cfg.dbFile)
+	} else {
+		cfg.logger.info("Using database file: %s", cfg.dbFile)
+		if err = createTablesIfNeeded(cfg.db, cfg.logger); err != nil {
+			return nil, err
+		}
+	}
+	cfg.history, err = resolveHistory(newSqliteStore(cfg.db), cfg.history,
+		cfg.update)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.snapshot > 0 {
+		// All the other operations use the snapshot instead.
+		snapshotDb, tempDir, err := openSnapshotDb(cfg.db, cfg.dbFile,
+			cfg.snapshot)
+		if err != nil {
+			return nil, err
+		}
+		cfg.db.Close()
+		cfg.db = snapshotDb
+		tempDirs = append(tempDirs, tempDir)
+		cfg.logger.info("Using snapshot of run %d", cfg.snapshot)
+	}
+	cfg.store = newSqliteStore(cfg.db)
+
+	res, err := run(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.textDb && (cfg.migrate > 0 || cfg.update) {
+		if err = saveTextDb(cfg.db, cfg.dbFile); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// Migrate or scan the records in cfg.store, which is the only way they are
+// accessed.
+func run(cfg *config) (*Result, error) {
+	var err error
+	cfg.hashAlgo, err = resolveHashAlgo(cfg.store, cfg.hashAlgo,
+		cfg.migrate > 0, cfg.logger)
+	if err != nil {
+		return nil, err
+	}
+	cfg.logger.info("Using hash algorithm: %s", cfg.hashAlgo)
+
+	if cfg.migrate > 0 {
+		migrateStats, err := migrateFiles(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{Migrate: &migrateStats, Errors: cfg.errors.skipped},
+			nil
+	}
+
+	if err = scan(cfg); err != nil {
+		return nil, err
+	}
+	return &Result{
+		Stats:   getStats(cfg),
+		Records: cfg.output.records,
+		Errors:  cfg.errors.skipped,
+	}, nil
+}
+
+// Walk the folder, and check the files against cfg.store. Return the error
+// aborting the scan, in which case cfg.store is not updated.
+func scan(cfg *config) error {
+	// Start workers (1 dbUpdateWorker and j fileCheckWorker).
+	chFileCheck := make(chan fileCheckMsg)
+	chDbUpdate := make(chan dbUpdateMsg, 128)
+	var wgDbUpdate sync.WaitGroup
+	var wgFileCheck sync.WaitGroup
+	wgDbUpdate.Add(1)
+	wgFileCheck.Add(cfg.j)
+	go dbUpdateWorker(cfg, &wgDbUpdate, chDbUpdate)
+	for i := 0; i < cfg.j; i++ {
+		go fileCheckWorker(i+1, cfg, &wgFileCheck, chFileCheck, chDbUpdate)
+	}
+
+	outputBegin(cfg)
+
+	// Walk the folder.
+	procOneFile := func(relPath string, info fs.FileInfo) error {
+		if cfg.errors.aborted.Load() {
+			return errAborted
+		}
+		fileType := typeFile
+		size := info.Size()
+		if isSymlink(info.Mode()) {
+			fileType = typeLink
+		} else if info.IsDir() {
+			// The size of a folder is meaningless.
+			fileType = typeDir
+			size = 0
+		}
+		chFileCheck <- fileCheckMsg{
+			relPath:  relPath,
+			size:     size,
+			stat:     getFileStat(info),
+			fileType: fileType,
+		}
+		return nil
+	}
+	procError := func(err *FileError) error {
+		if cfg.errors.aborted.Load() {
+			return errAborted
+		}
+		// dbUpdateWorker decides whether to skip it.
+		chDbUpdate <- dbUpdateMsg{"E", fileInfo{relPath: err.Path}, err}
+		return nil
+	}
+	walkOpts := walkOptions{
+		followLinks: cfg.followLinks,
+		trackLinks:  cfg.trackLinks,
+		trackDirs:   cfg.trackDirs,
+		logger:      cfg.logger,
+	}
+	prefixes := cfg.prefix
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	for _, prefix := range prefixes {
+		err := walkDir(cfg.rootDir, prefix, walkOpts, procOneFile, procError)
+		if err != nil {
+			if err != errAborted {
+				cfg.errors.abort(err)
+			}
+			break
+		}
+	}
+
+	// Wait for fileCheckWorker.
+	close(chFileCheck)
+	wgFileCheck.Wait()
+
+	// Check the deleted files.
+	if !cfg.errors.aborted.Load() {
+		for _, prefix := range prefixes {
+			chDbUpdate <- dbUpdateMsg{"D", fileInfo{relPath: prefix}, nil}
+		}
+	}
+
+	// Wait for dbUpdateWorker.
+	close(chDbUpdate)
+	wgDbUpdate.Wait()
+	if err := cfg.errors.get(); err != nil {
+		return err
+	}
+	return outputEnd(cfg)
+}
@@ -0,0 +1,357 @@
+package folderchecksum
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestNewScannerInvalidOptions(t *testing.T) {
+	testCases := []Options{
+		{},
+		{RootDir: "r", Jobs: -1},
+		{RootDir: "r", Exclude: []string{"("}},
+		{RootDir: "r", FollowLinks: true, TrackLinks: true},
+		{RootDir: "r", Track: []string{"size"}},
+		{RootDir: "r", HashAlgo: "md4"},
+		{RootDir: "r", Migrate: 1},
+		{RootDir: "r", Format: "xml"},
+		{RootDir: "r", Format: "json", Nul: true},
+		{RootDir: "r", Moves: true, SizeOnly: true},
+		{RootDir: "r", Retries: -1},
+		{RootDir: "r", Snapshot: 1, Update: true},
+		{RootDir: "r", Mtree: "spec", Update: true},
+		{RootDir: "r", DbFile: "db.txt", History: true},
+	}
+	for i := range testCases {
+		if _, err := NewScanner(testCases[i]); err == nil {
+			t.Errorf("Expected an error for %+v", testCases[i])
+		}
+	}
+	// 0 means NumCPU.
+	scanner, err := NewScanner(Options{RootDir: "r"})
+	if err != nil || scanner.cfg.j != runtime.NumCPU() {
+		t.Errorf("Incorrect jobs: %v", err)
+	}
+}
+
+func TestScannerRun(t *testing.T) {
+	rootDir := t.TempDir()
+	for _, name := range []string{"file2", "file1"} {
+		err := os.WriteFile(filepath.Join(rootDir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without Output, the records are returned.
+	scanner, err := NewScanner(Options{
+		Jobs:    2,
+		Update:  true,
+		Sort:    true,
+		RootDir: rootDir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := scanner.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stats != (Stats{New: 2}) || len(result.Records) != 2 ||
+		result.Records[0].Path != "file1" ||
+		result.Records[1].Path != "file2" ||
+		result.Records[0].Status != "new" {
+		t.Fatalf("Incorrect result: %+v", result)
+	}
+
+	// The scanner can run again against the updated db.
+	err = os.WriteFile(filepath.Join(rootDir, "file1"), []byte("new"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var builder strings.Builder
+	scanner, err = NewScanner(Options{
+		Output:  &builder,
+		RootDir: rootDir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		builder.Reset()
+		result, err = scanner.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Stats != (Stats{Changed: 1, Unchanged: 1}) ||
+			len(result.Records) != 0 {
+			t.Fatalf("Incorrect result: %+v", result)
+		}
+		if builder.String() != "changed: file1\n" {
+			t.Fatalf("Incorrect output: %s", builder.String())
+		}
+	}
+}
+
+func TestScannerSkipError(t *testing.T) {
+	rootDir := t.TempDir()
+	for _, name := range []string{"file1", "file2"} {
+		err := os.WriteFile(filepath.Join(rootDir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	scanner, err := NewScanner(Options{Update: true, RootDir: rootDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = scanner.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// file1 becomes a broken link, which can't be followed.
+	path1 := filepath.Join(rootDir, "file1")
+	if err = os.Remove(path1); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("missing", path1); err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "file2"), []byte("new"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		Update:      true,
+		FollowLinks: true,
+		Sort:        true,
+		RootDir:     rootDir,
+	}
+
+	// The run is aborted by default, and the db is not updated.
+	scanner, err = NewScanner(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = scanner.Run(); err == nil {
+		t.Fatal("Expected an error for the broken link")
+	}
+
+	// The broken link is skipped, and its row is left untouched.
+	var skipped []string
+	opts.SkipError = func(err *FileError) bool {
+		skipped = append(skipped, err.Path)
+		return true
+	}
+	for i := 0; i < 2; i++ {
+		scanner, err = NewScanner(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := scanner.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := Stats{Changed: 1, Errors: 1}
+		if i == 1 {
+			expect = Stats{Unchanged: 1, Errors: 1}
+		}
+		if result.Stats != expect || len(result.Errors) != 1 ||
+			result.Errors[0].Path != "file1" || len(result.Records) != 2-i ||
+			result.Records[0].Status != "error" ||
+			result.Records[0].Path != "file1" {
+			t.Fatalf("Incorrect result: %+v", result)
+		}
+	}
+	if strings.Join(skipped, ",") != "file1,file1" {
+		t.Fatalf("Incorrect skipped entries: %v", skipped)
+	}
+}
+
+func TestScannerRunAbortedMeta(t *testing.T) {
+	rootDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(rootDir, "file1"), []byte("1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("missing", filepath.Join(rootDir, "link1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The broken link aborts the run before -hash and -history are
+	// recorded.
+	scanner, err := NewScanner(Options{
+		Update:      true,
+		HashAlgo:    "sha256",
+		History:     true,
+		FollowLinks: true,
+		RootDir:     rootDir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = scanner.Run(); err == nil {
+		t.Fatal("Expected an error for the broken link")
+	}
+	db, err := openDb(filepath.Join(rootDir, ".checksum.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"hash", "history"} {
+		if _, ok, err := queryMeta(db, key); err != nil || ok {
+			t.Fatalf("Meta %s recorded by the aborted run: %v", key, err)
+		}
+	}
+}
+
+// Make readFileChecksums rewrite the file after each of its first n reads,
+// as if it were modified while being read. Return the number of reads.
+func modifyFileWhileReading(t *testing.T, path string, n int) *int {
+	reads := 0
+	readFileChecksums = func(filePath string, algos []string) ([]string,
+		int64, error) {
+		checksums, size, err := calcFileChecksums(filePath, algos)
+		reads++
+		if filePath == path && reads <= n {
+			content := []byte(strings.Repeat("x", reads))
+			if err := os.WriteFile(path, content, 0644); err != nil {
+				t.Error(err)
+			}
+		}
+		return checksums, size, err
+	}
+	t.Cleanup(func() { readFileChecksums = calcFileChecksums })
+	return &reads
+}
+
+func TestScannerRunRetry(t *testing.T) {
+	rootDir := t.TempDir()
+	path := filepath.Join(rootDir, "file1")
+	if err := os.WriteFile(path, []byte("file1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		Update:  true,
+		Retries: 2,
+		RootDir: rootDir,
+	}
+
+	// Modified by the first two reads, and stable on the last retry.
+	reads := modifyFileWhileReading(t, path, 2)
+	scanner, err := NewScanner(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := scanner.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *reads != 3 || result.Stats != (Stats{New: 1}) {
+		t.Fatalf("Incorrect result: %d reads, %+v", *reads, result)
+	}
+	db, err := openDb(filepath.Join(rootDir, ".checksum.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// The checksum of the content read by the last retry, i.e., "xx".
+	file, _, err := queryFile(db, "file1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file == nil || file.size != 2 ||
+		file.checksum != "9336ebf25087d91c818ee6e9ec29f8c1" {
+		t.Fatalf("Incorrect record: %+v", file)
+	}
+
+	// Still modified after the last retry.
+	reads = modifyFileWhileReading(t, path, 3)
+	scanner, err = NewScanner(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = scanner.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *reads != 3 || result.Stats != (Stats{Unstable: 1}) ||
+		len(result.Records) != 1 || result.Records[0].Status != "unstable" {
+		t.Fatalf("Incorrect result: %d reads, %+v", *reads, result)
+	}
+	// Its record is left untouched.
+	file, _, err = queryFile(db, "file1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file == nil || file.size != 2 ||
+		file.checksum != "9336ebf25087d91c818ee6e9ec29f8c1" {
+		t.Fatalf("Incorrect record: %+v", file)
+	}
+}
+
+func TestScannerRunCopiesSameOutput(t *testing.T) {
+	testCases := []struct {
+		name   string
+		moves  bool
+		expect string
+	}{
+		// a is deleted, so it's not the source of c or d.
+		{"copies", false, "deleted: a\ncopied: b -> c\ncopied: b -> d\n"},
+		// a is moved to c, and d is a copy of b (recorded before the
+		// run) rather than c.
+		{"moves", true, "moved: a -> c\ncopied: b -> d\n"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rootDir := t.TempDir()
+			writeFile := func(name string, content string) {
+				err := os.WriteFile(filepath.Join(rootDir, name),
+					[]byte(content), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			writeFile("a", "xx")
+			writeFile("b", "xx")
+			scanner, err := NewScanner(Options{Update: true, RootDir: rootDir})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = scanner.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = os.Remove(filepath.Join(rootDir, "a")); err != nil {
+				t.Fatal(err)
+			}
+			writeFile("c", "xx")
+			writeFile("d", "xx")
+			// Compare, then update.
+			for _, update := range []bool{false, true} {
+				var builder strings.Builder
+				scanner, err = NewScanner(Options{
+					Update:  update,
+					Copies:  true,
+					Moves:   testCase.moves,
+					Output:  &builder,
+					RootDir: rootDir,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err = scanner.Run(); err != nil {
+					t.Fatal(err)
+				}
+				if builder.String() != testCase.expect {
+					t.Fatalf("Incorrect output (update=%t): %s", update,
+						builder.String())
+				}
+			}
+		})
+	}
+}
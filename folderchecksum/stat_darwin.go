@@ -0,0 +1,24 @@
+package folderchecksum
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+func getFileStat(info fs.FileInfo) fileStat {
+	ret := fileStat{
+		mtime: info.ModTime().UnixNano(),
+		mode:  int64(info.Mode().Perm()),
+		uid:   -1,
+		gid:   -1,
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		ret.ctime = st.Ctimespec.Nano()
+		ret.inode = int64(st.Ino)
+		ret.dev = int64(st.Dev)
+		ret.mode = int64(st.Mode & 07777)
+		ret.uid = int64(st.Uid)
+		ret.gid = int64(st.Gid)
+	}
+	return ret
+}
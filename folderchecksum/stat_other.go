@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+
+package folderchecksum
+
+import (
+	"io/fs"
+)
+
+// Only mtime and the permission bits are available on this platform.
+func getFileStat(info fs.FileInfo) fileStat {
+	return fileStat{
+		mtime: info.ModTime().UnixNano(),
+		mode:  int64(info.Mode().Perm()),
+		uid:   -1,
+		gid:   -1,
+	}
+}
@@ -0,0 +1,90 @@
+package folderchecksum
+
+import (
+	"time"
+)
+
+// The queries shared by store and storeTx.
+type fileQuerier interface {
+	// Return 1. nil or the file; 2. visited flag.
+	queryFile(relPath string) (*fileInfo, bool, error)
+	// Return the smallest path (other than file.relPath, and the ones
+	// skip returns true for if it's not nil) of the regular files with the
+	// same size and checksum as file, or an empty string if there isn't
+	// one.
+	queryCopySource(file *fileInfo, skip func(relPath string) bool) (string,
+		error)
+}
+
+// A store keeps a record with a "visited" flag for each entry in the
+// folder. The workers only access the records through it. The methods of
+// store are safe for concurrent use.
+type store interface {
+	fileQuerier
+	// Return the meta (see setMeta) of key, and whether it's set.
+	queryMeta(key string) (string, bool, error)
+	// Return the number of records with checksums computed by one of
+	// hashers.
+	countFilesWithChecksum() (int64, error)
+	// Return the number of records with checksums computed by an
+	// algorithm other than algo.
+	countFilesToMigrate(algo string) (int64, error)
+	// Begin the tx used by dbUpdateWorker. The changes made in the tx are
+	// not visible to the store until committed.
+	begin() (storeTx, error)
+}
+
+// A storeTx is only used by a single goroutine. prefix of the methods
+// below is either "" (i.e., all the records) or ends with '/'.
+type storeTx interface {
+	fileQuerier
+	// Insert file, and mark it visited.
+	insertFile(file *fileInfo) error
+	// Update the existing record of file.relPath, and mark it visited.
+	updateAndMarkFile(file *fileInfo) error
+	// Mark the unvisited record of relPath visited.
+	markFile(relPath string) error
+	// Mark the record of relPath visited if it exists and is unvisited.
+	// Return the number of records marked (0 or 1).
+	markFileIfUnvisited(relPath string) (int64, error)
+	// Mark the unvisited records under prefix visited. Return the number
+	// of records marked.
+	markUnvisitedFiles(prefix string) (int64, error)
+	// Call procOneFile on each unvisited record under prefix in the
+	// order of path.
+	queryUnvisitedFiles(prefix string,
+		procOneFile func(file *fileInfo) error) error
+	// Delete the unvisited record of relPath.
+	deleteUnvisitedFile(relPath string) error
+	// Delete the unvisited records under prefix, which are expected to be
+	// expectN records.
+	deleteUnvisitedFiles(prefix string, expectN int64) error
+	// Clear the visited flag of relPath, which must be set.
+	clearVisitedFlag(relPath string) error
+	// Clear the visited flag of relPath if it's set. Return the number of
+	// records cleared (0 or 1).
+	clearVisitedFlagIfSet(relPath string) (int64, error)
+	// Clear the visited flags under prefix. Return the number of records
+	// cleared.
+	clearVisitedFlags(prefix string) (int64, error)
+	// Rewrite the unvisited record of oldPath as file, and mark it
+	// visited.
+	moveFile(oldPath string, file *fileInfo) error
+	// Return at most limit records whose checksums are computed by an
+	// algorithm other than algo, in the order of path. Only the records
+	// of prefix itself (if it's not "") or under prefix+"/", with paths
+	// greater than after, are returned.
+	queryFilesToMigrate(prefix string, after string, algo string,
+		limit int64) ([]fileInfo, error)
+	// Replace the checksum and algo of oldFile with newFile's. Both of
+	// them should have the same relPath, and oldFile should match the
+	// record.
+	migrateFile(oldFile *fileInfo, newFile *fileInfo) error
+	// Set the meta of the store, see setMeta.
+	setMeta(key string, value string) error
+	// Record the current records as a run of the history (see
+	// recordRun).
+	recordRun(now time.Time) (int64, error)
+	commit() error
+	rollback()
+}
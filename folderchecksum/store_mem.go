@@ -0,0 +1,344 @@
+package folderchecksum
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The store keeping the records in memory, e.g., for tests. A tx works on
+// a copy of the records, which replaces the records on commit.
+type memStore struct {
+	mu      sync.RWMutex
+	records map[string]memRecord
+	meta    map[string]string
+}
+
+type memRecord struct {
+	file    fileInfo
+	visited bool
+}
+
+type memTx struct {
+	store   *memStore
+	records map[string]memRecord
+	meta    map[string]string
+}
+
+// Return a memStore with files as the unvisited records.
+func newMemStore(files []fileInfo) *memStore {
+	s := &memStore{
+		records: make(map[string]memRecord),
+		meta:    make(map[string]string),
+	}
+	for _, file := range files {
+		s.records[file.relPath] = memRecord{file: file}
+	}
+	return s
+}
+
+// Return the committed records in the order of path.
+func (s *memStore) files() []fileInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var files []fileInfo
+	for _, relPath := range sortedPaths(s.records, "") {
+		files = append(files, s.records[relPath].file)
+	}
+	return files
+}
+
+// Return the sorted paths in records under prefix.
+func sortedPaths(records map[string]memRecord, prefix string) []string {
+	var paths []string
+	for relPath := range records {
+		if strings.HasPrefix(relPath, prefix) {
+			paths = append(paths, relPath)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func queryMemFile(records map[string]memRecord, relPath string) (*fileInfo,
+	bool) {
+	record, ok := records[relPath]
+	if !ok {
+		return nil, false
+	}
+	return &record.file, record.visited
+}
+
+func queryMemCopySource(records map[string]memRecord, file *fileInfo,
+	skip func(relPath string) bool) string {
+	src := ""
+	for relPath, record := range records {
+		f := &record.file
+		if f.fileType == typeFile && f.checksum == file.checksum &&
+			f.algo == file.algo && f.size == file.size &&
+			relPath != file.relPath && (src == "" || relPath < src) &&
+			(skip == nil || !skip(relPath)) {
+			src = relPath
+		}
+	}
+	return src
+}
+
+func (s *memStore) queryFile(relPath string) (*fileInfo, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	file, visited := queryMemFile(s.records, relPath)
+	return file, visited, nil
+}
+
+func (s *memStore) queryCopySource(file *fileInfo,
+	skip func(relPath string) bool) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return queryMemCopySource(s.records, file, skip), nil
+}
+
+func (s *memStore) queryMeta(key string) (string, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.meta[key]
+	return value, ok, nil
+}
+
+func (s *memStore) countFilesWithChecksum() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := int64(0)
+	for _, record := range s.records {
+		_, verifyOnly := verifyOnlyHashers[record.file.algo]
+		if record.file.checksum != "" && !verifyOnly {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memStore) countFilesToMigrate(algo string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := int64(0)
+	for _, record := range s.records {
+		if record.file.checksum != "" && record.file.algo != algo {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memStore) begin() (storeTx, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t := &memTx{
+		store:   s,
+		records: make(map[string]memRecord),
+		meta:    make(map[string]string),
+	}
+	for relPath, record := range s.records {
+		t.records[relPath] = record
+	}
+	for key, value := range s.meta {
+		t.meta[key] = value
+	}
+	return t, nil
+}
+
+func (t *memTx) queryFile(relPath string) (*fileInfo, bool, error) {
+	file, visited := queryMemFile(t.records, relPath)
+	return file, visited, nil
+}
+
+func (t *memTx) queryCopySource(file *fileInfo,
+	skip func(relPath string) bool) (string, error) {
+	return queryMemCopySource(t.records, file, skip), nil
+}
+
+// Return the record of relPath, which must exist with the visited flag.
+func (t *memTx) getRecord(relPath string, visited bool) (memRecord, error) {
+	record, ok := t.records[relPath]
+	if !ok || record.visited != visited {
+		return record, fmt.Errorf("Record %s (visited=%t) not found",
+			relPath, visited)
+	}
+	return record, nil
+}
+
+func (t *memTx) insertFile(file *fileInfo) error {
+	if _, ok := t.records[file.relPath]; ok {
+		return fmt.Errorf("Failed to insert %+v: already exists", file)
+	}
+	t.records[file.relPath] = memRecord{file: *file, visited: true}
+	return nil
+}
+
+func (t *memTx) updateAndMarkFile(file *fileInfo) error {
+	if _, ok := t.records[file.relPath]; !ok {
+		return fmt.Errorf("Failed to update %+v: not found", file)
+	}
+	t.records[file.relPath] = memRecord{file: *file, visited: true}
+	return nil
+}
+
+func (t *memTx) markFile(relPath string) error {
+	record, err := t.getRecord(relPath, false)
+	if err != nil {
+		return err
+	}
+	record.visited = true
+	t.records[relPath] = record
+	return nil
+}
+
+func (t *memTx) markFileIfUnvisited(relPath string) (int64, error) {
+	record, ok := t.records[relPath]
+	if !ok || record.visited {
+		return 0, nil
+	}
+	record.visited = true
+	t.records[relPath] = record
+	return 1, nil
+}
+
+func (t *memTx) markUnvisitedFiles(prefix string) (int64, error) {
+	n := int64(0)
+	for _, relPath := range sortedPaths(t.records, prefix) {
+		m, _ := t.markFileIfUnvisited(relPath)
+		n += m
+	}
+	return n, nil
+}
+
+func (t *memTx) queryUnvisitedFiles(prefix string,
+	procOneFile func(file *fileInfo) error) error {
+	for _, relPath := range sortedPaths(t.records, prefix) {
+		if record := t.records[relPath]; !record.visited {
+			if err := procOneFile(&record.file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *memTx) deleteUnvisitedFile(relPath string) error {
+	if _, err := t.getRecord(relPath, false); err != nil {
+		return err
+	}
+	delete(t.records, relPath)
+	return nil
+}
+
+func (t *memTx) deleteUnvisitedFiles(prefix string, expectN int64) error {
+	n := int64(0)
+	for _, relPath := range sortedPaths(t.records, prefix) {
+		if !t.records[relPath].visited {
+			delete(t.records, relPath)
+			n++
+		}
+	}
+	if n != expectN {
+		return fmt.Errorf("Deleted %d records, but expected %d", n, expectN)
+	}
+	return nil
+}
+
+func (t *memTx) clearVisitedFlag(relPath string) error {
+	record, err := t.getRecord(relPath, true)
+	if err != nil {
+		return err
+	}
+	record.visited = false
+	t.records[relPath] = record
+	return nil
+}
+
+func (t *memTx) clearVisitedFlagIfSet(relPath string) (int64, error) {
+	record, ok := t.records[relPath]
+	if !ok || !record.visited {
+		return 0, nil
+	}
+	record.visited = false
+	t.records[relPath] = record
+	return 1, nil
+}
+
+func (t *memTx) clearVisitedFlags(prefix string) (int64, error) {
+	n := int64(0)
+	for _, relPath := range sortedPaths(t.records, prefix) {
+		m, _ := t.clearVisitedFlagIfSet(relPath)
+		n += m
+	}
+	return n, nil
+}
+
+func (t *memTx) moveFile(oldPath string, file *fileInfo) error {
+	if _, err := t.getRecord(oldPath, false); err != nil {
+		return err
+	}
+	if _, ok := t.records[file.relPath]; ok {
+		return fmt.Errorf("Failed to move %s to %+v: already exists",
+			oldPath, file)
+	}
+	delete(t.records, oldPath)
+	t.records[file.relPath] = memRecord{file: *file, visited: true}
+	return nil
+}
+
+func (t *memTx) queryFilesToMigrate(prefix string, after string,
+	algo string, limit int64) ([]fileInfo, error) {
+	var files []fileInfo
+	for _, relPath := range sortedPaths(t.records, "") {
+		if int64(len(files)) >= limit {
+			break
+		}
+		file := t.records[relPath].file
+		if relPath > after && file.checksum != "" && file.algo != algo &&
+			(prefix == "" || relPath == prefix ||
+				strings.HasPrefix(relPath, prefix+"/")) {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+func (t *memTx) migrateFile(oldFile *fileInfo, newFile *fileInfo) error {
+	record, ok := t.records[oldFile.relPath]
+	if !ok || record.file.checksum != oldFile.checksum ||
+		record.file.algo != oldFile.algo {
+		return fmt.Errorf("Failed to migrate %+v: not found", oldFile)
+	}
+	record.file.checksum = newFile.checksum
+	record.file.algo = newFile.algo
+	t.records[oldFile.relPath] = record
+	return nil
+}
+
+func (t *memTx) setMeta(key string, value string) error {
+	t.meta[key] = value
+	return nil
+}
+
+func (t *memTx) recordRun(now time.Time) (int64, error) {
+	return 0, fmt.Errorf("History is not supported by memStore")
+}
+
+func (t *memTx) commit() error {
+	t.store.mu.Lock()
+	defer t.store.mu.Unlock()
+	t.store.records = t.records
+	t.store.meta = t.meta
+	t.records = nil
+	t.meta = nil
+	return nil
+}
+
+func (t *memTx) rollback() {
+	t.records = nil
+	t.meta = nil
+}
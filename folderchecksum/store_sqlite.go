@@ -0,0 +1,152 @@
+package folderchecksum
+
+import (
+	"database/sql"
+	"time"
+)
+
+// The store backed by the files table in a SQLite db.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+type sqliteTx struct {
+	tx      *sql.Tx
+	insStmt *sql.Stmt
+	updStmt *sql.Stmt
+	mrkStmt *sql.Stmt
+	migStmt *sql.Stmt
+}
+
+func newSqliteStore(db *sql.DB) *sqliteStore {
+	return &sqliteStore{db: db}
+}
+
+func (s *sqliteStore) queryFile(relPath string) (*fileInfo, bool, error) {
+	return queryFile(s.db, relPath)
+}
+
+func (s *sqliteStore) queryCopySource(file *fileInfo,
+	skip func(relPath string) bool) (string, error) {
+	return queryCopySource(s.db, file, skip)
+}
+
+func (s *sqliteStore) queryMeta(key string) (string, bool, error) {
+	return queryMeta(s.db, key)
+}
+
+func (s *sqliteStore) countFilesWithChecksum() (int64, error) {
+	return countFilesWithChecksum(s.db)
+}
+
+func (s *sqliteStore) countFilesToMigrate(algo string) (int64, error) {
+	return countFilesToMigrate(s.db, algo)
+}
+
+func (s *sqliteStore) begin() (storeTx, error) {
+	tx, err := createTx(s.db)
+	if err != nil {
+		return nil, err
+	}
+	t := &sqliteTx{tx: tx}
+	if t.insStmt, err = prepareInsertFile(tx); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if t.updStmt, err = prepareUpdateAndMarkFile(tx); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if t.mrkStmt, err = prepareMarkFile(tx); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if t.migStmt, err = prepareMigrateFile(tx); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *sqliteTx) queryFile(relPath string) (*fileInfo, bool, error) {
+	return queryFile(t.tx, relPath)
+}
+
+func (t *sqliteTx) queryCopySource(file *fileInfo,
+	skip func(relPath string) bool) (string, error) {
+	return queryCopySource(t.tx, file, skip)
+}
+
+func (t *sqliteTx) insertFile(file *fileInfo) error {
+	return insertFile(t.insStmt, file)
+}
+
+func (t *sqliteTx) updateAndMarkFile(file *fileInfo) error {
+	return updateAndMarkFile(t.updStmt, file)
+}
+
+func (t *sqliteTx) markFile(relPath string) error {
+	return markFile(t.mrkStmt, relPath)
+}
+
+func (t *sqliteTx) markFileIfUnvisited(relPath string) (int64, error) {
+	return markFileIfUnvisited(t.tx, relPath)
+}
+
+func (t *sqliteTx) markUnvisitedFiles(prefix string) (int64, error) {
+	return markUnvisitedFiles(t.tx, prefix)
+}
+
+func (t *sqliteTx) queryUnvisitedFiles(prefix string,
+	procOneFile func(file *fileInfo) error) error {
+	return queryUnvisitedFiles(t.tx, prefix, procOneFile)
+}
+
+func (t *sqliteTx) deleteUnvisitedFile(relPath string) error {
+	return deleteUnvisitedFile(t.tx, relPath)
+}
+
+func (t *sqliteTx) deleteUnvisitedFiles(prefix string, expectN int64) error {
+	return deleteUnvisitedFiles(t.tx, prefix, expectN)
+}
+
+func (t *sqliteTx) clearVisitedFlag(relPath string) error {
+	return clearVisitedFlag(t.tx, relPath)
+}
+
+func (t *sqliteTx) clearVisitedFlagIfSet(relPath string) (int64, error) {
+	return clearVisitedFlagIfSet(t.tx, relPath)
+}
+
+func (t *sqliteTx) clearVisitedFlags(prefix string) (int64, error) {
+	return clearVisitedFlags(t.tx, prefix)
+}
+
+func (t *sqliteTx) moveFile(oldPath string, file *fileInfo) error {
+	return moveFile(t.tx, oldPath, file)
+}
+
+func (t *sqliteTx) queryFilesToMigrate(prefix string, after string,
+	algo string, limit int64) ([]fileInfo, error) {
+	return queryFilesToMigrate(t.tx, prefix, after, algo, limit)
+}
+
+func (t *sqliteTx) migrateFile(oldFile *fileInfo, newFile *fileInfo) error {
+	return migrateFile(t.migStmt, oldFile, newFile)
+}
+
+func (t *sqliteTx) setMeta(key string, value string) error {
+	return setMeta(t.tx, key, value)
+}
+
+func (t *sqliteTx) recordRun(now time.Time) (int64, error) {
+	return recordRun(t.tx, now)
+}
+
+func (t *sqliteTx) commit() error {
+	return commitTx(t.tx)
+}
+
+func (t *sqliteTx) rollback() {
+	t.tx.Rollback()
+}
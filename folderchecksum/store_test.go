@@ -0,0 +1,274 @@
+package folderchecksum
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var storeTestFiles = []fileInfo{
+	{relPath: "a", size: 5, checksum: "aaa", algo: "md5"},
+	{relPath: "b", fileType: typeDir},
+	{relPath: "b/x", size: 5, checksum: "bbb", algo: "md5"},
+	{relPath: "b/y", size: 5, checksum: "aaa", algo: "md5"},
+	{relPath: "c", size: 3, fileType: typeLink, target: "b/x"},
+}
+
+// Run the same operations against s, which contains storeTestFiles.
+// getFiles returns the committed records in the order of path.
+func storeRunTest(t *testing.T, s store, getFiles func() []fileInfo) {
+	file, visited, err := s.queryFile("b/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file == nil || *file != storeTestFiles[2] || visited {
+		t.Fatalf("queryFile(b/x): %+v, %t", file, visited)
+	}
+	if file, _, err = s.queryFile("zz"); err != nil || file != nil {
+		t.Fatalf("queryFile(zz): %+v, %v", file, err)
+	}
+	newFile := fileInfo{relPath: "new", size: 5, checksum: "aaa", algo: "md5"}
+	if src, err := s.queryCopySource(&newFile, nil); err != nil || src != "a" {
+		t.Fatalf("queryCopySource(new): %s, %v", src, err)
+	}
+	src, err := s.queryCopySource(&storeTestFiles[0], nil)
+	if err != nil || src != "b/y" {
+		t.Fatalf("queryCopySource(a): %s, %v", src, err)
+	}
+	skipA := func(relPath string) bool { return relPath == "a" }
+	if src, err := s.queryCopySource(&newFile, skipA); err != nil ||
+		src != "b/y" {
+		t.Fatalf("queryCopySource(new, skip a): %s, %v", src, err)
+	}
+
+	// Changes are not visible until committed.
+	tx, err := s.begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.insertFile(&newFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, visited, err = tx.queryFile("new"); err != nil || !visited {
+		t.Fatalf("new is not visited in tx: %v", err)
+	}
+	if file, _, err = s.queryFile("new"); err != nil || file != nil {
+		t.Fatalf("new is visible outside tx: %+v, %v", file, err)
+	}
+	tx.rollback()
+	verifyFileInfo(t, getFiles(), storeTestFiles)
+
+	tx, err = s.begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.insertFile(&newFile); err != nil {
+		t.Fatal(err)
+	}
+	changed := storeTestFiles[2]
+	changed.checksum = "ccc"
+	if err := tx.updateAndMarkFile(&changed); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.markFile("b"); err != nil {
+		t.Fatal(err)
+	}
+	var unvisited []fileInfo
+	if err := tx.queryUnvisitedFiles("b/", func(file *fileInfo) error {
+		unvisited = append(unvisited, *file)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	verifyFileInfo(t, unvisited, storeTestFiles[3:4])
+	moved := fileInfo{relPath: "d", size: 5, checksum: "aaa", algo: "md5"}
+	if err := tx.moveFile("b/y", &moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.deleteUnvisitedFile("c"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := tx.clearVisitedFlagIfSet("zz"); err != nil || n != 0 {
+		t.Fatalf("clearVisitedFlagIfSet(zz): %d, %v", n, err)
+	}
+	if err := tx.clearVisitedFlag("new"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := tx.clearVisitedFlags("b/"); err != nil || n != 1 {
+		t.Fatalf("clearVisitedFlags(b/): %d, %v", n, err)
+	}
+	unvisited = nil
+	if err := tx.queryUnvisitedFiles("", func(file *fileInfo) error {
+		unvisited = append(unvisited, *file)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	verifyFileInfo(t, unvisited, []fileInfo{storeTestFiles[0], changed,
+		newFile})
+	if err := tx.deleteUnvisitedFiles("", 3); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := tx.clearVisitedFlags(""); err != nil || n != 2 {
+		t.Fatalf("clearVisitedFlags(): %d, %v", n, err)
+	}
+	if err := tx.commit(); err != nil {
+		t.Fatal(err)
+	}
+	verifyFileInfo(t, getFiles(), []fileInfo{storeTestFiles[1], moved})
+	if _, visited, err = s.queryFile("d"); err != nil || visited {
+		t.Fatalf("d is still visited: %v", err)
+	}
+}
+
+func TestSqliteStore(t *testing.T) {
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	s := newSqliteStore(db)
+	tx, err := s.begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range storeTestFiles {
+		if err := tx.insertFile(&storeTestFiles[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tx.clearVisitedFlags(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.commit(); err != nil {
+		t.Fatal(err)
+	}
+	storeRunTest(t, s, func() []fileInfo {
+		var files []fileInfo
+		if err := queryFilesUnder(db, "", func(file *fileInfo) error {
+			files = append(files, *file)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return files
+	})
+}
+
+func TestMemStore(t *testing.T) {
+	s := newMemStore(storeTestFiles)
+	storeRunTest(t, s, s.files)
+}
+
+func TestDbUpdateWorkerMemStore(t *testing.T) {
+	var wg sync.WaitGroup
+	var builder strings.Builder
+	tx := make(chan dbUpdateMsg)
+
+	s := newMemStore([]fileInfo{
+		{relPath: "a/file1", size: 5, checksum: "aaa", algo: "md5"},
+		{relPath: "a/file2", size: 5, checksum: "bbb", algo: "md5"},
+	})
+	cfg := config{
+		store:   s,
+		update:  true,
+		moves:   true,
+		outFile: &builder,
+		stats:   &scanStats{},
+		output:  &outputState{},
+		errors:  &scanErrors{},
+	}
+	mIn := []dbUpdateMsg{
+		{"N", fileInfo{relPath: "b/moved1", size: 5,
+			checksum: "aaa", algo: "md5"}, nil},
+		{"I", fileInfo{relPath: "b/new", size: 5,
+			checksum: "eee", algo: "md5"}, nil},
+		{"D", fileInfo{relPath: "a"}, nil},
+		{"D", fileInfo{relPath: "b"}, nil},
+	}
+	expectFiles := []fileInfo{
+		{relPath: "b/moved1", size: 5, checksum: "aaa", algo: "md5"},
+		{relPath: "b/new", size: 5, checksum: "eee", algo: "md5"},
+	}
+	expectStdout := "moved: a/file1 -> b/moved1\n" +
+		"deleted: a/file2\n"
+
+	// Updated by fileCheckWorker otherwise.
+	cfg.stats.numFilesNew.Add(1)
+	wg.Add(1)
+	go dbUpdateWorker(&cfg, &wg, tx)
+	for _, m := range mIn {
+		tx <- m
+	}
+	close(tx)
+	wg.Wait()
+
+	verifyFileInfo(t, s.files(), expectFiles)
+	if actualStdout := builder.String(); actualStdout != expectStdout {
+		t.Errorf("actualStdout: %s", actualStdout)
+		t.Errorf("expectStdout: %s", expectStdout)
+		t.FailNow()
+	}
+}
+
+func TestRunMigrateMemStore(t *testing.T) {
+	rootDir := t.TempDir()
+	for _, name := range []string{"file1", "file2"} {
+		err := os.WriteFile(filepath.Join(rootDir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newMemStore([]fileInfo{
+		{relPath: "file1", size: 5,
+			checksum: "826e8142e6baabe8af779f5f490cf5f5", algo: "md5"},
+		{relPath: "file2", size: 5,
+			checksum: "1c1c96fd2cf8330db0bfa936ce82f3b9", algo: "md5"},
+		{relPath: "file3", size: 5, checksum: "ccc", algo: "crc32"},
+	})
+	if _, err := resolveHashAlgo(s, "sha256", false, nil); err == nil {
+		t.Fatal("Expected an error for the mismatch")
+	}
+
+	cfg := config{
+		j:         2,
+		store:     s,
+		excludeRe: regexp.MustCompile(`^$`),
+		includeRe: regexp.MustCompile(`^$`),
+		hashAlgo:  "sha256",
+		migrate:   1,
+		rootDir:   rootDir,
+		errors:    &scanErrors{},
+	}
+	// file3 only has an imported checksum, and is missing.
+	for i, expect := range []MigrateStats{
+		{Migrated: 1, Remaining: 2},
+		{Migrated: 1, Remaining: 1},
+		{Skipped: 1, Remaining: 1},
+	} {
+		res, err := run(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *res.Migrate != expect {
+			t.Fatalf("Incorrect stats of run %d: %+v", i, *res.Migrate)
+		}
+	}
+	verifyFileInfo(t, s.files(), []fileInfo{
+		{relPath: "file1", size: 5,
+			checksum: "c147efcfc2d7ea666a9e4f5187b115c9" +
+				"0903f0fc896a56df9a6ef5d8f3fc9f31", algo: "sha256"},
+		{relPath: "file2", size: 5,
+			checksum: "3377870dfeaaa7adf79a374d2702a3fd" +
+				"b13e5e5ea0dd8aa95a802ad39044a92f", algo: "sha256"},
+		{relPath: "file3", size: 5, checksum: "ccc", algo: "crc32"},
+	})
+
+	// The algorithm is recorded by the migration.
+	algo, err := resolveHashAlgo(s, "", false, nil)
+	if err != nil || algo != "sha256" {
+		t.Fatalf("Incorrect algo: %s, %v", algo, err)
+	}
+}
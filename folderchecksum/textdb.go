@@ -0,0 +1,357 @@
+package folderchecksum
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A text database file is a sorted, line-oriented manifest which can be
+// committed to git. It's loaded into a temporary SQLite db, so that all
+// the operations work in the same way, and written back atomically after
+// an update.
+//
+// The first line is textDbHeader, followed by the meta lines in the form
+// of "#meta <key>=<value>", and the names of the columns in the form of
+// "#columns <column>\t<column>...". Each of the remaining lines is a row
+// of the files table in the order of path, with the fields of the named
+// columns separated by tabs. NULL is written as an empty field, and mode
+// is in octal.
+const textDbHeader = "# FolderChecksum text database v2"
+
+// The header of the first version, which has no "#columns" line. Its
+// columns are textDbV1Columns, and mode is in decimal.
+const textDbV1Header = "# FolderChecksum text database v1"
+
+// The columns written to a text database file. The stat fields specific
+// to a machine or a checkout (mtime, ctime, inode and dev) are left out,
+// so that a fresh clone doesn't rewrite every line.
+var textDbColumns = []string{"path", "size", "checksum", "algo", "mode",
+	"uid", "gid", "type", "target", "xattrs"}
+
+var textDbV1Columns = []string{"path", "size", "checksum", "algo", "mtime",
+	"ctime", "inode", "dev", "mode", "uid", "gid", "type", "target",
+	"xattrs"}
+
+// The layout of the rows in a text database file.
+type textDbLayout struct {
+	columns  []string
+	modeBase int
+}
+
+func isTextDbFile(dbFile string) bool {
+	return strings.HasSuffix(dbFile, ".txt")
+}
+
+// Escape '\\', tab, newline and carriage return in str, and a leading '#'
+// which starts a comment.
+func escapeTextDbField(str string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`,
+		"\r", `\r`)
+	str = replacer.Replace(str)
+	if strings.HasPrefix(str, "#") {
+		str = `\` + str
+	}
+	return str
+}
+
+func unescapeTextDbField(str string) string {
+	if strings.HasPrefix(str, `\#`) {
+		str = str[1:]
+	}
+	replacer := strings.NewReplacer(`\\`, `\`, `\t`, "\t", `\n`, "\n",
+		`\r`, "\r")
+	return replacer.Replace(str)
+}
+
+// Return the field of column in file. Negative mode, uid and gid are
+// NULL.
+func formatTextDbField(file *fileInfo, column string) string {
+	switch column {
+	case "path":
+		return escapeTextDbField(file.relPath)
+	case "size":
+		return strconv.FormatInt(file.size, 10)
+	case "checksum":
+		return file.checksum
+	case "algo":
+		return file.algo
+	case "mode":
+		if file.stat.mode < 0 {
+			return ""
+		}
+		return fmt.Sprintf("%04o", file.stat.mode)
+	case "uid", "gid":
+		n := file.stat.uid
+		if column == "gid" {
+			n = file.stat.gid
+		}
+		if n < 0 {
+			return ""
+		}
+		return strconv.FormatInt(n, 10)
+	case "type":
+		return strconv.Itoa(int(file.fileType))
+	case "target":
+		return escapeTextDbField(file.target)
+	case "xattrs":
+		return file.xattrs
+	}
+	return ""
+}
+
+func formatTextDbLine(file *fileInfo) string {
+	var fields []string
+	for _, column := range textDbColumns {
+		fields = append(fields, formatTextDbField(file, column))
+	}
+	return strings.Join(fields, "\t")
+}
+
+// Return the columns in a "#columns" line (without the prefix). Each of
+// them must be one of textDbV1Columns (i.e., all the columns), and path
+// is required.
+func parseTextDbColumns(str string, name string,
+	lineNum int) ([]string, error) {
+	columns := strings.Split(str, "\t")
+	seen := make(map[string]bool)
+	for _, column := range columns {
+		known := false
+		for _, c := range textDbV1Columns {
+			known = known || c == column
+		}
+		if !known || seen[column] {
+			return nil, fmt.Errorf("%s:%d: unknown or duplicate column '%s'",
+				name, lineNum, column)
+		}
+		seen[column] = true
+	}
+	if !seen["path"] {
+		return nil, fmt.Errorf("%s:%d: missing column 'path'", name, lineNum)
+	}
+	return columns, nil
+}
+
+// Parse a row in layout. The columns not in layout are NULL, and size is
+// unknownSize.
+func parseTextDbLine(line string, layout *textDbLayout, name string,
+	lineNum int) (fileInfo, error) {
+	fields := strings.Split(line, "\t")
+	if len(fields) != len(layout.columns) {
+		return fileInfo{}, fmt.Errorf("%s:%d: expected %d fields, got %d",
+			name, lineNum, len(layout.columns), len(fields))
+	}
+	file := fileInfo{
+		size: unknownSize,
+		stat: fileStat{mode: -1, uid: -1, gid: -1},
+	}
+	for i, column := range layout.columns {
+		str := fields[i]
+		var dest *int64
+		base := 10
+		switch column {
+		case "path":
+			file.relPath = unescapeTextDbField(str)
+		case "checksum":
+			file.checksum = str
+		case "algo":
+			file.algo = str
+		case "target":
+			file.target = unescapeTextDbField(str)
+		case "xattrs":
+			file.xattrs = str
+		case "type":
+			fileType, err := strconv.Atoi(str)
+			if err != nil || fileType < int(typeFile) ||
+				fileType > int(typeDir) {
+				return fileInfo{}, fmt.Errorf("%s:%d: invalid type '%s'",
+					name, lineNum, str)
+			}
+			file.fileType = entryType(fileType)
+		case "size":
+			dest = &file.size
+		case "mtime":
+			dest = &file.stat.mtime
+		case "ctime":
+			dest = &file.stat.ctime
+		case "inode":
+			dest = &file.stat.inode
+		case "dev":
+			dest = &file.stat.dev
+		case "mode":
+			dest = &file.stat.mode
+			base = layout.modeBase
+		case "uid":
+			dest = &file.stat.uid
+		case "gid":
+			dest = &file.stat.gid
+		}
+		if dest == nil {
+			continue
+		}
+		if str == "" {
+			// Only mode, uid and gid are nullable.
+			*dest = -1
+			continue
+		}
+		n, err := strconv.ParseInt(str, base, 64)
+		if err != nil {
+			return fileInfo{}, fmt.Errorf("%s:%d: invalid %s '%s'", name,
+				lineNum, column, str)
+		}
+		*dest = n
+	}
+	return file, nil
+}
+
+// Load the text database file (if exists) into a new temporary db. The
+// user should call Close() on the returned db, then remove the returned
+// temp folder.
+func loadTextDb(dbFile string) (*sql.DB, string, error) {
+	return openTempDb("text.db", func(db *sql.DB) error {
+		f, err := os.Open(dbFile)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to open '%s': %w", dbFile, err)
+		}
+		defer f.Close()
+		return readTextDb(db, f, dbFile)
+	})
+}
+
+// Read the text database file f (opened from name) into db.
+func readTextDb(db *sql.DB, f io.Reader, name string) error {
+	tx, err := createTx(db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := prepareInsertFile(tx)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	var n int64
+	var layout textDbLayout
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		switch {
+		case lineNum == 1:
+			switch line {
+			case textDbHeader:
+				layout.modeBase = 8
+			case textDbV1Header:
+				layout = textDbLayout{columns: textDbV1Columns, modeBase: 10}
+			default:
+				return fmt.Errorf("%s:%d: expected '%s'", name, lineNum,
+					textDbHeader)
+			}
+		case strings.HasPrefix(line, "#columns "):
+			layout.columns, err = parseTextDbColumns(
+				line[len("#columns "):], name, lineNum)
+			if err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "#meta "):
+			key, value, _ := strings.Cut(line[len("#meta "):], "=")
+			_, err = tx.Exec(
+				`INSERT INTO meta(key, value) VALUES(?, ?)
+					ON CONFLICT(key) DO UPDATE SET value=excluded.value`,
+				key, value)
+			if err != nil {
+				return fmt.Errorf("Failed to set meta %s: %w", key, err)
+			}
+		case line == "" || strings.HasPrefix(line, "#"):
+		case layout.columns == nil:
+			return fmt.Errorf("%s:%d: missing '#columns' line", name,
+				lineNum)
+		default:
+			file, err := parseTextDbLine(line, &layout, name, lineNum)
+			if err != nil {
+				return err
+			}
+			if err = insertFile(stmt, &file); err != nil {
+				return err
+			}
+			n++
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("Failed to read '%s': %w", name, err)
+	}
+	numCleared, err := clearVisitedFlags(tx, "")
+	if err != nil {
+		return err
+	}
+	if numCleared != n {
+		return fmt.Errorf("numVisitedFlagsCleared mismatch")
+	}
+	return commitTx(tx)
+}
+
+// Write db to the text database file atomically, i.e., write a temp file
+// then rename it.
+func saveTextDb(db *sql.DB, dbFile string) error {
+	tempFile := dbFile + ".tmp"
+	f, err := os.Create(tempFile)
+	if err != nil {
+		return fmt.Errorf("Failed to create '%s': %w", tempFile, err)
+	}
+	err = writeTextDb(db, f)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("Failed to write '%s': %w", tempFile, err)
+	}
+	if err = os.Rename(tempFile, dbFile); err != nil {
+		return fmt.Errorf("Failed to rename '%s': %w", tempFile, err)
+	}
+	return nil
+}
+
+// Write the meta and files tables of db to w in the text database format.
+func writeTextDb(db *sql.DB, w io.Writer) error {
+	out := bufio.NewWriter(w)
+	out.WriteString(textDbHeader + "\n")
+
+	rows, err := db.Query(`SELECT key, value FROM meta ORDER BY key ASC`)
+	if err != nil {
+		return fmt.Errorf("Failed to query meta: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, value string
+		if err = rows.Scan(&key, &value); err != nil {
+			return fmt.Errorf("Failed to scan meta: %w", err)
+		}
+		fmt.Fprintf(out, "#meta %s=%s\n", key, value)
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("Failed to query meta: %w", err)
+	}
+	rows.Close()
+
+	out.WriteString("#columns " + strings.Join(textDbColumns, "\t") + "\n")
+	err = queryFilesUnder(db, "", func(file *fileInfo) error {
+		out.WriteString(formatTextDbLine(file))
+		out.WriteByte('\n')
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
@@ -0,0 +1,130 @@
+package folderchecksum
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTextDbRoundTrip(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "test.txt")
+
+	// A new file.
+	db, tempDir, err := loadTextDb(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := append(copyAndSortFileRows(testDbRows[:]),
+		fileRow{path: "#dir\t1/\\#file\n", size: unknownSize,
+			checksum: "aaa", algo: "md5",
+			stat: fileStat{mode: -1, uid: -1, gid: -1}},
+		fileRow{path: "dir1", fileType: typeDir,
+			stat:   fileStat{mode: 0755, uid: 0, gid: 0},
+			xattrs: "security:0123"})
+	for i := range rows {
+		rows[i].visited = false
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+	if err := setMeta(db, "hash", "md5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveTextDb(db, dbFile); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	os.RemoveAll(tempDir)
+
+	content, err := os.ReadFile(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(content), "\n")
+	if lines[0] != textDbHeader || lines[1] != "#meta hash=md5" ||
+		lines[2] != "#columns path\tsize\tchecksum\talgo\tmode\tuid\t"+
+			"gid\ttype\ttarget\txattrs" ||
+		lines[3] != "\\#dir\\t1/\\\\#file\\n\t-1\taaa\tmd5\t\t\t\t0\t\t" ||
+		!strings.Contains(string(content),
+			"\nfile1\t123\taaa\tmd5\t0644\t1000\t1000\t0\t\t\n") {
+		t.Fatalf("Incorrect content:\n%s", content)
+	}
+	if _, err := os.Stat(dbFile + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("Temp file not renamed")
+	}
+
+	db, tempDir, err = loadTextDb(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	defer db.Close()
+	// The stat fields specific to the machine are not written.
+	for i := range rows {
+		rows[i].stat.mtime = 0
+		rows[i].stat.ctime = 0
+		rows[i].stat.inode = 0
+		rows[i].stat.dev = 0
+	}
+	verifyFileRows(t, getAllRowsFromFiles(t, db), copyAndSortFileRows(rows))
+	if algo, _, err := queryMeta(db, "hash"); err != nil || algo != "md5" {
+		t.Fatalf("Incorrect algo: %s, %v", algo, err)
+	}
+}
+
+func TestReadTextDbColumns(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content string
+		expect  []fileRow
+	}{
+		{
+			name: "v1",
+			content: "# FolderChecksum text database v1\n" +
+				"file1\t5\taaa\tmd5\t1\t2\t3\t4\t420\t\t\t0\t\t\n",
+			expect: []fileRow{{path: "file1", size: 5, checksum: "aaa",
+				algo: "md5", stat: fileStat{mtime: 1, ctime: 2, inode: 3,
+					dev: 4, mode: 0644, uid: -1, gid: -1}}},
+		},
+		{
+			// The columns can be in any order, and the missing ones
+			// are NULL.
+			name: "reordered",
+			content: textDbHeader + "\n" +
+				"#columns checksum\tpath\tmode\n" +
+				"aaa\tfile1\t0755\n",
+			expect: []fileRow{{path: "file1", size: unknownSize,
+				checksum: "aaa", stat: fileStat{mode: 0755, uid: -1,
+					gid: -1}}},
+		},
+		{
+			name:    "no columns",
+			content: textDbHeader + "\nfile1\t5\n",
+		},
+		{
+			name:    "unknown column",
+			content: textDbHeader + "\n#columns path\tcolor\n",
+		},
+		{
+			name:    "no path",
+			content: textDbHeader + "\n#columns size\n",
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			db := prepareTestDb(t)
+			defer db.Close()
+			err := readTextDb(db, strings.NewReader(testCase.content),
+				"test")
+			if testCase.expect == nil {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifyFileRows(t, getAllRowsFromFiles(t, db), testCase.expect)
+		})
+	}
+}
@@ -0,0 +1,669 @@
+package folderchecksum
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The counters of a scan, updated by the workers.
+type scanStats struct {
+	numFilesNew            atomic.Int64
+	numFilesChanged        atomic.Int64
+	numFilesDeleted        atomic.Int64
+	numFilesUnchanged      atomic.Int64
+	numFilesMetaChanged    atomic.Int64
+	numFilesMoved          atomic.Int64
+	numFilesCopied         atomic.Int64
+	numFilesError          atomic.Int64
+	numFilesUnstable       atomic.Int64
+	numVisitedFlagsCleared atomic.Int64
+	// The records marked visited because of a skipped FileError or an
+	// unstable file.
+	numFilesSkipped atomic.Int64
+}
+
+type fileCheckMsg struct {
+	relPath  string
+	size     int64
+	stat     fileStat
+	fileType entryType
+}
+
+// opType "E" carries an error (instead of info) to dbUpdateWorker, which
+// decides whether to skip it or abort the scan. opType "S" marks the record
+// of an unstable file visited, leaving it untouched.
+type dbUpdateMsg struct {
+	opType string
+	info   fileInfo
+	err    error
+}
+
+// Returned by calcChecksums if the file keeps being modified while it's
+// read.
+var errUnstable = errors.New("modified while being read")
+
+// Return whether the file is modified between the two stats.
+func isStatChanged(before fs.FileInfo, after fs.FileInfo) bool {
+	statBefore := getFileStat(before)
+	statAfter := getFileStat(after)
+	return before.Size() != after.Size() ||
+		statBefore.mtime != statAfter.mtime ||
+		statBefore.ctime != statAfter.ctime
+}
+
+// Read the files for calcChecksums. Replaced in tests to modify the files
+// while they are being read.
+var readFileChecksums = calcFileChecksums
+
+// Read the file and return the checksums computed by algos, and the number
+// of bytes read. The file is stat'ed before and after it's read. If the
+// size, mtime or ctime differs, or the number of bytes read doesn't match
+// the size, the file is read again, up to retries more times before
+// errUnstable is returned.
+func calcChecksums(path string, algos []string, retries int,
+	logger *Logger) ([]string, int64, error) {
+	for i := 0; ; i++ {
+		before, err := os.Stat(path)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Failed to stat '%s': %w", path, err)
+		}
+		checksums, n, err := readFileChecksums(path, algos)
+		if err != nil {
+			return nil, 0, err
+		}
+		after, err := os.Stat(path)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Failed to stat '%s': %w", path, err)
+		}
+		if n == before.Size() && !isStatChanged(before, after) {
+			return checksums, n, nil
+		}
+		if i >= retries {
+			return nil, 0, errUnstable
+		}
+		logger.info("'%s' is modified while being read, retrying", path)
+	}
+}
+
+// Fill in info.checksum and info.algo using cfg.hashAlgo, and set
+// info.size to the size they are computed from. Leave them empty in
+// sizeOnly mode or for symlinks and folders.
+func fillChecksum(cfg *config, path string, info *fileInfo) error {
+	if cfg.sizeOnly || info.fileType != typeFile {
+		info.checksum = ""
+		info.algo = ""
+		return nil
+	}
+	checksums, n, err := calcChecksums(path, []string{cfg.hashAlgo},
+		cfg.retries, cfg.logger)
+	if err != nil {
+		return &FileError{Path: info.relPath, Err: err}
+	}
+	info.size = n
+	info.checksum = checksums[0]
+	info.algo = cfg.hashAlgo
+	return nil
+}
+
+// Output file as copied if cfg.copies is true and cfg.store had the same
+// content under another path (except the ones removed returns true for) at
+// the beginning of the run, or as new otherwise. file.checksum should be
+// filled in when cfg.copies is true.
+func outputNewOrCopiedFile(cfg *config, file *fileInfo,
+	removed func(relPath string) bool) error {
+	if cfg.copies && file.fileType == typeFile && file.size != 0 {
+		src, err := cfg.store.queryCopySource(file, removed)
+		if err != nil {
+			return err
+		}
+		if src != "" {
+			outputCopiedFile(cfg, src, file)
+			return nil
+		}
+	}
+	outputNewFile(cfg, file)
+	return nil
+}
+
+func shouldExcludePath(cfg *config, relPath string) bool {
+	return cfg.excludeRe.MatchString(relPath) &&
+		!cfg.includeRe.MatchString(relPath)
+}
+
+func fileCheckWorker(id int, cfg *config, wg *sync.WaitGroup,
+	cIn <-chan fileCheckMsg, cOut chan<- dbUpdateMsg) {
+	// This worker doesn't create any tx on its own.
+	cfg.logger.debug("Started fileCheckWorker %d", id)
+
+	for msg := range cIn {
+		if cfg.errors.aborted.Load() {
+			// Drain the channel.
+			continue
+		}
+		err := checkFile(id, cfg, &msg, cOut)
+		if errors.Is(err, errUnstable) {
+			// Report the file instead of recording a checksum that may
+			// be wrong.
+			outputUnstableFile(cfg, msg.relPath)
+			cOut <- dbUpdateMsg{"S", fileInfo{relPath: msg.relPath}, nil}
+		} else if err != nil {
+			cOut <- dbUpdateMsg{"E", fileInfo{relPath: msg.relPath}, err}
+		}
+	}
+
+	cfg.logger.debug("Stopped fileCheckWorker %d", id)
+	wg.Done()
+}
+
+// Check the file in msg against cfg.store, and send the update to cOut.
+// An error reading the file is returned as a *FileError, which wraps
+// errUnstable if the file keeps being modified while it's read.
+func checkFile(id int, cfg *config, msg *fileCheckMsg,
+	cOut chan<- dbUpdateMsg) error {
+	path := filepath.Join(cfg.rootDir, msg.relPath)
+	if shouldExcludePath(cfg, msg.relPath) {
+		cfg.logger.info("skipped: %s", msg.relPath)
+		return nil
+	}
+
+	infoInDb, _, err := cfg.store.queryFile(msg.relPath)
+	if err != nil {
+		return err
+	}
+	info := fileInfo{
+		relPath:  msg.relPath,
+		size:     msg.size,
+		checksum: "",
+		algo:     "",
+		stat:     msg.stat,
+		fileType: msg.fileType,
+		target:   "",
+	}
+	if msg.fileType == typeLink {
+		if info.target, err = readLink(path); err != nil {
+			return &FileError{Path: msg.relPath, Err: err}
+		}
+	}
+	if len(cfg.xattrs) != 0 {
+		// Symlinks reaching here are tracked (not followed), so are
+		// their xattrs.
+		info.xattrs, err = getXattrsDigest(path, msg.fileType == typeLink,
+			cfg.xattrs)
+		if err != nil {
+			return &FileError{Path: msg.relPath, Err: err}
+		}
+	}
+
+	cfg.logger.debug("(worker %d) checking %s: %+v", id, msg.relPath, infoInDb)
+
+	if infoInDb == nil && (cfg.moves || cfg.copies) &&
+		msg.fileType == typeFile && msg.size != 0 {
+		// Db doesn't have this file, but it may be moved from a
+		// deleted one, or copied from one that remains. dbUpdateWorker
+		// decides after the deleted files are known. Empty files are
+		// never deemed moved or copied.
+		if err = fillChecksum(cfg, path, &info); err != nil {
+			return err
+		}
+		cOut <- dbUpdateMsg{"N", info, nil}
+		return nil
+	}
+	if infoInDb == nil {
+		// Db doesn't have this file.
+		if cfg.update {
+			if err = fillChecksum(cfg, path, &info); err != nil {
+				return err
+			}
+		}
+		outputNewFile(cfg, &info)
+		if cfg.update {
+			// Insert the file into db.
+			cOut <- dbUpdateMsg{"I", info, nil}
+		}
+		return nil
+	}
+
+	dbInfo := *infoInDb
+	dbStat := dbInfo.stat
+	dbXattrs := dbInfo.xattrs
+	if len(cfg.xattrs) == 0 {
+		// Keep the digest in db when it's not computed.
+		info.xattrs = dbXattrs
+	}
+	changes := getMetaChanges(cfg.track, dbStat, msg.stat)
+	if change := getXattrsChange(dbXattrs, info.xattrs); change != "" {
+		changes = append(changes, change)
+	}
+	if len(changes) != 0 {
+		outputMetaChangedFile(cfg, msg.relPath, changes)
+	}
+	// Whether the stat tuple and xattrs in db need to be refreshed.
+	metaUnchanged := dbStat == msg.stat && dbXattrs == info.xattrs
+
+	if dbInfo.fileType != msg.fileType ||
+		(dbInfo.size != msg.size && dbInfo.size != unknownSize) {
+		// Db has this file, but type or size is different. The
+		// size of a file imported from a manifest may be unknown.
+		if cfg.update {
+			if err = fillChecksum(cfg, path, &info); err != nil {
+				return err
+			}
+		}
+		outputChangedFile(cfg, &dbInfo, &info)
+		if cfg.update {
+			// Update the file in db.
+			cOut <- dbUpdateMsg{"U", info, nil}
+		} else {
+			// Mark the file visited.
+			cOut <- dbUpdateMsg{"M", info, nil}
+		}
+		return nil
+	}
+
+	// Db has this folder. It's deemed unchanged.
+	if msg.fileType == typeDir {
+		outputUnchangedFile(cfg, msg.relPath)
+		if !metaUnchanged && cfg.update {
+			// Refresh the stat tuple and xattrs in db.
+			cOut <- dbUpdateMsg{"U", info, nil}
+		} else {
+			// Mark the folder visited.
+			cOut <- dbUpdateMsg{"M", info, nil}
+		}
+		return nil
+	}
+
+	// Db has this symlink, size is the same. Compare the target.
+	if msg.fileType == typeLink {
+		if dbInfo.target != info.target {
+			outputChangedFile(cfg, &dbInfo, &info)
+			if cfg.update {
+				// Update the link in db.
+				cOut <- dbUpdateMsg{"U", info, nil}
+			} else {
+				// Mark the link visited.
+				cOut <- dbUpdateMsg{"M", info, nil}
+			}
+		} else {
+			outputUnchangedFile(cfg, msg.relPath)
+			if !metaUnchanged && cfg.update {
+				// Refresh the stat tuple and xattrs in db.
+				cOut <- dbUpdateMsg{"U", info, nil}
+			} else {
+				// Mark the link visited.
+				cOut <- dbUpdateMsg{"M", info, nil}
+			}
+		}
+		return nil
+	}
+
+	dbHasChecksum := dbInfo.checksum != ""
+	// A zero mtime means the stat tuple is not recorded in db.
+	statUnchanged := dbStat.mtime != 0 && dbStat == msg.stat
+
+	// Db has this file, size is the same. The file is deemed unchanged
+	// in sizeOnly mode.
+	if cfg.sizeOnly {
+		if dbInfo.size == unknownSize {
+			cfg.logger.warning("Db doesn't have the size of '%s' but "+
+				"-sizeonly is used.", msg.relPath)
+		}
+		outputUnchangedFile(cfg, msg.relPath)
+		if (dbHasChecksum || !metaUnchanged) && cfg.update {
+			// Clear the original checksum in db, and refresh the
+			// stat tuple.
+			cOut <- dbUpdateMsg{"U", info, nil}
+		} else {
+			// Mark the file visited.
+			cOut <- dbUpdateMsg{"M", info, nil}
+		}
+		return nil
+	}
+
+	// Db has this file, size and the stat tuple are the same. The file
+	// is deemed unchanged in quick mode.
+	if cfg.quick && dbHasChecksum && statUnchanged {
+		outputUnchangedFile(cfg, msg.relPath)
+		info.checksum = dbInfo.checksum
+		info.algo = dbInfo.algo
+		// Mark the file visited.
+		cOut <- dbUpdateMsg{"M", info, nil}
+		return nil
+	}
+
+	// Compare the checksum computed by the algorithm stored in db.
+	// When the file needs to be updated in db and the algorithms are
+	// different, also compute the checksum by cfg.hashAlgo in the
+	// same pass.
+	algo := dbInfo.algo
+	if !dbHasChecksum {
+		cfg.logger.warning("Db only has size info for '%s' but -sizeonly is "+
+			"not used.", msg.relPath)
+		algo = cfg.hashAlgo
+	}
+	algos := []string{algo}
+	if cfg.update && algo != cfg.hashAlgo {
+		algos = append(algos, cfg.hashAlgo)
+	}
+	checksums, n, err := calcChecksums(path, algos, cfg.retries,
+		cfg.logger)
+	if err != nil {
+		return &FileError{Path: msg.relPath, Err: err}
+	}
+	// The file may be modified since it's walked, in which case the
+	// checksums differ from db.
+	info.size = n
+	info.checksum = checksums[0]
+	info.algo = algo
+	if dbInfo.checksum == info.checksum {
+		outputUnchangedFile(cfg, msg.relPath)
+		if !metaUnchanged && cfg.update {
+			// Refresh the stat tuple in db, so that the file can be
+			// skipped next time in quick mode.
+			cOut <- dbUpdateMsg{"U", info, nil}
+		} else {
+			// Mark the file visited.
+			cOut <- dbUpdateMsg{"M", info, nil}
+		}
+	} else {
+		info.checksum = checksums[len(checksums)-1]
+		info.algo = algos[len(algos)-1]
+		outputChangedFile(cfg, &dbInfo, &info)
+		if cfg.update {
+			// Update the file in db.
+			cOut <- dbUpdateMsg{"U", info, nil}
+		} else {
+			// Mark the file visited.
+			cOut <- dbUpdateMsg{"M", info, nil}
+		}
+	}
+	return nil
+}
+
+func verifyStats(cfg *config) error {
+	numFilesNew := cfg.stats.numFilesNew.Load()
+	numFilesChanged := cfg.stats.numFilesChanged.Load()
+	numFilesDeleted := cfg.stats.numFilesDeleted.Load()
+	numFilesUnchanged := cfg.stats.numFilesUnchanged.Load()
+	numFilesMetaChanged := cfg.stats.numFilesMetaChanged.Load()
+	numFilesMoved := cfg.stats.numFilesMoved.Load()
+	numFilesCopied := cfg.stats.numFilesCopied.Load()
+	numFilesError := cfg.stats.numFilesError.Load()
+	numFilesUnstable := cfg.stats.numFilesUnstable.Load()
+	numVisitedFlagsCleared := cfg.stats.numVisitedFlagsCleared.Load()
+	numFilesSkipped := cfg.stats.numFilesSkipped.Load()
+
+	// numFilesMetaChanged overlaps with the other counters, and the rows
+	// of the numFilesError and numFilesUnstable entries are counted by
+	// numFilesSkipped, so they are not part of the check below.
+	cfg.logger.info("stats: numFilesNew=%d numFilesChanged=%d "+
+		"numFilesDeleted=%d numFilesUnchanged=%d numFilesMetaChanged=%d "+
+		"numFilesMoved=%d numFilesCopied=%d numFilesError=%d "+
+		"numFilesUnstable=%d numVisitedFlagsCleared=%d numFilesSkipped=%d",
+		numFilesNew, numFilesChanged, numFilesDeleted,
+		numFilesUnchanged, numFilesMetaChanged, numFilesMoved,
+		numFilesCopied, numFilesError, numFilesUnstable,
+		numVisitedFlagsCleared, numFilesSkipped)
+
+	if cfg.update {
+		numVisited := numFilesNew + numFilesChanged + numFilesUnchanged +
+			numFilesMoved + numFilesCopied + numFilesSkipped
+		if numVisitedFlagsCleared != numVisited {
+			return fmt.Errorf("stats inconsistent: "+
+				"numVisitedFlagsCleared=%d, numFilesNew+numFilesChanged+"+
+				"numFilesUnchanged+numFilesMoved+numFilesCopied+"+
+				"numFilesSkipped=%d", numVisitedFlagsCleared, numVisited)
+		}
+	} else {
+		if numVisitedFlagsCleared != 0 {
+			return fmt.Errorf("numVisitedFlagsCleared=%d, expected 0",
+				numVisitedFlagsCleared)
+		}
+	}
+	return nil
+}
+
+// Mark the records of the skipped entry relPath visited, so that they are
+// left untouched instead of being deleted. If dir is true, the entries
+// under the folder relPath are skipped.
+func markSkippedFiles(cfg *config, tx storeTx, relPath string,
+	dir bool) error {
+	var n int64
+	var err error
+	if dir {
+		// The entries under the folder are not walked. The folder itself
+		// is handled by fileCheckWorker.
+		prefix := relPath + "/"
+		if relPath == "." {
+			prefix = ""
+		}
+		n, err = tx.markUnvisitedFiles(prefix)
+	} else {
+		n, err = tx.markFileIfUnvisited(relPath)
+	}
+	if err != nil {
+		return err
+	}
+	cfg.stats.numFilesSkipped.Add(n)
+	return nil
+}
+
+// Output the unvisited files as deleted files, remove them from db, then
+// clear the "visited" flag in db. Folders and symlinks recorded in db are
+// handled in the same way as files.
+// Note that we can't use range query alone. Consider this case: the db
+// contains one record for a normal file named "aa", and multiple records
+// for the files under folder "aab/". Then the user use "aa" as the prefix.
+// We should first check the prefix itself ("aa", which may also be a
+// folder record), then use range query on the prefix with a trailing
+// slash ("aa/").
+// An unvisited file matching a file in pending is moved instead (with
+// -moves). Its row is rewritten (rather than deleted) before the deletion.
+// Either way, it's no longer a copy source for pending.
+func handleDeletedFiles(cfg *config, tx storeTx, prefix string,
+	pending *pendingNewFiles) error {
+	numDeleted := int64(0)
+	var moves [][2]fileInfo
+	procUnvisitedFile := func(file *fileInfo) error {
+		pending.remove(file.relPath)
+		if cfg.moves {
+			if newFile := pending.take(file); newFile != nil {
+				outputMovedFile(cfg, file, newFile)
+				moves = append(moves, [2]fileInfo{*file, *newFile})
+				return nil
+			}
+		}
+		outputDeletedFile(cfg, file)
+		numDeleted++
+		return nil
+	}
+	applyMoves := func() error {
+		var err error
+		if cfg.update {
+			err = pending.applyMoves(tx, moves)
+		}
+		moves = nil
+		return err
+	}
+	// Delete the unvisited files under dirPrefix, and clear the visited
+	// flags.
+	deleteFiles := func(dirPrefix string) error {
+		if !cfg.update {
+			return nil
+		}
+		err := tx.deleteUnvisitedFiles(dirPrefix, numDeleted)
+		if err != nil {
+			return err
+		}
+		numCleared, err := tx.clearVisitedFlags(dirPrefix)
+		if err != nil {
+			return err
+		}
+		cfg.stats.numVisitedFlagsCleared.Add(numCleared)
+		return nil
+	}
+
+	if prefix == "" {
+		// Process all entries.
+		err := tx.queryUnvisitedFiles("", procUnvisitedFile)
+		if err != nil {
+			return err
+		}
+		if err = applyMoves(); err != nil {
+			return err
+		}
+		return deleteFiles("")
+	}
+
+	if prefix[len(prefix)-1] == '/' {
+		return fmt.Errorf("prefix '%s' has a trailing slash", prefix)
+	}
+
+	// Process "prefix"
+	file, visited, err := tx.queryFile(prefix)
+	if err != nil {
+		return err
+	}
+	if file != nil {
+		if visited {
+			if cfg.update {
+				if err = tx.clearVisitedFlag(prefix); err != nil {
+					return err
+				}
+				cfg.stats.numVisitedFlagsCleared.Add(1)
+			}
+		} else {
+			if err = procUnvisitedFile(file); err != nil {
+				return err
+			}
+			if err = applyMoves(); err != nil {
+				return err
+			}
+			if cfg.update && numDeleted != 0 {
+				if err = tx.deleteUnvisitedFile(prefix); err != nil {
+					return err
+				}
+			}
+			numDeleted = 0
+		}
+	}
+
+	// Process "prefix/..."
+	err = tx.queryUnvisitedFiles(prefix+"/", procUnvisitedFile)
+	if err != nil {
+		return err
+	}
+	if err = applyMoves(); err != nil {
+		return err
+	}
+	return deleteFiles(prefix + "/")
+}
+
+// Apply msg to tx.
+func applyDbUpdate(cfg *config, tx storeTx, pending *pendingNewFiles,
+	msg *dbUpdateMsg) error {
+	switch msg.opType {
+	case "I":
+		return tx.insertFile(&msg.info)
+	case "U":
+		return tx.updateAndMarkFile(&msg.info)
+	case "M":
+		return tx.markFile(msg.info.relPath)
+	case "N":
+		pending.add(&msg.info)
+		return nil
+	case "D":
+		return handleDeletedFiles(cfg, tx, msg.info.relPath, pending)
+	case "E":
+		if fileErr := skipFileError(cfg, msg.err); fileErr != nil {
+			outputErrorFile(cfg, fileErr)
+			return markSkippedFiles(cfg, tx, fileErr.Path, fileErr.dir)
+		}
+		// The scan is aborted with msg.err.
+		return nil
+	case "S":
+		return markSkippedFiles(cfg, tx, msg.info.relPath, false)
+	default:
+		return fmt.Errorf("Unknown opType %s", msg.opType)
+	}
+}
+
+// Called after all the messages are applied. Commit tx if cfg.update is
+// true, or roll it back otherwise.
+func finishDbUpdate(cfg *config, tx storeTx, pending *pendingNewFiles) error {
+	if pending != nil {
+		if err := pending.finish(cfg, tx); err != nil {
+			return err
+		}
+	}
+
+	if err := verifyStats(cfg); err != nil {
+		return err
+	}
+	if !cfg.update {
+		tx.rollback()
+		return nil
+	}
+	// The meta is only recorded along with the records, so that a failed
+	// run leaves it unchanged.
+	if err := tx.setMeta("hash", cfg.hashAlgo); err != nil {
+		return err
+	}
+	if cfg.history {
+		if err := tx.setMeta("history", "1"); err != nil {
+			return err
+		}
+		runId, err := tx.recordRun(time.Now())
+		if err != nil {
+			return err
+		}
+		cfg.logger.info("Recorded run %d", runId)
+	}
+	return tx.commit()
+}
+
+func dbUpdateWorker(cfg *config, wg *sync.WaitGroup,
+	cIn <-chan dbUpdateMsg) {
+	// This worker creates a tx on its own. All store APIs should use it.
+	// I.e., don't use cfg.store directly, except to look up the copy
+	// sources among the records before this run.
+	cfg.logger.debug("Started dbUpdateWorker")
+	tx, err := cfg.store.begin()
+	if err != nil {
+		cfg.errors.abort(err)
+	}
+	var pending *pendingNewFiles
+	if cfg.moves || cfg.copies {
+		pending = newPendingNewFiles()
+	}
+
+	for msg := range cIn {
+		if cfg.errors.aborted.Load() {
+			// Drain the channel.
+			continue
+		}
+		cfg.logger.debug("updating: %+v", msg)
+		if err = applyDbUpdate(cfg, tx, pending, &msg); err != nil {
+			cfg.errors.abort(err)
+		}
+	}
+
+	if !cfg.errors.aborted.Load() {
+		if err = finishDbUpdate(cfg, tx, pending); err != nil {
+			cfg.errors.abort(err)
+		}
+	}
+	if cfg.errors.aborted.Load() && tx != nil {
+		// Nothing is written to the store.
+		tx.rollback()
+	}
+
+	cfg.logger.debug("Stopped dbUpdateWorker")
+	wg.Done()
+}
@@ -0,0 +1,1494 @@
+package folderchecksum
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func fileCheckWorkerRunTests(t *testing.T, cfg *config,
+	mIn []fileCheckMsg, expectMOut []dbUpdateMsg, expectStdout string) {
+	var wg sync.WaitGroup
+	var builder strings.Builder
+	tx := make(chan fileCheckMsg)
+	rx := make(chan dbUpdateMsg)
+
+	origOutFile := cfg.outFile
+	defer func() { cfg.outFile = origOutFile }()
+	cfg.outFile = &builder
+	cfg.stats = &scanStats{}
+	cfg.output = &outputState{}
+	cfg.errors = &scanErrors{}
+
+	wg.Add(1)
+	go fileCheckWorker(0, cfg, &wg, tx, rx)
+
+	// Send len(mIn) messages.
+	go func() {
+		for _, m := range mIn {
+			tx <- m
+		}
+		close(tx)
+	}()
+
+	// Receive len(expectout) messages.
+	for i, expect := range expectMOut {
+		actual := <-rx
+		if actual != expect {
+			t.Errorf("actualOut[%d]: %+v", i, actual)
+			t.Errorf("expectOut[%d]: %+v", i, expect)
+			t.FailNow()
+		}
+	}
+	close(rx)
+	wg.Wait()
+
+	actualStdOut := builder.String()
+	if actualStdOut != expectStdout {
+		t.Errorf("actualStdout: %s", actualStdOut)
+		t.Errorf("expectStdout: %s", expectStdout)
+		t.FailNow()
+	}
+}
+
+func TestFileCheckWorker(t *testing.T) {
+	// - rootDir
+	// | file1exc
+	// | file.exc
+	// | exclude
+	// | - dir1.exc
+	// | | incfile1.exc
+	rootDir := filepath.Join(t.TempDir(), "rootDir")
+	err := os.Mkdir(rootDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "file1exc"), []byte("file1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "file.exc"), []byte("file1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "exclude"), []byte("file1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir1 := filepath.Join(rootDir, "dir1.exc")
+	err = os.Mkdir(dir1, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir1, "incfile1.exc"), []byte("dir1/file1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mIn := []fileCheckMsg{
+		{relPath: "exclude", size: 5},
+		{relPath: "file1exc", size: 5},
+		{relPath: "file.exc", size: 5},
+		{relPath: "dir1.exc/incfile1.exc", size: 10},
+	}
+
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	defaultCfg := config{
+		db:        db,
+		store:     newSqliteStore(db),
+		excludeRe: regexp.MustCompile(`^((.*\.exc)|(exclude))$`),
+		includeRe: regexp.MustCompile(`^(.*/)?inc[^/]*$`),
+		sizeOnly:  false,
+		update:    false,
+		hashAlgo:  "md5",
+		rootDir:   rootDir,
+	}
+
+	// Unchanged files.
+	cfg := defaultCfg
+	rows := []fileRow{
+		{
+			path:     "file1exc",
+			size:     5,
+			checksum: "826e8142e6baabe8af779f5f490cf5f5",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path: "dir1.exc/incfile1.exc",
+			size: 10,
+			// Missing checksum.
+			checksum: "",
+			visited:  false,
+		},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+	expectMOut := []dbUpdateMsg{
+		{"M", fileInfo{relPath: "file1exc", size: 5,
+			checksum: "826e8142e6baabe8af779f5f490cf5f5", algo: "md5"}, nil},
+		{"M", fileInfo{relPath: "dir1.exc/incfile1.exc", size: 10,
+			checksum: "a09ebcef8ab11daef0e33e4394ea775f", algo: "md5"}, nil},
+	}
+	expectStdout := "changed: dir1.exc/incfile1.exc\n"
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+	cfg.update = true
+	expectMOut = []dbUpdateMsg{
+		{"M", fileInfo{relPath: "file1exc", size: 5,
+			checksum: "826e8142e6baabe8af779f5f490cf5f5", algo: "md5"}, nil},
+		{"U", fileInfo{relPath: "dir1.exc/incfile1.exc", size: 10,
+			checksum: "a09ebcef8ab11daef0e33e4394ea775f", algo: "md5"}, nil},
+	}
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+
+	// New files.
+	cfg = defaultCfg
+	rows = []fileRow{
+		{
+			path:     "dir1.exc",
+			size:     10,
+			checksum: "a09ebcef8ab11daef0e33e4394ea775f",
+			algo:     "md5",
+			visited:  false,
+		},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+	expectMOut = []dbUpdateMsg{
+		{"I", fileInfo{relPath: "file1exc", size: 5,
+			checksum: "826e8142e6baabe8af779f5f490cf5f5", algo: "md5"}, nil},
+		{"I", fileInfo{relPath: "dir1.exc/incfile1.exc", size: 10,
+			checksum: "a09ebcef8ab11daef0e33e4394ea775f", algo: "md5"}, nil},
+	}
+	expectStdout = "new: file1exc\n" +
+		"new: dir1.exc/incfile1.exc\n"
+	// When cfg.update is false, expect empty dbUpdateMsg.
+	fileCheckWorkerRunTests(t, &cfg, mIn, []dbUpdateMsg{}, expectStdout)
+	cfg.update = true
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+
+	// Changed files.
+	cfg = defaultCfg
+	rows = []fileRow{
+		{
+			path:     "file1exc",
+			size:     123,
+			checksum: "826e8142e6baabe8af779f5f490cf5f5",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path: "dir1.exc/incfile1.exc",
+			size: 10,
+			// Missing checksum.
+			checksum: "",
+			visited:  false,
+		},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+	expectMOut = []dbUpdateMsg{
+		{"M", fileInfo{relPath: "file1exc", size: 5}, nil},
+		{"M", fileInfo{relPath: "dir1.exc/incfile1.exc", size: 10,
+			checksum: "a09ebcef8ab11daef0e33e4394ea775f", algo: "md5"}, nil},
+	}
+	expectStdout = "changed: file1exc\n" +
+		"changed: dir1.exc/incfile1.exc\n"
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+	cfg.update = true
+	expectMOut = []dbUpdateMsg{
+		{"U", fileInfo{relPath: "file1exc", size: 5,
+			checksum: "826e8142e6baabe8af779f5f490cf5f5", algo: "md5"}, nil},
+		{"U", fileInfo{relPath: "dir1.exc/incfile1.exc", size: 10,
+			checksum: "a09ebcef8ab11daef0e33e4394ea775f", algo: "md5"}, nil},
+	}
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+}
+
+func TestFileCheckWorkerSizeOnly(t *testing.T) {
+	// - rootDir
+	// | file1
+	// | - dir1
+	// | | file1
+	rootDir := filepath.Join(t.TempDir(), "rootDir")
+	err := os.Mkdir(rootDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "file1"), []byte("file1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir1 := filepath.Join(rootDir, "dir1")
+	err = os.Mkdir(dir1, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir1, "file1"), []byte("dir1/file1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mIn := []fileCheckMsg{
+		{relPath: "file1", size: 5},
+		{relPath: "dir1/file1", size: 10},
+	}
+
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	defaultCfg := config{
+		db:        db,
+		store:     newSqliteStore(db),
+		excludeRe: regexp.MustCompile(`^$`),
+		includeRe: regexp.MustCompile(`^$`),
+		sizeOnly:  true,
+		update:    false,
+		hashAlgo:  "md5",
+		rootDir:   rootDir,
+	}
+
+	// Unchanged files.
+	cfg := defaultCfg
+	rows := []fileRow{
+		{
+			path: "file1",
+			size: 5,
+			// Redundant checksum.
+			checksum: "abcde",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "dir1/file1",
+			size:     10,
+			checksum: "",
+			visited:  false,
+		},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+	expectMOut := []dbUpdateMsg{
+		{"M", fileInfo{relPath: "file1", size: 5}, nil},
+		{"M", fileInfo{relPath: "dir1/file1", size: 10}, nil},
+	}
+	expectStdout := ""
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+	cfg.update = true
+	expectMOut = []dbUpdateMsg{
+		{"U", fileInfo{relPath: "file1", size: 5}, nil},
+		{"M", fileInfo{relPath: "dir1/file1", size: 10}, nil},
+	}
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+
+	// New files.
+	cfg = defaultCfg
+	rows = []fileRow{
+		{
+			path:     "dir1",
+			size:     10,
+			checksum: "a09ebcef8ab11daef0e33e4394ea775f",
+			algo:     "md5",
+			visited:  false,
+		},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+	expectMOut = []dbUpdateMsg{
+		{"I", fileInfo{relPath: "file1", size: 5}, nil},
+		{"I", fileInfo{relPath: "dir1/file1", size: 10}, nil},
+	}
+	expectStdout = "new: file1\n" +
+		"new: dir1/file1\n"
+	// When cfg.update is false, expect empty dbUpdateMsg.
+	fileCheckWorkerRunTests(t, &cfg, mIn, []dbUpdateMsg{}, expectStdout)
+	cfg.update = true
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+
+	// Changed files.
+	cfg = defaultCfg
+	rows = []fileRow{
+		{
+			path: "file1",
+			size: 123,
+			// Redundant checksum.
+			checksum: "826e8142e6baabe8af779f5f490cf5f5",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "dir1/file1",
+			size:     123,
+			checksum: "",
+			visited:  false,
+		},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+	expectMOut = []dbUpdateMsg{
+		{"M", fileInfo{relPath: "file1", size: 5}, nil},
+		{"M", fileInfo{relPath: "dir1/file1", size: 10}, nil},
+	}
+	expectStdout = "changed: file1\n" +
+		"changed: dir1/file1\n"
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+	cfg.update = true
+	expectMOut = []dbUpdateMsg{
+		{"U", fileInfo{relPath: "file1", size: 5}, nil},
+		{"U", fileInfo{relPath: "dir1/file1", size: 10}, nil},
+	}
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+}
+
+func dbUpdateWorkerRunTest(t *testing.T, cfg *config,
+	mIn []dbUpdateMsg, expectRows []fileRow, expectStdout string) {
+	var wg sync.WaitGroup
+	var builder strings.Builder
+	tx := make(chan dbUpdateMsg)
+
+	origOutFile := cfg.outFile
+	defer func() { cfg.outFile = origOutFile }()
+	cfg.outFile = &builder
+
+	cfg.stats = &scanStats{}
+	cfg.output = &outputState{}
+	cfg.errors = &scanErrors{}
+	wg.Add(1)
+	go dbUpdateWorker(cfg, &wg, tx)
+
+	for _, m := range mIn {
+		// In this test we don't create fileCheckWorker, so update the
+		// stats here.
+		switch m.opType {
+		case "I":
+			cfg.stats.numFilesNew.Add(1)
+		case "U":
+			cfg.stats.numFilesChanged.Add(1)
+		case "M":
+			cfg.stats.numFilesUnchanged.Add(1)
+		case "D", "N", "E", "S":
+		default:
+			t.Fatalf("Unknown opType %s", m.opType)
+		}
+		tx <- m
+	}
+	close(tx)
+	wg.Wait()
+
+	actualRows := getAllRowsFromFiles(t, cfg.db)
+	verifyFileRows(t, actualRows, expectRows)
+
+	actualStdOut := builder.String()
+	if actualStdOut != expectStdout {
+		t.Errorf("actualStdout: %s", actualStdOut)
+		t.Errorf("expectStdout: %s", expectStdout)
+		t.FailNow()
+	}
+}
+
+func TestDbUpdateWorker(t *testing.T) {
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	defaultCfg := config{
+		db:     db,
+		store:  newSqliteStore(db),
+		update: false,
+	}
+
+	// Insert, update, mark.
+	cfg := defaultCfg
+	rows := []fileRow{
+		{
+			path:     "file1",
+			size:     5,
+			checksum: "aaa",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "dir1/file1",
+			size:     10,
+			checksum: "bbb",
+			algo:     "md5",
+			visited:  false,
+		},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+	mIn := []dbUpdateMsg{
+		{"I", fileInfo{relPath: "dir1/file2", size: 20,
+			checksum: "ccc", algo: "md5"}, nil},
+		{"U", fileInfo{relPath: "dir1/file1", size: 20,
+			checksum: "ccc", algo: "md5"}, nil},
+		{"M", fileInfo{relPath: "file1", size: 0}, nil},
+		{"D", fileInfo{relPath: "", size: 0}, nil},
+	}
+	expectRows := []fileRow{
+		{
+			path:     "dir1/file1",
+			size:     20,
+			checksum: "ccc",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "dir1/file2",
+			size:     20,
+			checksum: "ccc",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "file1",
+			size:     5,
+			checksum: "aaa",
+			algo:     "md5",
+			visited:  false,
+		},
+	}
+	expectStdout := ""
+	dbUpdateWorkerRunTest(t, &cfg, mIn, copyAndSortFileRows(rows), expectStdout)
+	cfg.update = true
+	dbUpdateWorkerRunTest(t, &cfg, mIn, expectRows, expectStdout)
+
+	// Originally dir1 was a folder in db. Then it becomes a file.
+	cfg = defaultCfg
+	rows = []fileRow{
+		{
+			path:     "file1",
+			size:     5,
+			checksum: "aaa",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "dir1/file1",
+			size:     10,
+			checksum: "bbb",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "dir1/file2",
+			size:     10,
+			checksum: "ccc",
+			algo:     "md5",
+			visited:  false,
+		},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+	mIn = []dbUpdateMsg{
+		{"I", fileInfo{relPath: "dir1", size: 20,
+			checksum: "ddd", algo: "md5"}, nil},
+		{"D", fileInfo{relPath: "dir1", size: 0}, nil},
+	}
+	expectRows = []fileRow{
+		{
+			path:     "dir1",
+			size:     20,
+			checksum: "ddd",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "file1",
+			size:     5,
+			checksum: "aaa",
+			algo:     "md5",
+			visited:  false,
+		},
+	}
+	expectStdout = "deleted: dir1/file1\n" +
+		"deleted: dir1/file2\n"
+	dbUpdateWorkerRunTest(t, &cfg, mIn, copyAndSortFileRows(rows), expectStdout)
+	cfg.update = true
+	dbUpdateWorkerRunTest(t, &cfg, mIn, expectRows, expectStdout)
+
+	// Originally dir1 was a file in db. Then it becomes a folder.
+	cfg = defaultCfg
+	rows = []fileRow{
+		{
+			path:     "file1",
+			size:     5,
+			checksum: "aaa",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "dir1",
+			size:     5,
+			checksum: "bbb",
+			algo:     "md5",
+			visited:  false,
+		},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+	mIn = []dbUpdateMsg{
+		{"I", fileInfo{relPath: "dir1/file1", size: 10,
+			checksum: "ccc", algo: "md5"}, nil},
+		{"I", fileInfo{relPath: "dir1/file2", size: 10,
+			checksum: "ddd", algo: "md5"}, nil},
+		{"D", fileInfo{relPath: "dir1", size: 0}, nil},
+	}
+	expectRows = []fileRow{
+		{
+			path:     "dir1/file1",
+			size:     10,
+			checksum: "ccc",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "dir1/file2",
+			size:     10,
+			checksum: "ddd",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "file1",
+			size:     5,
+			checksum: "aaa",
+			algo:     "md5",
+			visited:  false,
+		},
+	}
+	expectStdout = "deleted: dir1\n"
+	dbUpdateWorkerRunTest(t, &cfg, mIn, copyAndSortFileRows(rows), expectStdout)
+	cfg.update = true
+	dbUpdateWorkerRunTest(t, &cfg, mIn, expectRows, expectStdout)
+}
+
+func TestDbUpdateWorkerSkipError(t *testing.T) {
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	rows := []fileRow{
+		{
+			path:     "dir1/file1",
+			size:     10,
+			checksum: "aaa",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "dir1/file2",
+			size:     10,
+			checksum: "bbb",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "file1",
+			size:     5,
+			checksum: "ccc",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "file2",
+			size:     5,
+			checksum: "ddd",
+			algo:     "md5",
+			visited:  false,
+		},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+	// The entries under dir1 are not walked.
+	mIn := []dbUpdateMsg{
+		{"E", fileInfo{relPath: "dir1"}, &FileError{Path: "dir1",
+			Err: os.ErrPermission, dir: true}},
+		{"E", fileInfo{relPath: "file2"}, &FileError{Path: "file2",
+			Err: os.ErrPermission}},
+		{"M", fileInfo{relPath: "file1", size: 5}, nil},
+		{"D", fileInfo{relPath: ""}, nil},
+	}
+
+	// Aborted by the first error.
+	cfg := config{
+		db:     db,
+		store:  newSqliteStore(db),
+		update: true,
+	}
+	dbUpdateWorkerRunTest(t, &cfg, mIn, copyAndSortFileRows(rows), "")
+	if err := cfg.errors.get(); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("Incorrect error: %v", err)
+	}
+
+	// The rows of the skipped entries are not deleted.
+	cfg.skipError = func(err *FileError) bool { return true }
+	expectStdout := "error: dir1 (permission denied)\n" +
+		"error: file2 (permission denied)\n"
+	dbUpdateWorkerRunTest(t, &cfg, mIn, copyAndSortFileRows(rows),
+		expectStdout)
+	if err := cfg.errors.get(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.errors.skipped) != 2 || cfg.errors.skipped[0].Path != "dir1" ||
+		cfg.errors.skipped[1].Path != "file2" {
+		t.Fatalf("Incorrect skipped entries: %+v", cfg.errors.skipped)
+	}
+	if n := cfg.stats.numFilesError.Load(); n != 2 {
+		t.Fatalf("Incorrect numFilesError: %d", n)
+	}
+	if n := cfg.stats.numFilesSkipped.Load(); n != 3 {
+		t.Fatalf("Incorrect numFilesSkipped: %d", n)
+	}
+}
+
+func TestFileCheckWorkerRowAlgo(t *testing.T) {
+	// - rootDir
+	// | file1
+	// | file2
+	rootDir := filepath.Join(t.TempDir(), "rootDir")
+	err := os.Mkdir(rootDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "file1"), []byte("file1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "file2"), []byte("file2"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mIn := []fileCheckMsg{
+		{relPath: "file1", size: 5},
+		{relPath: "file2", size: 5},
+	}
+
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	defaultCfg := config{
+		db:        db,
+		store:     newSqliteStore(db),
+		excludeRe: regexp.MustCompile(`^$`),
+		includeRe: regexp.MustCompile(`^$`),
+		sizeOnly:  false,
+		update:    false,
+		hashAlgo:  "md5",
+		rootDir:   rootDir,
+	}
+
+	// file1 is unchanged, file2 is changed. Both of them are compared
+	// using sha256 stored in db.
+	cfg := defaultCfg
+	rows := []fileRow{
+		{
+			path: "file1",
+			size: 5,
+			checksum: "c147efcfc2d7ea666a9e4f5187b115c9" +
+				"0903f0fc896a56df9a6ef5d8f3fc9f31",
+			algo:    "sha256",
+			visited: false,
+		},
+		{
+			path:     "file2",
+			size:     5,
+			checksum: "aaa",
+			algo:     "sha256",
+			visited:  false,
+		},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+	expectMOut := []dbUpdateMsg{
+		{"M", fileInfo{relPath: "file1", size: 5,
+			checksum: rows[0].checksum.(string), algo: "sha256"}, nil},
+		{"M", fileInfo{relPath: "file2", size: 5,
+			checksum: "3377870dfeaaa7adf79a374d2702a3fd" +
+				"b13e5e5ea0dd8aa95a802ad39044a92f", algo: "sha256"}, nil},
+	}
+	expectStdout := "changed: file2\n"
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+
+	// With -update, the unchanged file keeps its algorithm, and the
+	// changed file is updated using cfg.hashAlgo.
+	cfg.update = true
+	expectMOut = []dbUpdateMsg{
+		{"M", fileInfo{relPath: "file1", size: 5,
+			checksum: rows[0].checksum.(string), algo: "sha256"}, nil},
+		{"U", fileInfo{relPath: "file2", size: 5,
+			checksum: "1c1c96fd2cf8330db0bfa936ce82f3b9", algo: "md5"}, nil},
+	}
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+}
+
+func TestFileCheckWorkerQuick(t *testing.T) {
+	// - rootDir
+	// | file1
+	// | file2
+	rootDir := filepath.Join(t.TempDir(), "rootDir")
+	err := os.Mkdir(rootDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "file1"), []byte("file1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "file2"), []byte("file2"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat1 := fileStat{mtime: 1, ctime: 2, inode: 3, dev: 4}
+	stat2 := fileStat{mtime: 5, ctime: 6, inode: 7, dev: 8}
+	mIn := []fileCheckMsg{
+		{relPath: "file1", size: 5, stat: stat1},
+		{relPath: "file2", size: 5, stat: stat2},
+	}
+
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	defaultCfg := config{
+		db:        db,
+		store:     newSqliteStore(db),
+		excludeRe: regexp.MustCompile(`^$`),
+		includeRe: regexp.MustCompile(`^$`),
+		sizeOnly:  false,
+		quick:     true,
+		update:    false,
+		hashAlgo:  "md5",
+		rootDir:   rootDir,
+	}
+
+	// The content of both files are different from db. file1 has the
+	// same stat tuple so it's not read. file2 has a different ctime.
+	cfg := defaultCfg
+	rows := []fileRow{
+		{
+			path:     "file1",
+			size:     5,
+			checksum: "aaa",
+			algo:     "md5",
+			stat:     stat1,
+			visited:  false,
+		},
+		{
+			path:     "file2",
+			size:     5,
+			checksum: "bbb",
+			algo:     "md5",
+			stat:     fileStat{mtime: 5, ctime: 0, inode: 7, dev: 8},
+			visited:  false,
+		},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+	expectMOut := []dbUpdateMsg{
+		{"M", fileInfo{relPath: "file1", size: 5,
+			checksum: "aaa", algo: "md5", stat: stat1}, nil},
+		{"M", fileInfo{relPath: "file2", size: 5,
+			checksum: "1c1c96fd2cf8330db0bfa936ce82f3b9", algo: "md5",
+			stat: stat2}, nil},
+	}
+	expectStdout := "changed: file2\n"
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+	cfg.update = true
+	expectMOut[1].opType = "U"
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+
+	// Without quick mode, both files are read. The stat tuple of an
+	// unchanged file is refreshed in db.
+	cfg = defaultCfg
+	cfg.quick = false
+	rows[0].checksum = "826e8142e6baabe8af779f5f490cf5f5"
+	rows[1].checksum = "1c1c96fd2cf8330db0bfa936ce82f3b9"
+	clearAndInsertRowsToFiles(t, db, rows)
+	expectMOut = []dbUpdateMsg{
+		{"M", fileInfo{relPath: "file1", size: 5,
+			checksum: "826e8142e6baabe8af779f5f490cf5f5", algo: "md5",
+			stat: stat1}, nil},
+		{"M", fileInfo{relPath: "file2", size: 5,
+			checksum: "1c1c96fd2cf8330db0bfa936ce82f3b9", algo: "md5",
+			stat: stat2}, nil},
+	}
+	expectStdout = ""
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+	cfg.update = true
+	expectMOut[1].opType = "U"
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+}
+
+func TestFileCheckWorkerLinks(t *testing.T) {
+	// - rootDir
+	// | link1 -> file1
+	// | link2 -> file2
+	// | link3 -> file3
+	rootDir := filepath.Join(t.TempDir(), "rootDir")
+	err := os.Mkdir(rootDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"1", "2", "3"} {
+		err = os.Symlink("file"+name, filepath.Join(rootDir, "link"+name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mIn := []fileCheckMsg{
+		{relPath: "link1", size: 5, fileType: typeLink},
+		{relPath: "link2", size: 5, fileType: typeLink},
+		{relPath: "link3", size: 5, fileType: typeLink},
+	}
+
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	defaultCfg := config{
+		db:        db,
+		store:     newSqliteStore(db),
+		excludeRe: regexp.MustCompile(`^$`),
+		includeRe: regexp.MustCompile(`^$`),
+		sizeOnly:  false,
+		update:    false,
+		hashAlgo:  "md5",
+		rootDir:   rootDir,
+	}
+
+	// link1 is unchanged, link2 is retargeted, link3 was a regular file.
+	cfg := defaultCfg
+	rows := []fileRow{
+		{
+			path:     "link1",
+			size:     5,
+			fileType: typeLink,
+			target:   "file1",
+			visited:  false,
+		},
+		{
+			path:     "link2",
+			size:     5,
+			fileType: typeLink,
+			target:   "fileX",
+			visited:  false,
+		},
+		{
+			path:     "link3",
+			size:     5,
+			checksum: "aaa",
+			algo:     "md5",
+			visited:  false,
+		},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+	expectMOut := []dbUpdateMsg{
+		{"M", fileInfo{relPath: "link1", size: 5,
+			fileType: typeLink, target: "file1"}, nil},
+		{"M", fileInfo{relPath: "link2", size: 5,
+			fileType: typeLink, target: "file2"}, nil},
+		{"M", fileInfo{relPath: "link3", size: 5,
+			fileType: typeLink, target: "file3"}, nil},
+	}
+	expectStdout := "changed: link2\n" +
+		"changed: link3\n"
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+	cfg.update = true
+	expectMOut[1].opType = "U"
+	expectMOut[2].opType = "U"
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+
+	// New links.
+	cfg = defaultCfg
+	clearAndInsertRowsToFiles(t, db, []fileRow{})
+	expectStdout = "new: link1\n" +
+		"new: link2\n" +
+		"new: link3\n"
+	fileCheckWorkerRunTests(t, &cfg, mIn, []dbUpdateMsg{}, expectStdout)
+	cfg.update = true
+	for i := range expectMOut {
+		expectMOut[i].opType = "I"
+	}
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+}
+
+func TestFileCheckWorkerDirs(t *testing.T) {
+	mIn := []fileCheckMsg{
+		{relPath: "dir1", fileType: typeDir},
+		{relPath: "dir2", fileType: typeDir},
+		{relPath: "dir3", fileType: typeDir},
+	}
+
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	defaultCfg := config{
+		db:        db,
+		store:     newSqliteStore(db),
+		excludeRe: regexp.MustCompile(`^$`),
+		includeRe: regexp.MustCompile(`^$`),
+		sizeOnly:  false,
+		update:    false,
+		hashAlgo:  "md5",
+		rootDir:   t.TempDir(),
+	}
+
+	// dir1 is unchanged, dir2 was a regular file, dir3 is new.
+	cfg := defaultCfg
+	rows := []fileRow{
+		{
+			path:     "dir1",
+			fileType: typeDir,
+			visited:  false,
+		},
+		{
+			path:     "dir2",
+			size:     0,
+			checksum: "aaa",
+			algo:     "md5",
+			visited:  false,
+		},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+	expectMOut := []dbUpdateMsg{
+		{"M", fileInfo{relPath: "dir1", fileType: typeDir}, nil},
+		{"M", fileInfo{relPath: "dir2", fileType: typeDir}, nil},
+	}
+	expectStdout := "changed: dir2\n" +
+		"new: dir3\n"
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+	cfg.update = true
+	expectMOut[1].opType = "U"
+	expectMOut = append(expectMOut,
+		dbUpdateMsg{"I", fileInfo{relPath: "dir3", fileType: typeDir}, nil})
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+
+	// Folders are tested against the patterns.
+	cfg = defaultCfg
+	cfg.excludeRe = regexp.MustCompile(`^dir[23]$`)
+	expectMOut = []dbUpdateMsg{
+		{"M", fileInfo{relPath: "dir1", fileType: typeDir}, nil},
+	}
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, "")
+}
+
+func TestFileCheckWorkerMeta(t *testing.T) {
+	// - rootDir
+	// | file1
+	// | file2
+	rootDir := filepath.Join(t.TempDir(), "rootDir")
+	err := os.Mkdir(rootDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "file1"), []byte("file1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "file2"), []byte("file2"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := fileStat{mtime: 1e9, mode: 0777, uid: 1000, gid: 0}
+	mIn := []fileCheckMsg{
+		{relPath: "file1", size: 5, stat: stat},
+		{relPath: "file2", size: 5, stat: stat},
+	}
+
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	defaultCfg := config{
+		db:        db,
+		store:     newSqliteStore(db),
+		excludeRe: regexp.MustCompile(`^$`),
+		includeRe: regexp.MustCompile(`^$`),
+		sizeOnly:  false,
+		update:    false,
+		hashAlgo:  "md5",
+		rootDir:   rootDir,
+	}
+
+	// file1 is chmod'ed and chown'ed. The content of file2 is changed,
+	// and its mode, uid and gid are not recorded in db.
+	rows := []fileRow{
+		{
+			path:     "file1",
+			size:     5,
+			checksum: "826e8142e6baabe8af779f5f490cf5f5",
+			algo:     "md5",
+			stat:     fileStat{mtime: 1e9, mode: 0644, uid: 0, gid: 0},
+			visited:  false,
+		},
+		{
+			path:     "file2",
+			size:     5,
+			checksum: "aaa",
+			algo:     "md5",
+			stat:     fileStat{mtime: 2e9, mode: -1, uid: -1, gid: -1},
+			visited:  false,
+		},
+	}
+	expectMOut := []dbUpdateMsg{
+		{"M", fileInfo{relPath: "file1", size: 5,
+			checksum: "826e8142e6baabe8af779f5f490cf5f5", algo: "md5",
+			stat: stat}, nil},
+		{"M", fileInfo{relPath: "file2", size: 5,
+			checksum: "1c1c96fd2cf8330db0bfa936ce82f3b9", algo: "md5",
+			stat: stat}, nil},
+	}
+
+	// Nothing is tracked.
+	cfg := defaultCfg
+	clearAndInsertRowsToFiles(t, db, rows)
+	expectStdout := "changed: file2\n"
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+
+	// Track all attributes.
+	cfg.track = trackedAttrs{mode: true, uid: true, gid: true, mtime: true}
+	expectStdout = "metachanged: file1 (mode: 0644 -> 0777, uid: 0 -> 1000)\n" +
+		"metachanged: file2 (mtime: 1970-01-01T00:00:02Z -> " +
+		"1970-01-01T00:00:01Z)\n" +
+		"changed: file2\n"
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+
+	// Only track mode. The new attributes are recorded by -update.
+	cfg.track = trackedAttrs{mode: true}
+	cfg.update = true
+	expectStdout = "metachanged: file1 (mode: 0644 -> 0777)\n" +
+		"changed: file2\n"
+	expectMOut[0].opType = "U"
+	expectMOut[1].opType = "U"
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+}
+
+func TestDbUpdateWorkerMoves(t *testing.T) {
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	defaultCfg := config{
+		db:     db,
+		store:  newSqliteStore(db),
+		update: false,
+		moves:  true,
+	}
+
+	// a/file1 is moved to b/moved1 (handled before its new prefix), and
+	// b/file3 is moved to a/moved3 (handled after its new prefix).
+	cfg := defaultCfg
+	rows := []fileRow{
+		{
+			path:     "a/file1",
+			size:     5,
+			checksum: "aaa",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "a/file2",
+			size:     5,
+			checksum: "bbb",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "b/file3",
+			size:     5,
+			checksum: "ccc",
+			algo:     "md5",
+			visited:  false,
+		},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+	mIn := []dbUpdateMsg{
+		{"N", fileInfo{relPath: "b/new", size: 5,
+			checksum: "eee", algo: "md5"}, nil},
+		{"N", fileInfo{relPath: "b/moved1", size: 5,
+			checksum: "aaa", algo: "md5"}, nil},
+		{"N", fileInfo{relPath: "a/moved3", size: 5,
+			checksum: "ccc", algo: "md5"}, nil},
+		// Same checksum, but computed by another algorithm.
+		{"N", fileInfo{relPath: "b/new2", size: 5,
+			checksum: "bbb", algo: "sha256"}, nil},
+		{"D", fileInfo{relPath: "a"}, nil},
+		{"D", fileInfo{relPath: "b"}, nil},
+	}
+	expectRows := []fileRow{
+		{
+			path:     "a/moved3",
+			size:     5,
+			checksum: "ccc",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "b/moved1",
+			size:     5,
+			checksum: "aaa",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "b/new",
+			size:     5,
+			checksum: "eee",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "b/new2",
+			size:     5,
+			checksum: "bbb",
+			algo:     "sha256",
+			visited:  false,
+		},
+	}
+	expectStdout := "moved: a/file1 -> b/moved1\n" +
+		"deleted: a/file2\n" +
+		"moved: b/file3 -> a/moved3\n" +
+		"new: b/new\n" +
+		"new: b/new2\n"
+	dbUpdateWorkerRunTest(t, &cfg, mIn, copyAndSortFileRows(rows), expectStdout)
+	cfg.update = true
+	dbUpdateWorkerRunTest(t, &cfg, mIn, expectRows, expectStdout)
+
+	// Without prefix. The file is moved to the one with the smallest path.
+	cfg = defaultCfg
+	clearAndInsertRowsToFiles(t, db, rows[:1])
+	mIn = []dbUpdateMsg{
+		{"N", fileInfo{relPath: "c", size: 5, checksum: "aaa", algo: "md5"}, nil},
+		{"N", fileInfo{relPath: "b", size: 5, checksum: "aaa", algo: "md5"}, nil},
+		{"D", fileInfo{relPath: ""}, nil},
+	}
+	expectRows = []fileRow{
+		{
+			path:     "b",
+			size:     5,
+			checksum: "aaa",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "c",
+			size:     5,
+			checksum: "aaa",
+			algo:     "md5",
+			visited:  false,
+		},
+	}
+	expectStdout = "moved: a/file1 -> b\n" +
+		"new: c\n"
+	cfg.update = true
+	dbUpdateWorkerRunTest(t, &cfg, mIn, expectRows, expectStdout)
+}
+
+func TestFileCheckWorkerMoves(t *testing.T) {
+	rootDir := filepath.Join(t.TempDir(), "rootDir")
+	err := os.Mkdir(rootDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "file1"), []byte("file1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "empty"), []byte(""), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mIn := []fileCheckMsg{
+		{relPath: "empty", size: 0},
+		{relPath: "file1", size: 5},
+	}
+
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	// New files are checksummed and held back even without -update,
+	// except empty ones.
+	cfg := config{
+		db:        db,
+		store:     newSqliteStore(db),
+		excludeRe: regexp.MustCompile(`^$`),
+		includeRe: regexp.MustCompile(`^$`),
+		moves:     true,
+		hashAlgo:  "md5",
+		rootDir:   rootDir,
+	}
+	clearAndInsertRowsToFiles(t, db, []fileRow{})
+	expectMOut := []dbUpdateMsg{
+		{"N", fileInfo{relPath: "file1", size: 5,
+			checksum: "826e8142e6baabe8af779f5f490cf5f5", algo: "md5"}, nil},
+	}
+	expectStdout := "new: empty\n"
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+}
+
+func TestFileCheckWorkerCopies(t *testing.T) {
+	rootDir := filepath.Join(t.TempDir(), "rootDir")
+	err := os.Mkdir(rootDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "file1"), []byte("file1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "empty"), []byte(""), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mIn := []fileCheckMsg{
+		{relPath: "empty", size: 0},
+		{relPath: "file1", size: 5},
+	}
+
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	// New files are checksummed and held back until the deleted files
+	// are known, except empty ones.
+	cfg := config{
+		db:        db,
+		store:     newSqliteStore(db),
+		excludeRe: regexp.MustCompile(`^$`),
+		includeRe: regexp.MustCompile(`^$`),
+		copies:    true,
+		hashAlgo:  "md5",
+		rootDir:   rootDir,
+	}
+	clearAndInsertRowsToFiles(t, db, []fileRow{})
+	expectMOut := []dbUpdateMsg{
+		{"N", fileInfo{relPath: "file1", size: 5,
+			checksum: "826e8142e6baabe8af779f5f490cf5f5", algo: "md5"}, nil},
+	}
+	expectStdout := "new: empty\n"
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+	cfg.update = true
+	expectMOut = append([]dbUpdateMsg{
+		{"I", fileInfo{relPath: "empty", size: 0,
+			checksum: "d41d8cd98f00b204e9800998ecf8427e", algo: "md5"}, nil},
+	}, expectMOut...)
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+}
+
+func TestDbUpdateWorkerCopies(t *testing.T) {
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	// file1 exists in db under two other paths, and the smaller one is
+	// deleted in this run. file2 has the same checksum as a symlink and a
+	// file of another size.
+	cfg := config{
+		db:     db,
+		store:  newSqliteStore(db),
+		copies: true,
+	}
+	rows := []fileRow{
+		{
+			path:     "dir1/file1",
+			size:     5,
+			checksum: "aaa",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "dir2/file1",
+			size:     5,
+			checksum: "aaa",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "file3",
+			size:     6,
+			checksum: "bbb",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "link1",
+			size:     5,
+			checksum: "bbb",
+			algo:     "md5",
+			fileType: typeLink,
+			visited:  false,
+		},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+	mIn := []dbUpdateMsg{
+		{"M", fileInfo{relPath: "dir2/file1"}, nil},
+		{"N", fileInfo{relPath: "file2", size: 5,
+			checksum: "bbb", algo: "md5"}, nil},
+		{"N", fileInfo{relPath: "file1", size: 5,
+			checksum: "aaa", algo: "md5"}, nil},
+		{"M", fileInfo{relPath: "file3"}, nil},
+		{"M", fileInfo{relPath: "link1"}, nil},
+		{"D", fileInfo{relPath: ""}, nil},
+	}
+	expectRows := []fileRow{
+		rows[1],
+		{
+			path:     "file1",
+			size:     5,
+			checksum: "aaa",
+			algo:     "md5",
+			visited:  false,
+		},
+		{
+			path:     "file2",
+			size:     5,
+			checksum: "bbb",
+			algo:     "md5",
+			visited:  false,
+		},
+		rows[2],
+		rows[3],
+	}
+	// The same output with or without -update.
+	expectStdout := "deleted: dir1/file1\n" +
+		"copied: dir2/file1 -> file1\n" +
+		"new: file2\n"
+	dbUpdateWorkerRunTest(t, &cfg, mIn, copyAndSortFileRows(rows),
+		expectStdout)
+	cfg.update = true
+	dbUpdateWorkerRunTest(t, &cfg, mIn, expectRows, expectStdout)
+}
+
+func TestFileCheckWorkerUnknownSize(t *testing.T) {
+	// - rootDir
+	// | file1
+	// | file2
+	rootDir := filepath.Join(t.TempDir(), "rootDir")
+	err := os.Mkdir(rootDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "file1"), []byte("file1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "file2"), []byte("file2"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mIn := []fileCheckMsg{
+		{relPath: "file1", size: 5, stat: fileStat{mtime: 1}},
+		{relPath: "file2", size: 5, stat: fileStat{mtime: 1}},
+	}
+
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	cfg := config{
+		db:        db,
+		store:     newSqliteStore(db),
+		excludeRe: regexp.MustCompile(`^$`),
+		includeRe: regexp.MustCompile(`^$`),
+		hashAlgo:  "md5",
+		rootDir:   rootDir,
+	}
+
+	// Imported from a manifest without sizes. file1 is unchanged, and
+	// file2 is changed.
+	unknown := fileStat{mode: -1, uid: -1, gid: -1}
+	rows := []fileRow{
+		{
+			path:     "file1",
+			size:     unknownSize,
+			checksum: "826e8142e6baabe8af779f5f490cf5f5",
+			algo:     "md5",
+			stat:     unknown,
+		},
+		{
+			path:     "file2",
+			size:     unknownSize,
+			checksum: "826e8142e6baabe8af779f5f490cf5f5",
+			algo:     "md5",
+			stat:     unknown,
+		},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+	expectStdout := "changed: file2\n"
+	cfg.update = true
+	expectMOut := []dbUpdateMsg{
+		{"U", fileInfo{relPath: "file1", size: 5,
+			checksum: "826e8142e6baabe8af779f5f490cf5f5", algo: "md5",
+			stat: fileStat{mtime: 1}}, nil},
+		{"U", fileInfo{relPath: "file2", size: 5,
+			checksum: "1c1c96fd2cf8330db0bfa936ce82f3b9", algo: "md5",
+			stat: fileStat{mtime: 1}}, nil},
+	}
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+}
+
+// Return a symlink under a new rootDir to a file whose size never matches
+// the bytes read, which is always deemed modified while being read.
+func prepareUnstableFile(t *testing.T) (string, string) {
+	target := "/proc/self/status"
+	if _, err := os.Stat(target); err != nil {
+		t.Skip(err)
+	}
+	rootDir := t.TempDir()
+	err := os.Symlink(target, filepath.Join(rootDir, "unstable"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rootDir, "unstable"
+}
+
+func TestCalcChecksums(t *testing.T) {
+	rootDir := prepareTestDir(t)
+	checksums, n, err := calcChecksums(filepath.Join(rootDir, "file1"),
+		[]string{"md5", "sha256"}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 || len(checksums) != 2 ||
+		checksums[0] != "826e8142e6baabe8af779f5f490cf5f5" {
+		t.Fatalf("Incorrect checksums: %v, %d", checksums, n)
+	}
+
+	rootDir, relPath := prepareUnstableFile(t)
+	_, _, err = calcChecksums(filepath.Join(rootDir, relPath),
+		[]string{"md5"}, 2, nil)
+	if !errors.Is(err, errUnstable) {
+		t.Fatalf("Expected errUnstable, got %v", err)
+	}
+}
+
+func TestFileCheckWorkerUnstable(t *testing.T) {
+	rootDir, relPath := prepareUnstableFile(t)
+	mIn := []fileCheckMsg{
+		{relPath: relPath, size: 0},
+	}
+
+	db := prepareTestDb(t)
+	defer db.Close()
+
+	cfg := config{
+		db:        db,
+		store:     newSqliteStore(db),
+		excludeRe: regexp.MustCompile(`^$`),
+		includeRe: regexp.MustCompile(`^$`),
+		update:    true,
+		hashAlgo:  "md5",
+		retries:   1,
+		rootDir:   rootDir,
+	}
+
+	// The file is neither inserted nor updated.
+	expectMOut := []dbUpdateMsg{
+		{"S", fileInfo{relPath: relPath}, nil},
+	}
+	expectStdout := "unstable: unstable\n"
+	clearAndInsertRowsToFiles(t, db, []fileRow{})
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+	rows := []fileRow{
+		{
+			path:     relPath,
+			size:     0,
+			checksum: "aaa",
+			algo:     "md5",
+			visited:  false,
+		},
+	}
+	clearAndInsertRowsToFiles(t, db, rows)
+	fileCheckWorkerRunTests(t, &cfg, mIn, expectMOut, expectStdout)
+
+	// Its record is left untouched instead of being deleted.
+	mIn2 := append(expectMOut, dbUpdateMsg{"D", fileInfo{relPath: ""}, nil})
+	dbUpdateWorkerRunTest(t, &cfg, mIn2, rows, "")
+	if n := cfg.stats.numFilesSkipped.Load(); n != 1 {
+		t.Fatalf("Incorrect numFilesSkipped: %d", n)
+	}
+}
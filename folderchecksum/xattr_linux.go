@@ -0,0 +1,95 @@
+package folderchecksum
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const xattrsSupported = true
+
+// Call fn with a growing buffer until it's large enough. fn has the same
+// semantics as listxattr(2) and getxattr(2).
+func readXattrBuf(fn func(buf []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := fn(nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := fn(buf)
+		if errors.Is(err, unix.ERANGE) {
+			// Changed in between, try again.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// Return the digest of the extended attributes of path in the given
+// namespaces (e.g., "security" for "security.selinux"). The digest is
+// prefixed with the namespaces, so that digests computed with different
+// namespaces are never compared. Symlinks are not followed if noFollow
+// is true. A file system without xattr support is treated as having no
+// xattrs.
+func getXattrsDigest(path string, noFollow bool,
+	namespaces []string) (string, error) {
+	listxattr := unix.Listxattr
+	getxattr := unix.Getxattr
+	if noFollow {
+		listxattr = unix.Llistxattr
+		getxattr = unix.Lgetxattr
+	}
+
+	list, err := readXattrBuf(func(buf []byte) (int, error) {
+		return listxattr(path, buf)
+	})
+	if errors.Is(err, unix.ENOTSUP) {
+		list = nil
+	} else if err != nil {
+		return "", fmt.Errorf("Failed to list xattrs of '%s': %w", path, err)
+	}
+
+	var names []string
+	for _, name := range bytes.Split(list, []byte{0}) {
+		ns, _, ok := strings.Cut(string(name), ".")
+		if !ok {
+			continue
+		}
+		i := sort.SearchStrings(namespaces, ns)
+		if i < len(namespaces) && namespaces[i] == ns {
+			names = append(names, string(name))
+		}
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		value, err := readXattrBuf(func(buf []byte) (int, error) {
+			return getxattr(path, name, buf)
+		})
+		if errors.Is(err, unix.ENODATA) {
+			// Removed in between.
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("Failed to get xattr %s of '%s': %w", name,
+				path, err)
+		}
+		// Values may contain any bytes, so prefix them with the length.
+		fmt.Fprintf(h, "%s\x00%d\x00", name, len(value))
+		h.Write(value)
+	}
+
+	return strings.Join(namespaces, ",") + ":" +
+		hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,107 @@
+package folderchecksum
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestXattrsDigest(t *testing.T) {
+	rootDir := prepareTestDir(t)
+	path := filepath.Join(rootDir, "file1")
+	link := filepath.Join(rootDir, "dir2", "file1")
+
+	err := unix.Setxattr(path, "user.test", []byte("value1"), 0)
+	if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) {
+		t.Skipf("xattrs not supported: %s", err.Error())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest1, err := getXattrsDigest(path, false, []string{"user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(digest1, "user:") {
+		t.Fatalf("Incorrect digest: %s", digest1)
+	}
+	// The link is followed.
+	digest, err := getXattrsDigest(link, false, []string{"user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != digest1 {
+		t.Fatalf("Incorrect digest of link: %s", digest)
+	}
+	// The other namespaces are filtered out.
+	empty, err := getXattrsDigest(path, false, []string{"trusted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty2, err := getXattrsDigest(filepath.Join(rootDir, "file2"), false,
+		[]string{"trusted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty != empty2 {
+		t.Fatalf("Incorrect digest: %s", empty)
+	}
+	if change := getXattrsChange(digest1, empty); change != "" {
+		t.Fatalf("Digests of different namespaces compared: %s", change)
+	}
+
+	err = unix.Setxattr(path, "user.test", []byte("value2"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest2, err := getXattrsDigest(path, false, []string{"user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	change := getXattrsChange(digest1, digest2)
+	if change != "xattrs: "+digest1[5:17]+" -> "+digest2[5:17] {
+		t.Fatalf("Incorrect change: %s", change)
+	}
+	if change := getXattrsChange("", digest2); change != "" {
+		t.Fatalf("Unrecorded digest compared: %s", change)
+	}
+
+	// Removing the xattr restores the digest of a file without xattrs.
+	err = unix.Removexattr(path, "user.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest3, err := getXattrsDigest(path, false, []string{"user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest4, err := getXattrsDigest(filepath.Join(rootDir, "file2"), false,
+		[]string{"user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest3 != digest4 {
+		t.Fatalf("Incorrect digest: %s, %s", digest3, digest4)
+	}
+}
+
+func TestParseXattrNamespaces(t *testing.T) {
+	namespaces, err := parseXattrNamespaces(
+		[]string{"system", " security", "system"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(namespaces, ",") != "security,system" {
+		t.Fatalf("Incorrect namespaces: %v", namespaces)
+	}
+	if namespaces, _ = parseXattrNamespaces(nil); namespaces != nil {
+		t.Fatal("Expected nil")
+	}
+	if _, err = parseXattrNamespaces([]string{"user.x"}); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package folderchecksum
+
+import (
+	"fmt"
+)
+
+const xattrsSupported = false
+
+func getXattrsDigest(path string, noFollow bool,
+	namespaces []string) (string, error) {
+	return "", fmt.Errorf("Extended attributes are only supported on Linux")
+}
@@ -2,4 +2,9 @@ module github.com/liuqx0717/FolderChecksum
 
 go 1.20
 
-require github.com/mattn/go-sqlite3 v1.14.16
+require (
+	github.com/cespare/xxhash/v2 v2.2.0
+	github.com/mattn/go-sqlite3 v1.14.16
+	golang.org/x/crypto v0.17.0
+	golang.org/x/sys v0.15.0
+)
@@ -4,10 +4,23 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"sync"
+
+	"github.com/liuqx0717/FolderChecksum/folderchecksum"
 )
 
+// The exit code when some files are not checked, i.e., skipped by
+// -keep-going or unstable. It differs from 2, which the flag package uses
+// for usage errors.
+const exitIncomplete = 3
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd := findCommand(os.Args[1]); cmd != nil {
+			cmd.run(cmd, os.Args[2:])
+			return
+		}
+	}
+
 	// Parse arguments.
 	flag.Parse()
 	if flg.version {
@@ -15,53 +28,16 @@ func main() {
 		os.Exit(0)
 	}
 	parsePositionalArgs()
-	cfg := flagsToConfig(&flg)
-	if cfg.followLinks {
-		logFatal("Option not implemented")
-	}
-	logInfo("Using database file: %s", cfg.dbFile)
-	mustCreateFilesTableIfNeeded(cfg.db)
-
-	// Start workers (1 dbUpdateWorker and j fileCheckWorker).
-	chFileCheck := make(chan fileCheckMsg)
-	chDbUpdate := make(chan dbUpdateMsg, 128)
-	var wgDbUpdate sync.WaitGroup
-	var wgFileCheck sync.WaitGroup
-	wgDbUpdate.Add(1)
-	wgFileCheck.Add(cfg.j)
-	go dbUpdateWorker(cfg, &wgDbUpdate, chDbUpdate)
-	for i := 0; i < cfg.j; i++ {
-		go fileCheckWorker(i+1, cfg, &wgFileCheck, chFileCheck, chDbUpdate)
-	}
 
-	// Walk the folder.
-	procOneFile := func(relPath string, size int64) {
-		chFileCheck <- fileCheckMsg{relPath, size}
+	scanner, err := folderchecksum.NewScanner(flagsToOptions(&flg))
+	if err != nil {
+		logFatal("%s", err.Error())
 	}
-	if len(cfg.prefix) == 0 {
-		mustWalkDir(cfg.rootDir, "", cfg.followLinks, procOneFile)
-	} else {
-		for _, prefix := range cfg.prefix {
-			mustWalkDir(cfg.rootDir, prefix, cfg.followLinks, procOneFile)
-		}
+	result, err := scanner.Run()
+	if err != nil {
+		logFatal("%s", err.Error())
 	}
-
-	// Wait for fileCheckWorker.
-	close(chFileCheck)
-	wgFileCheck.Wait()
-
-	// Check the deleted files.
-	if len(cfg.prefix) == 0 {
-		chDbUpdate <- dbUpdateMsg{"D", fileInfo{"", 0, ""}}
-	} else {
-		for _, prefix := range cfg.prefix {
-			chDbUpdate <- dbUpdateMsg{"D", fileInfo{prefix, 0, ""}}
-		}
+	if len(result.Errors) != 0 || result.Stats.Unstable != 0 {
+		os.Exit(exitIncomplete)
 	}
-
-	// Wait for dbUpdateWorker.
-	close(chDbUpdate)
-	wgDbUpdate.Wait()
-
-	cfg.db.Close()
 }